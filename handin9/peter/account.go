@@ -18,33 +18,48 @@ type Peer struct {
 }
 
 type Message struct {
-	ID    string
-	Value interface{}
+	ID      string
+	Value   interface{}
+	TraceID string // Set on traced transactions and blocks. Empty if the message isn't traced
+	Hops    int    // How many times a traced message has been passed on
 }
 
 type InitInfo struct {
-	Peers        []Peer
+	Peers        []TimedPeer // A random sample of the address book
 	GenesisBlock GenesisBlock
 }
 
 const TRANSACTION_MESSAGE = "transMsg"                 // When the message contains a transaction
-const NEW_PEER_MESSAGE = "newPeerMsg"                  // When the message contains a new peer
 const REQUEST_INIT_INFO_MESSAGE = "requestInitInfoMsg" // When the message requests the initial info
 const INIT_INFO_MESSAGE = "initInfoMsg"                // When the message contains the initial info
 const BLOCK_MESSAGE = "blockMsg"                       // When a block is sent
+const HELLO_MESSAGE = "helloMsg"                       // The first message sent on every connection
+const HELLO_ACK_MESSAGE = "helloAckMsg"                // Proves possession of the key sent in the hello
+const DISCONNECT_MESSAGE = "disconnectMsg"             // Sent right before closing a connection, with a reason
+const KEY_EXCHANGE_MESSAGE = "keyExchangeMsg"          // Sets up an encrypted channel after the hello
+const PING_MESSAGE = "pingMsg"                         // A heartbeat, which is answered with a pong
+const PONG_MESSAGE = "pongMsg"                         // The answer to a heartbeat
+const PEER_LEFT_MESSAGE = "peerLeftMsg"                // When a peer has left the network
+const GETADDR_MESSAGE = "getAddrMsg"                   // Asks for a sample of the address book
+const ADDR_MESSAGE = "addrMsg"                         // Contains peers, and when they were last seen
+const GET_BLOCK_MESSAGE = "getBlockMsg"                // Asks for a block by its signature, and its transactions
+const HEADER_MESSAGE = "headerMsg"                     // A block header, which is sent to light clients instead of the block
+const GET_PROOF_MESSAGE = "getProofMsg"                // Asks a full node for a proof of a balance or a transaction
+const PROOF_MESSAGE = "proofMsg"                       // The answer to a GET_PROOF_MESSAGE
 
 func (t *SignedTransaction) isValid() bool {
 	// Get public key of the sender
 
-	if t.Amount < 1 {
+	if t.Amount < 1 || !isValidKeyString(t.From) {
 		return false
 	}
 
 	pk := GeneratePublicKeyFromString(t.From)
 
-	signatureString := t.Signature
-	signature := new(big.Int)
-	signature.SetString(signatureString, 10)
+	signature, ok := new(big.Int).SetString(t.Signature, 10)
+	if !ok {
+		return false
+	}
 	message := GenerateMessageFromTransaction(t)
 
 	verify := Verify(message, signature, pk)
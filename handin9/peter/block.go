@@ -1,30 +1,93 @@
 package main
 
-import "math/big"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"time"
+)
 
-type Block struct {
+// The part of a block which is signed. TxRoot commits to the transactions in the body, and StateRoot
+// to the balances after the block and the transactions used so far
+type BlockHeader struct {
 	ID            int
 	PreviousBlock string
 	Sender        string
-	Transactions  []string
+	TxRoot        string // The Merkle root over the hashes of the transactions, as hex
+	StateRoot     string // The root over the balances and the used transactions after the block, see stateRoot
 	Signature     string
 	Draw          *big.Int
 }
 
+type BlockBody struct {
+	Transactions []string // The IDs of the transactions, in the order of the Merkle tree
+}
+
+type Block struct {
+	BlockHeader
+	BlockBody
+}
+
+// Returns an unsigned block
+func NewBlock(id int, previous string, sender string, transactions []string, txRoot string, draw *big.Int) *Block {
+	return &Block{
+		BlockHeader{ID: id, PreviousBlock: previous, Sender: sender, TxRoot: txRoot, Draw: draw},
+		BlockBody{Transactions: transactions},
+	}
+}
+
 type GenesisBlock struct {
 	*Block
-	KingKeys []string
-	Seed     int
+	KingKeys    []string // The accounts which take part in the lottery
+	Seed        int
+	Allocations []Allocation // The balance of each account before the first block
+	SlotLength  time.Duration
+	Hardness    *big.Int
+	StartTime   time.Time // When slot 1 begins. If zero, the slots are counted from when the lottery is started
+
+	ParamsSignature string // The creator's signature of the fields above. The block signature only covers the block
+}
+
+// Creates a genesis block signed by creator, where every king starts with PREMIUM_ACCOUNT
+func NewGenesisBlock(creator KeyPair, kingKeys []string, seed int, startTime time.Time) *GenesisBlock {
+	var allocations []Allocation
+	for _, key := range kingKeys {
+		allocations = append(allocations, Allocation{key, PREMIUM_ACCOUNT})
+	}
+
+	genesis := &GenesisBlock{KingKeys: kingKeys, Seed: seed, Allocations: allocations, SlotLength: SLOT_LENGTH, Hardness: new(big.Int).Set(HARDNESS), StartTime: startTime}
+	genesis.Sign(creator)
+
+	return genesis
 }
 
-func (b *Block) isValid() bool {
+// Returns true if the header is signed by its sender. The body is checked against TxRoot separately,
+// since that needs the transactions
+func (b *BlockHeader) isValid() bool {
+	if !isValidKeyString(b.Sender) {
+		return false
+	}
 
 	pk := GeneratePublicKeyFromString(b.Sender)
 
-	blockMsg := GenerateMessageFromBlock(b)
+	blockMsg := GenerateMessageFromHeader(b)
 
-	temp := new(big.Int)
-	signature, _ := temp.SetString(b.Signature, 10)
+	// A signature which isn't a number can't be verified
+	signature, ok := new(big.Int).SetString(b.Signature, 10)
+	if !ok {
+		return false
+	}
 
 	return Verify(blockMsg, signature, pk)
 }
+
+// Returns a hash identifying the chain that starts with this genesis block
+func (g *GenesisBlock) Hash() string {
+	sha := sha256.New()
+	sha.Write(GenerateMessageFromBlock(g.Block))
+	sha.Write([]byte(g.Signature))
+	sha.Write(g.paramsMessage())
+	sha.Write([]byte(g.ParamsSignature))
+
+	return hex.EncodeToString(sha.Sum(nil))
+}
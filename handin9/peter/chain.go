@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// A chain file holds everything a client has seen: the genesis block, the transactions, and every
+// block it has added, forks included, so a run can be loaded into another one, or shared. It is JSON
+// lines: the first line has the version of the format, the second the genesis block, and each line
+// after that a transaction or a block. A block comes after its previous block and its transactions.
+// Blocks and transactions are written like the JSON-RPC methods send them, with big numbers as
+// strings. Nothing in the file is trusted: the blocks are checked one by one like blocks from a peer,
+// against the slot of the importing client, and the first invalid line stops the import.
+
+// One line of a chain file. Only one of the fields is set
+type ChainRecord struct {
+	Version     int              `json:"version,omitempty"`
+	Genesis     *GenesisJSON     `json:"genesis,omitempty"`
+	Transaction *TransactionJSON `json:"transaction,omitempty"`
+	Block       *BlockJSON       `json:"block,omitempty"`
+}
+
+// The genesis block as it is written to a chain file. The slot length is in nanoseconds
+type GenesisJSON struct {
+	Block           BlockJSON        `json:"block"`
+	KingKeys        []string         `json:"kingKeys"`
+	Seed            int              `json:"seed"`
+	Allocations     []AllocationJSON `json:"allocations"`
+	SlotLength      time.Duration    `json:"slotLength"`
+	Hardness        string           `json:"hardness"`
+	StartTime       time.Time        `json:"startTime"`
+	ParamsSignature string           `json:"paramsSignature"`
+}
+
+type AllocationJSON struct {
+	Account string `json:"account"`
+	Amount  int    `json:"amount"`
+}
+
+type Chain struct {
+	Genesis *GenesisBlock
+	Records []ChainRecord // The transactions and blocks, from the third line of the file and on
+}
+
+func genesisToJSON(g *GenesisBlock) GenesisJSON {
+	var allocations []AllocationJSON
+	for _, allocation := range g.Allocations {
+		allocations = append(allocations, AllocationJSON{allocation.Account, allocation.Amount})
+	}
+
+	hardness := ""
+	if g.Hardness != nil {
+		hardness = g.Hardness.String()
+	}
+
+	return GenesisJSON{blockToJSON(g.Block), g.KingKeys, g.Seed, allocations, g.SlotLength, hardness, g.StartTime, g.ParamsSignature}
+}
+
+func (g GenesisJSON) toGenesisBlock() (*GenesisBlock, error) {
+	block, err := g.Block.toBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var allocations []Allocation
+	for _, allocation := range g.Allocations {
+		allocations = append(allocations, Allocation{allocation.Account, allocation.Amount})
+	}
+
+	var hardness *big.Int
+	if g.Hardness != "" {
+		var ok bool
+		if hardness, ok = new(big.Int).SetString(g.Hardness, 10); !ok {
+			return nil, errors.New("malformed hardness")
+		}
+	}
+
+	return &GenesisBlock{block, g.KingKeys, g.Seed, allocations, g.SlotLength, hardness, g.StartTime, g.ParamsSignature}, nil
+}
+
+// Returns the line of the file the record is on
+func chainLine(index int) int {
+	return index + 3
+}
+
+// Returns how many blocks and transactions the chain has
+func (chain *Chain) count() (int, int) {
+	blocks, transactions := 0, 0
+	for _, record := range chain.Records {
+		if record.Block != nil {
+			blocks++
+		} else {
+			transactions++
+		}
+	}
+
+	return blocks, transactions
+}
+
+// Returns the transactions and the blocks of this client, in the order they were added
+func (s *State) exportChain() (*Chain, error) {
+	if s.light {
+		return nil, errors.New("a light client only has the headers of the blocks")
+	}
+
+	if s.snapshot != nil {
+		return nil, errors.New("a client started from a snapshot only has the headers of the blocks below it")
+	}
+
+	chain := &Chain{Genesis: s.genesisBlock}
+
+	for _, transaction := range s.transactionsReceived {
+		record := transactionToJSON(transaction)
+		chain.Records = append(chain.Records, ChainRecord{Transaction: &record})
+	}
+
+	// The genesis block is the first block, and it is on a line of its own
+	for _, block := range s.blocks[1:] {
+		record := blockToJSON(block)
+		chain.Records = append(chain.Records, ChainRecord{Block: &record})
+	}
+
+	return chain, nil
+}
+
+// Adds the transactions and blocks of the chain, which has to be of the genesis block of this
+// client. The client mustn't have any other blocks or transactions yet. The slot is the one the
+// client is at by its own clock, and blocks from later slots are rejected, like blocks from a peer.
+// A client whose slots haven't started yet passes NO_SLOT, and its slots go on from the last block
+// of the chain. Returns an error describing the first invalid line
+func (s *State) importChain(chain *Chain, slot int) error {
+	if s.light {
+		return errors.New("a light client can't check the bodies of the blocks")
+	}
+
+	if len(s.blocks) > 1 || len(s.transactionsReceived) > 0 {
+		return errors.New("the client already has blocks or transactions")
+	}
+
+	if chain.Genesis.Hash() != s.genesisBlock.Hash() {
+		return errors.New("line 2: the chain is of another genesis block")
+	}
+
+	s.currentBlockID = slot
+	if slot == NO_SLOT {
+		s.currentBlockID = MAX_INT
+	}
+
+	last := 0
+	for i, record := range chain.Records {
+		if record.Transaction != nil {
+			transaction := record.Transaction.toTransaction()
+
+			switch s.applyTransaction(transaction) {
+			case VERDICT_INVALID:
+				return fmt.Errorf("line %d: transaction %s isn't valid", chainLine(i), transaction.ID)
+			case VERDICT_DUPLICATE:
+				return fmt.Errorf("line %d: transaction %s is there twice", chainLine(i), transaction.ID)
+			}
+
+			continue
+		}
+
+		block, err := record.Block.toBlock()
+		if err != nil {
+			return fmt.Errorf("line %d: %w", chainLine(i), err)
+		}
+
+		// Anything but a useful block is an error, since everything it needs is earlier in the file
+		if verdict, err := s.checkBlock(block); verdict != VERDICT_USEFUL {
+			return fmt.Errorf("line %d: the block in slot %d %w", chainLine(i), block.ID, err)
+		}
+
+		s.addBlock(block)
+		if block.ID > last {
+			last = block.ID
+		}
+	}
+
+	if slot == NO_SLOT {
+		s.currentBlockID = last
+	}
+
+	return nil
+}
+
+func (c *Client) exportChain() (*Chain, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.exportChain()
+}
+
+func (c *Client) importChain(chain *Chain, slot int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.importChain(chain, slot)
+}
+
+func saveChain(chain *Chain, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer) // Writes each record on a line of its own
+
+	if err := encoder.Encode(ChainRecord{Version: CHAIN_VERSION}); err != nil {
+		return err
+	}
+
+	genesis := genesisToJSON(chain.Genesis)
+	if err := encoder.Encode(ChainRecord{Genesis: &genesis}); err != nil {
+		return err
+	}
+
+	for _, record := range chain.Records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// Reads a chain, and checks the version and the genesis block. The transactions and blocks are
+// checked when it is imported
+func loadChain(path string) (*Chain, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, MAX_MESSAGE_SIZE)
+
+	chain := &Chain{}
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		var record ChainRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d of %s isn't valid JSON: %w", line, path, err)
+		}
+
+		switch line {
+		case 1:
+			if record.Version != CHAIN_VERSION {
+				return nil, fmt.Errorf("unsupported chain version %d in %s, expected %d", record.Version, path, CHAIN_VERSION)
+			}
+
+		case 2:
+			if record.Genesis == nil {
+				return nil, fmt.Errorf("line 2 of %s isn't a genesis block", path)
+			}
+
+			genesis, err := record.Genesis.toGenesisBlock()
+			if err != nil || !genesis.isValid() {
+				return nil, fmt.Errorf("line 2 of %s isn't a valid genesis block", path)
+			}
+			chain.Genesis = genesis
+
+		default:
+			if (record.Transaction == nil) == (record.Block == nil) {
+				return nil, fmt.Errorf("line %d of %s has to have either a transaction or a block", line, path)
+			}
+			chain.Records = append(chain.Records, record)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read line %d of %s: %w", line+1, path, err)
+	}
+
+	if chain.Genesis == nil {
+		return nil, errors.New(path + " has no genesis block")
+	}
+
+	return chain, nil
+}
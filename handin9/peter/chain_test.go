@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Saves the chain of the state, and loads it again
+func roundTripChain(t *testing.T, s *State) *Chain {
+	t.Helper()
+
+	chain, err := s.exportChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "chain.jsonl")
+	if err := saveChain(chain, path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadChain(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return loaded
+}
+
+func TestChainRoundTrip(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestChain(t, keys, 4)
+	chain := roundTripChain(t, s)
+
+	other := &State{}
+	other.setGenesisBlock(chain.Genesis)
+	if err := other.importChain(chain, 4); err != nil {
+		t.Fatalf("a valid chain was rejected: %v", err)
+	}
+
+	if head, want := other.getLongestBlock(MAX_INT), s.getLongestBlock(MAX_INT); head.Signature != want.Signature {
+		t.Error("the imported chain has another head")
+	}
+
+	// A client whose slots haven't started goes on from the last block
+	other = &State{}
+	other.setGenesisBlock(chain.Genesis)
+	if err := other.importChain(chain, NO_SLOT); err != nil {
+		t.Fatal(err)
+	}
+
+	if other.currentBlockID != 4 {
+		t.Errorf("got slot %d after the import, expected 4", other.currentBlockID)
+	}
+}
+
+func TestChainWritesBigNumbersAsStrings(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestChain(t, keys, 1)
+
+	chain, err := s.exportChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "chain.jsonl")
+	if err := saveChain(chain, path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := s.blocks[1]
+	if !strings.Contains(string(data), `"draw":"`+block.Draw.String()+`"`) {
+		t.Error("the draw of the block isn't written as a string")
+	}
+}
+
+func TestChainRejectsBlocksAfterTheSlot(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestChain(t, keys, 4)
+	chain := roundTripChain(t, s)
+
+	other := &State{}
+	other.setGenesisBlock(chain.Genesis)
+	err := other.importChain(chain, 2)
+	if err == nil {
+		t.Fatal("imported blocks from slots the client hasn't reached")
+	}
+
+	if !strings.Contains(err.Error(), "in slot 4 is too far ahead of slot 2") {
+		t.Errorf("got %q, expected the reason of the first block after the slot", err)
+	}
+}
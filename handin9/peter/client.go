@@ -1,359 +1,615 @@
 package main
 
 import (
-	"encoding/gob"
-	"fmt"
+	"errors"
+	"io"
+	"math/rand"
 	"net"
-	"sort"
+	"sync"
 	"time"
 )
 
 type Client struct {
-	outboundMessages     chan Message        // A channel for all messages
-	connections          []net.Conn          // A list of all current connections
-	transactionsSent     []string            // A list of already broadcasted transactions
-	transactionsReceived []SignedTransaction // A list of all received transactions
-	peers                []Peer              // List of all peers in the network
-	ownPeer              Peer                // The id of this peer (public key as string)
-	firstPeer            bool                // Indicated if this client is the first peer in the network
-	blocks               []*Block            // A list of all received blocks
-	genesisBlock         *GenesisBlock
-	currentBlockID       int
+	State
+	lock sync.Mutex // Guards State. Every goroutine has to hold it while reading or changing the state
+
+	outboundMessages chan Message // A channel for all messages
+	connections      []*PeerConn  // A list of all current connections
+	connectionsLock  sync.Mutex   // Guards connections
+	ownPeer          Peer         // The id of this peer (public key as string)
+	firstPeer        bool         // Indicated if this client is the first peer in the network
+	peerManager      *PeerManager
+	topology         Topology // Which peers to connect to. Guarded by lock
+	reputation       *Reputation
+	listener         net.Listener
+	rpc              *RPCServer // Nil until the JSON-RPC server is started
+	events           *EventBus
+	faults           *Faults
+	tracer           *Tracer
+	proofWaiters     *ProofWaiters // The proof requests of a light client which haven't been answered yet
+	stopped          chan struct{} // Closed when the client leaves the network
+	activity         *Activity     // Counts the messages which are still being handled, see Simulator. Nil outside a simulation
 
 	pk PublicKey
 	sk SecretKey
-
-	transactionID int
 }
 
+// The methods below wrap the state transitions of State, and hold the lock while they run.
+// Peers are returned as copies, since the list of peers may change once the lock is released.
+
 func (c *Client) GetPeerFromPK(str string) *Peer {
-	for i := 0; i < len(c.peers); i++ {
-		if str == c.peers[i].Pk {
-			return &c.peers[i]
-		}
-	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	return nil
+	return copyPeer(c.State.GetPeerFromPK(str))
+}
+
+func (c *Client) getBoundPeer(address string) *Peer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return copyPeer(c.State.getBoundPeer(address))
 }
 
 func (c *Client) GetPeerFromIP(ip string) *Peer {
-	for i := 0; i < len(c.peers); i++ {
-		if ip == c.peers[i].Address {
-			return &c.peers[i]
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return copyPeer(c.State.GetPeerFromIP(ip))
+}
+
+func copyPeer(peer *Peer) *Peer {
+	if peer == nil {
+		return nil
+	}
+
+	copy := *peer
+	return &copy
+}
+
+func (c *Client) getPeers() []Peer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]Peer{}, c.peers...)
+}
+
+func (c *Client) addPeer(peer Peer) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.addPeer(peer)
+}
+
+func (c *Client) removePeer(address string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.removePeer(address)
+}
+
+// Returns the known peers, other than this client, in the order the topology prefers them.
+// The second value is how many of them the client should connect to
+func (c *Client) candidatePeers() ([]Peer, int) {
+	c.lock.Lock()
+	var known []Peer
+	for _, peer := range c.peers {
+		if peer.Address != c.ownPeer.Address {
+			known = append(known, peer)
 		}
 	}
+	candidates := c.topology.Candidates(c.ownPeer, known, c.random)
+	target := c.topology.OutboundTarget(len(known))
+	c.lock.Unlock()
 
-	return nil
+	return candidates, target
 }
 
-func (c *Client) getPeerList(targetIP string) {
+func (c *Client) getTopology() Topology {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.topology
+}
+
+// Changes the topology, and drops the outbound connections which don't fit the new one
+func (c *Client) setTopology(topology Topology) {
+	c.lock.Lock()
+	c.topology = topology
+	c.lock.Unlock()
+
+	if c.peerManager != nil {
+		c.peerManager.rebalance()
+	}
+}
+
+func (c *Client) getGenesisBlock() *GenesisBlock {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.genesisBlock
+}
+
+func (c *Client) setGenesisBlock(genesis *GenesisBlock) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.setGenesisBlock(genesis)
+}
+
+func (c *Client) transactionCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.transactionsReceived)
+}
+
+func (c *Client) nextTransactionID() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := c.transactionID
+	c.transactionID++
+	return id
+}
+
+func (c *Client) generateNewestLedger() (*Ledger, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.generateNewestLedger()
+}
+
+func (c *Client) generateLedgerForBlock(block *Block) (*Ledger, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.generateLedgerForBlock(block)
+}
+
+// Joins the network through the peer at targetIP. Returns true if it got the genesis block and peers
+func (c *Client) getPeerList(targetIP string) bool {
 
 	// Try to establish connection
 	conn, err := net.Dial("tcp", targetIP)
 
 	if err != nil {
-		fmt.Println("No peer found or invalid IP/Port")
+		c.log.Info(LOG_NETWORK, "No peer found or invalid IP/Port", "peer", targetIP)
 		c.firstPeer = true
 	} else {
 		c.firstPeer = false
 
-		defer conn.Close()
+		pc := NewPeerConn(conn)
+		pc.dialed = targetIP
+		defer pc.Close()
+
+		if err := c.performHandshake(pc, true); err != nil {
+			c.log.Warn(LOG_NETWORK, "Handshake failed", "peer", targetIP, "error", err)
+			return false
+		}
 
 		//Request peer list
 		var message = Message{ID: REQUEST_INIT_INFO_MESSAGE}
-		c.sendMessage(conn, message)
+		if !c.sendMessage(pc, message) {
+			return false
+		}
 
 		// Wait for response
-		var newMessage = &Message{}
-		var dec = gob.NewDecoder(conn)
-		var err = dec.Decode(newMessage)
+		newMessage, err := pc.ReadMessage()
 		if err != nil {
-			fmt.Println("Error while reading init info: ", err.Error())
-			return
+			c.log.Warn(LOG_NETWORK, "Error while reading init info", "peer", targetIP, "error", err)
+			return false
 		} else if newMessage.ID != INIT_INFO_MESSAGE {
-			fmt.Println("Got an unexspected response from other peer: " + newMessage.ID)
-			return
+			c.log.Warn(LOG_NETWORK, "Got an unexpected response from other peer", "peer", targetIP, "type", newMessage.ID)
+			return false
 		}
 
 		initInfo, ok := newMessage.Value.(InitInfo)
 
 		if !ok {
-			panic("Error while decoding InitInfo from message")
+			c.log.Warn(LOG_NETWORK, "Got malformed init info", "peer", targetIP)
+			return false
+		}
+
+		// The genesis block has to be the one the peer claimed in the handshake
+		if !initInfo.GenesisBlock.isValid() || initInfo.GenesisBlock.Hash() != pc.remote.GenesisHash {
+			c.log.Warn(LOG_NETWORK, "Got a genesis block which doesn't match the handshake", "peer", targetIP)
+			return false
 		}
 
-		c.peers = initInfo.Peers
-		c.setGenesisBlock(&initInfo.GenesisBlock)
+		c.lock.Lock()
+		c.bindDialedPeer(pc)
+		for _, timed := range initInfo.Peers {
+			c.markPeerSeen(timed.Peer, timed.LastSeen)
+		}
+		// A node started from a genesis file already has it, and the handshake has checked it's the same.
+		// The genesis block has been checked above, so it can't be rejected
+		if c.genesisBlock == nil {
+			c.State.setGenesisBlock(&initInfo.GenesisBlock)
+		}
+		c.lock.Unlock()
+
+		return true
 	}
+
+	return false
 }
 
-func (c *Client) sendMessage(conn net.Conn, msg Message) {
-	var enc = gob.NewEncoder(conn)
-	var err = enc.Encode(&msg)
+// Sends a message to a single connection. If it fails, the connection is closed and dropped
+func (c *Client) sendMessage(pc *PeerConn, msg Message) bool {
+	err := pc.WriteMessage(msg)
 	if err != nil {
-		fmt.Println("Got error when sending message: ", err.Error())
-		fmt.Println("Message:", msg)
+		c.log.Warn(LOG_NETWORK, "Got error when sending message", "peer", pc.RemoteAddr(), "type", msg.ID, "error", err)
+		c.removeConnection(pc)
+		return false
 	}
+
+	return true
 }
 
-func (c *Client) setupListeningServer() net.Listener {
-	fmt.Println("Listening for connections on:")
-	ln, _ := net.Listen("tcp", ":")
+func (c *Client) addConnection(pc *PeerConn) {
+	c.connectionsLock.Lock()
+	defer c.connectionsLock.Unlock()
+
+	c.connections = append(c.connections, pc)
+
+	go c.writeMessages(pc)
+
+	c.events.Publish(EVENT_PEER_JOINED, connectionToJSON(pc))
+}
+
+// Closes the connection and removes it from the list of connections
+func (c *Client) removeConnection(pc *PeerConn) {
+	pc.Close()
+	c.reputation.Forget(pc)
 
-	// Printing the IP's
-	var address = getOwnAddress()
+	c.connectionsLock.Lock()
+	defer c.connectionsLock.Unlock()
 
-	// Printing the port
-	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	for i, tempConn := range c.connections {
+		if tempConn == pc {
+			c.connections = append(c.connections[:i], c.connections[i+1:]...)
+			c.events.Publish(EVENT_PEER_LEFT, connectionToJSON(pc))
+			return
+		}
+	}
+}
 
-	// Generate address
-	fullAddress := address + ":" + port
-	fmt.Println(fullAddress)
+// Returns a copy of the current connections, which is safe to iterate over
+func (c *Client) getConnections() []*PeerConn {
+	c.connectionsLock.Lock()
+	defer c.connectionsLock.Unlock()
 
-	c.ownPeer = Peer{Address: fullAddress, Pk: c.pk.toString()}
+	return append([]*PeerConn{}, c.connections...)
+}
 
+func (c *Client) setupListeningServer() net.Listener {
+	ln, _ := c.listen(":", "")
 	return ln
 }
 
+// Listens on the address, and sets the address other peers should use to reach this client.
+// If advertise is empty, it's the IP of this machine and the port that was listened on
+func (c *Client) listen(address string, advertise string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if advertise == "" {
+		// Printing the port
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+		// Generate address
+		advertise = getOwnAddress() + ":" + port
+	}
+	c.ownPeer = Peer{Address: advertise, Pk: c.pk.toString()}
+	c.listener = ln
+	c.log = newPeerLogger(c.ownPeer)
+
+	c.log.Info(LOG_NETWORK, "Listening for connections", "listen", ln.Addr().String())
+
+	return ln, nil
+}
+
 func (c *Client) listenForConnections(ln net.Listener) {
 	defer ln.Close()
 
 	for {
-		conn, _ := ln.Accept()
-		go c.handleConnection(conn)
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.log.Error(LOG_NETWORK, "Stopped listening for connections", "error", err)
+			}
+			return
+		}
+
+		go func() {
+			pc := NewPeerConn(conn)
+			if c.openConnection(pc) {
+				c.handleConnection(pc)
+			}
+		}()
 	}
 }
 
-func (c *Client) handleConnection(conn net.Conn) {
-	defer conn.Close()
+// Runs the handshake on a new connection, and adds it to the list of connections if it succeeds
+func (c *Client) openConnection(pc *PeerConn) bool {
+	if err := c.performHandshake(pc, false); err != nil {
+		c.log.Warn(LOG_NETWORK, "Handshake failed", "peer", pc.RemoteAddr(), "error", err)
+		pc.Close()
+		return false
+	}
 
-	c.connections = append(c.connections, conn)
+	// A joining node is never used for gossip
+	if pc.remote.Join {
+		c.serveJoin(pc)
+		return false
+	}
 
-	for {
-		var decoder = gob.NewDecoder(conn)
-		var message = Message{}
-		var err = decoder.Decode(&message)
+	c.lock.Lock()
+	c.bindDialedPeer(pc)
+	c.lock.Unlock()
 
-		if err != nil {
+	c.addConnection(pc)
+	return true
+}
 
-			// Finding the index of conn in connections
-			index := -1
+// Answers the REQUEST_INIT_INFO of a joining node with the genesis block and a sample of the peers,
+// and closes the connection
+func (c *Client) serveJoin(pc *PeerConn) {
+	defer pc.Close()
 
-			for connIndex, tempConn := range c.connections {
-				if conn == tempConn {
-					index = connIndex
-					break
-				}
+	message, err := pc.ReadMessage()
+	if err != nil || message.ID != REQUEST_INIT_INFO_MESSAGE {
+		c.log.Info(LOG_NETWORK, "A joining peer didn't ask for the init info", "peer", pc.RemoteAddr())
+		return
+	}
+
+	c.lock.Lock()
+	if c.genesisBlock == nil {
+		// This client never joined the network itself, so it has nothing to share
+		c.lock.Unlock()
+		return
+	}
+	c.markPeerSeen(c.ownPeer, time.Now())
+	initInfo := InitInfo{Peers: c.samplePeers(ADDR_SAMPLE_SIZE, time.Now()), GenesisBlock: *c.genesisBlock}
+	c.lock.Unlock()
+
+	if err := pc.WriteMessage(Message{ID: INIT_INFO_MESSAGE, Value: initInfo}); err != nil {
+		c.log.Warn(LOG_NETWORK, "Unable to send the init info", "peer", pc.RemoteAddr(), "error", err)
+	}
+}
+
+func (c *Client) handleConnection(pc *PeerConn) {
+	defer c.removeConnection(pc)
+
+	for {
+		message, err := pc.ReadMessage()
+
+		if err != nil {
+			// The stream can't be read past something malformed, but it still counts towards a ban
+			if errors.Is(err, ErrMalformedMessage) {
+				c.log.Warn(LOG_NETWORK, "Closing connection after a malformed message", "peer", pc.RemoteAddr(), "error", err)
+				c.scorePeer(pc, VERDICT_INVALID)
+				return
 			}
 
-			// Remove the connection from the array
-			if index != -1 {
-				c.connections = append(c.connections[:index], c.connections[index+1:]...)
+			// Connections closed on purpose from this side don't need to be reported
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				c.log.Info(LOG_NETWORK, "Closing connection", "peer", pc.RemoteAddr(), "error", err)
 			}
 
 			return
 		} else {
 
+			// Messages from the other side of a partition are lost
+			if c.faults.isCut(pc) {
+				continue
+			}
+
+			metrics.Inc("messages_received_total", "client", c.ownPeer.Address, "type", message.ID)
+			c.log.Debug(LOG_NETWORK, "Received a message", "peer", pc.RemoteAddr(), "type", message.ID)
+
+			// Count this hop, so the copy which is passed on carries it
+			if message.TraceID != "" {
+				message.Hops++
+				c.tracer.Seen(message, traceAddress(pc), time.Now())
+			}
+
+			verdict := VERDICT_IGNORED
+
 			switch message.ID {
 			case TRANSACTION_MESSAGE:
-				c.handleTransaction(message)
+				verdict = c.handleTransaction(message)
 				break
 
-			case NEW_PEER_MESSAGE:
-				var peer = message.Value.(Peer)
-
-				// If the peer is already registered
-				if c.isPeerRegistered(peer.Address) {
+			case ADDR_MESSAGE:
+				addresses, ok := message.Value.(Addresses)
+				if !ok {
+					verdict = VERDICT_INVALID
 					break
 				}
 
-				c.peers = append(c.peers, peer)
-				c.sortPeers()
-
-				c.outboundMessages <- message
+				verdict = c.handleAddresses(pc, addresses)
 				break
 
-			case REQUEST_INIT_INFO_MESSAGE:
-				initInfo := InitInfo{Peers: c.peers, GenesisBlock: *c.genesisBlock}
-				response := Message{ID: INIT_INFO_MESSAGE, Value: initInfo}
-				c.sendMessage(conn, response)
+			case GETADDR_MESSAGE:
+				c.handleGetAddresses(pc)
 				break
 
 			case BLOCK_MESSAGE:
-				block := message.Value.(Block)
-				c.handleBlock(&block, message)
-				break
-			}
-		}
-	}
-}
+				block, ok := message.Value.(Block)
+				if !ok {
+					verdict = VERDICT_INVALID
+					break
+				}
 
-func (c *Client) handleTransaction(msg Message) {
-	var transaction = msg.Value.(SignedTransaction)
-	var transID = transaction.ID
+				verdict = c.handleBlock(&block, message)
+				c.requestMissing(pc, &block, verdict)
+				break
 
-	// Don't broadcast an invalid message
-	if !transaction.isValid() {
-		fmt.Println("Received an invalid transaction")
-		return
-	}
+			case HEADER_MESSAGE:
+				header, ok := message.Value.(BlockHeader)
+				if !ok {
+					verdict = VERDICT_INVALID
+					break
+				}
 
-	// If this transaction has already been sent, break
-	alreadySent := false
-	for i := 0; i < len(c.transactionsSent); i++ {
-		if c.transactionsSent[i] == transID {
-			alreadySent = true
-			break
-		}
-	}
-	if alreadySent {
-		return
-	}
+				// Full nodes need the whole block, so they only take headers as a light client
+				if !c.light {
+					break
+				}
 
-	c.transactionsSent = append(c.transactionsSent, transID)
-	c.transactionsReceived = append(c.transactionsReceived, transaction)
+				block := Block{BlockHeader: header}
+				verdict = c.handleBlock(&block, message)
+				c.requestMissing(pc, &block, verdict)
+				break
 
-	c.outboundMessages <- msg
-}
+			case GET_PROOF_MESSAGE:
+				request, ok := message.Value.(ProofRequest)
+				if !ok {
+					verdict = VERDICT_INVALID
+					break
+				}
 
-func (c *Client) handleBlock(block *Block, msg Message) {
+				c.handleGetProof(pc, request)
+				break
 
-	// Skip this block, if it has already been received
-	for i := 0; i < len(c.blocks); i++ {
-		if c.blocks[i].ID == block.ID && c.blocks[i].Sender == block.Sender {
-			return
-		}
-	}
+			case PROOF_MESSAGE:
+				response, ok := message.Value.(ProofResponse)
+				if !ok {
+					verdict = VERDICT_INVALID
+					break
+				}
 
-	senderPk := GeneratePublicKeyFromString(block.Sender)
+				// The proof is checked by the request it answers. Answers nobody asked this peer for are dropped
+				c.proofWaiters.deliver(pc, response)
+				break
 
-	if c.IsValidDraw(c.genesisBlock.Seed, block.ID, block.Draw, senderPk) {
-		if block.isValid() {
-			if c.isBlockValid(block) {
+			case GET_BLOCK_MESSAGE:
+				signature, ok := message.Value.(string)
+				if !ok {
+					verdict = VERDICT_INVALID
+					break
+				}
 
-				c.blocks = append(c.blocks, block)
-				c.outboundMessages <- msg
-				return
-			}
-		} else {
-			fmt.Println("Invalid block: unable to match the signature with the block")
-		}
-	}
+				c.handleGetBlock(pc, signature)
+				break
 
-	fmt.Println("[Warning] Received an invalid block")
-}
+			case PING_MESSAGE:
+				c.queueMessage(pc, Message{ID: PONG_MESSAGE})
+				break
 
-func (c *Client) isBlockValid(block *Block) bool {
+			case PONG_MESSAGE:
+				// Receiving it is enough to keep the connection alive
+				break
 
-	prev := c.getBlockBySignature(block.PreviousBlock)
+			case PEER_LEFT_MESSAGE:
+				peer, ok := message.Value.(Peer)
+				if !ok {
+					verdict = VERDICT_INVALID
+					break
+				}
 
-	if prev != nil {
-		if block.ID > prev.ID { // Verify that prev block is smaller than current
-			if block.ID <= c.currentBlockID+1 { // Verify that the block is the expected one
-				return true
-			} else {
-				fmt.Println("Invalid block: block ID is too far ahead. Got", block.ID, "but is currently on", c.currentBlockID)
-			}
-		} else {
-			fmt.Println("Invalid block: the block ID is lower than that of the previous block")
-		}
-	} else {
-		fmt.Println("Invalid block: unable to locate the previous block")
-	}
+				c.handlePeerLeft(peer)
+				break
 
-	return false
-}
+			case DISCONNECT_MESSAGE:
+				disconnect, _ := message.Value.(Disconnect)
+				c.log.Info(LOG_NETWORK, "Peer disconnected", "peer", pc.RemoteAddr(), "reason", disconnect.Reason)
+				return
 
-func (c *Client) getBlockBySignature(sign string) *Block {
-	for i := 0; i < len(c.blocks); i++ {
+			default:
+				verdict = VERDICT_INVALID
+			}
 
-		if c.blocks[i].Signature == sign {
-			return c.blocks[i]
+			if !c.scorePeer(pc, verdict) {
+				return
+			}
 		}
 	}
-
-	return nil
 }
 
-func (c *Client) getLongestBlock(lessThanID int) *Block {
-
-	getDistanceToGenesis := func(block *Block) int {
-		var dist = 0
-
-		for block.ID > 0 {
-			dist++
-			block = c.getBlockBySignature(block.PreviousBlock)
-		}
-
-		return dist
+func (c *Client) handleTransaction(msg Message) Verdict {
+	if c.light {
+		return c.handleLightTransaction(msg)
 	}
 
-	var longestDist = 0
-	var longestBlock = c.genesisBlock.Block
-
-	for i := 0; i < len(c.blocks); i++ {
-		block := c.blocks[i]
-
-		if block.ID >= lessThanID {
-			continue
-		}
+	transaction, ok := msg.Value.(SignedTransaction)
+	if !ok {
+		return VERDICT_INVALID
+	}
 
-		dist := getDistanceToGenesis(block)
+	c.lock.Lock()
+	verdict := c.applyTransaction(transaction)
+	c.lock.Unlock()
 
-		if dist > longestDist {
-			longestDist = dist
-			longestBlock = block
-		} else if dist == longestDist {
+	if verdict == VERDICT_INVALID {
+		metrics.Inc("invalid_transactions_total", "client", c.ownPeer.Address)
+	}
 
-			// If distance is the same, pick the one with the biggest ID
-			if block.ID == longestBlock.ID {
-				if block.Signature > longestBlock.Signature {
-					longestDist = dist
-					longestBlock = block
-				}
-			} else if block.ID > longestBlock.ID {
-				longestDist = dist
-				longestBlock = block
-			}
-		}
+	if verdict == VERDICT_USEFUL {
+		c.events.Publish(EVENT_NEW_TRANSACTION, transactionToJSON(transaction))
+		c.broadcast(msg)
 	}
 
-	return longestBlock
+	return verdict
 }
 
-func (c *Client) generateBlock() *Block {
+func (c *Client) handleBlock(block *Block, msg Message) Verdict {
+	c.lock.Lock()
+	oldHead := c.getLongestBlock(MAX_INT)
+	verdict := c.applyBlock(block)
+	newHead := c.getLongestBlock(MAX_INT)
+	height := c.chainHeight(newHead)
+	depth := c.reorgDepth(oldHead, newHead)
+
+	var children []*Block
+	if verdict == VERDICT_USEFUL {
+		children = c.takeOrphans(block.Signature)
+		c.updateHistory()
+	}
+	c.lock.Unlock()
 
-	// Copy the list of transactions
-	transactions := make([]string, len(c.transactionsReceived))
+	if verdict == VERDICT_INVALID {
+		metrics.Inc("invalid_blocks_total", "client", c.ownPeer.Address)
+	}
 
-	for i := 0; i < len(c.transactionsReceived); i++ {
-		transactions[i] = c.transactionsReceived[i].ID
+	if depth > 0 {
+		metrics.Inc("reorgs_total", "client", c.ownPeer.Address)
+		metrics.Observe("reorg_depth", float64(depth), "client", c.ownPeer.Address)
 	}
 
-	getTransIndex := func(transID string) int {
-		for i := 0; i < len(transactions); i++ {
-			if transactions[i] == transID {
-				return i
-			}
-		}
+	if verdict == VERDICT_USEFUL {
+		c.events.Publish(EVENT_NEW_BLOCK, blockToJSON(block))
+		c.publishHeadChange(oldHead, newHead, height, depth)
 
-		return -1
+		// A light client can't vouch for the bodies of blocks, so it leaves the gossip to full nodes
+		if !c.light {
+			c.broadcast(msg)
+		}
 	}
 
-	// Remove all 'old' transactions
-	for i := 0; i < len(c.blocks); i++ {
-		block := c.blocks[i]
-		for j := 0; j < len(block.Transactions); j++ {
-			index := getTransIndex(block.Transactions[j])
-			if index != -1 {
-				transactions = append(transactions[:index], transactions[index+1:]...)
-			}
-		}
+	// The orphans which were waiting for this block can be applied now
+	for _, child := range children {
+		c.handleBlock(child, Message{ID: BLOCK_MESSAGE, Value: *child})
 	}
 
-	prevSign := c.getLongestBlock(c.currentBlockID).Signature
-	draw := GenerateDraw(c.genesisBlock.Seed, c.currentBlockID, c.sk)
+	return verdict
+}
 
-	block := &Block{c.currentBlockID, prevSign, c.ownPeer.Pk, transactions, "", draw}
+// Creates and signs a block for the slot, on top of the longest chain
+func (c *Client) generateBlock(slot int) *Block {
+	c.lock.Lock()
+	transactions := c.pendingTransactions()
+	txRoot, _ := c.txRoot(transactions) // Pending transactions are ones this client has
+	block := NewBlock(slot, c.getLongestBlock(slot).Signature, c.ownPeer.Pk, transactions, txRoot, nil)
+	block.StateRoot, _ = c.stateRoot(block)
+	seed := c.genesisBlock.Seed
+	c.lock.Unlock()
+
+	block.Draw = GenerateDraw(seed, slot, c.sk)
 	c.SignBlock(block)
 
 	return block
@@ -365,225 +621,184 @@ func (c *Client) SignBlock(block *Block) {
 	block.Signature = signature
 }
 
-func (c *Client) setGenesisBlock(genesis *GenesisBlock) {
-	if !genesis.isValid() {
-		panic("Got an invalid genesis key")
-	}
-
-	c.genesisBlock = genesis
-	c.blocks = append(c.blocks, genesis.Block)
-}
+// Queues a message for every connection. A stopped client drops it, since nothing sends it anymore
+func (c *Client) broadcast(msg Message) {
+	c.activity.Add(1)
 
-func (c *Client) isPeerRegistered(address string) bool {
-	for i := 0; i < len(c.peers); i++ {
-		if c.peers[i].Address == address {
-			return true
-		}
-	}
-
-	return false
-}
-
-func (c *Client) sortPeers() {
-	address := func(i, j int) bool {
-		return c.peers[i].Address < c.peers[j].Address
+	select {
+	case c.outboundMessages <- msg:
+	case <-c.stopped:
+		c.activity.Add(-1)
 	}
-	sort.SliceStable(c.peers, address)
 }
 
 func (c *Client) broadcastMessages() {
 	for {
-		var message = <-c.outboundMessages
-
-		for i := 0; i < len(c.connections); i++ {
-			var conn = c.connections[i]
-			c.sendMessage(conn, message)
+		var message Message
+		select {
+		case <-c.stopped:
+			return
+		case message = <-c.outboundMessages:
 		}
-	}
-}
-
-func (c *Client) connectToPeers() {
 
-	// Find the index of itself
-	var len = len(c.peers)
-	var index = -1
-	for i := 0; i < len; i++ {
-		peer := c.peers[i]
-		if peer == c.ownPeer {
-			index = i
-			break
+		for _, pc := range c.getConnections() {
+			if c.queueMessage(pc, message) {
+				c.tracer.Forwarded(message, traceAddress(pc))
+			}
 		}
-	}
 
-	if index == -1 {
-		fmt.Println("Error: peer ID wasn't in the list of peers")
-		return
+		c.activity.Add(-1)
 	}
+}
 
-	// Connect to the 10 peers after peerID in the list with wrap around
-	for i := 1; i <= 10; i++ {
-		currentIndex := (index + i) % len
-		peer := c.peers[currentIndex]
-
-		// If the list is exhausted
-		if peer == c.ownPeer {
-			return
-		}
-
-		// Connect to the peer
-		conn, err := net.Dial("tcp", peer.Address)
-		if err != nil {
-			fmt.Println("Unable to connect to peer: ", peer.Address)
-		} else {
-			go c.handleConnection(conn)
-		}
-	}
+func (c *Client) connectToPeers() {
+	c.peerManager.fillSlots()
 }
 
+// Announces this client to its connections, which pass it on to a few of theirs
 func (c *Client) broadcastSelf() {
-	var message = Message{ID: NEW_PEER_MESSAGE, Value: c.ownPeer}
-	c.outboundMessages <- message
+	self := TimedPeer{c.ownPeer, time.Now()}
+	var message = Message{ID: ADDR_MESSAGE, Value: Addresses{[]TimedPeer{self}}}
+	c.broadcast(message)
 }
 
 func (c *Client) addSelfToList() {
-	c.peers = append(c.peers, c.ownPeer)
-	c.sortPeers()
-}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-/* Returns a ledger alongside a boolean describing if the ledger is valid or not.
-The ledger will be invalid only if a block brings an account below 0. */
-func (c *Client) generateNewestLedger() (*Ledger, bool) {
-	block := c.getLongestBlock(MAX_INT)
-
-	return c.generateLedgerForBlock(block)
+	c.markPeerSeen(c.ownPeer, time.Now())
 }
 
-func (c *Client) generateLedgerForBlock(block *Block) (*Ledger, bool) {
-	// Make a copy of the current ledger
-	ledger := MakeLedger()
-
-	blocks := []*Block{block}
-
-	for block.PreviousBlock != "" {
-		block = c.getBlockBySignature(block.PreviousBlock)
+// Starts counting slots. Clients with a king key also take part in the lottery.
+// Clients without one still need the current slot, to know which blocks they may accept
+func (c *Client) startBlocks() {
+	genesis := c.getGenesisBlock()
 
-		if block == nil {
-			fmt.Println("Unable to generate ledger: missing block with ID", block.PreviousBlock[0:50])
-			return nil, true
+	// A light client can't make blocks, since it doesn't have the transactions
+	isKing := false
+	for _, key := range genesis.KingKeys {
+		if key == c.ownPeer.Pk && !c.light {
+			isKing = true
+			break
 		}
-
-		blocks = append([]*Block{block}, blocks...) // Unshift the block
 	}
 
-	for _, kingKey := range c.genesisBlock.KingKeys {
-		ledger.AddAmount(kingKey, PREMIUM_ACCOUNT)
-	}
+	go c.blockTimer(genesis, isKing)
+}
 
-	fmt.Println("There are ", len(blocks), "blocks")
+func (c *Client) blockTimer(genesis *GenesisBlock, isKing bool) {
+	ticker := time.NewTicker(genesis.slotLength())
 
-	var usedTransactions []string
+	defer ticker.Stop()
 
-	for _, block := range blocks {
-		senderPay := 10 // Add 10 AU to the sender of the block
-		for _, transID := range block.Transactions {
+	for {
+		select {
+		case <-c.stopped:
+			return
 
-			// Skip this ID, if it has already been seen
-			isUsed := false
-			for _, id := range usedTransactions {
-				if id == transID {
-					isUsed = true
-					break
-				}
-			}
-			if isUsed {
-				continue
-			}
+		case now := <-ticker.C:
+			slot := c.getCurrentSlot() + 1
 
-			foundTrans := false
-			for _, trans := range c.transactionsReceived {
-				if transID == trans.ID {
-					foundTrans = true
-					usedTransactions = append(usedTransactions, transID)
-					if ledger.SignedTransaction(&trans) {
-						senderPay++ // Add 1 AU for each valid transaction
-						break
-					} else {
-						fmt.Println("Transaction: " + trans.ID + " is invalid")
-					}
-				}
+			// A genesis block with a start time decides the slot, so every node agrees on it
+			if !genesis.StartTime.IsZero() {
+				slot = genesis.slotAt(now)
 			}
 
-			if !foundTrans {
-				fmt.Println("Missing a transaction:", transID+". Cannot calculate ledger")
-				return nil, true
+			if !c.advanceSlot(slot) || !isKing {
+				continue
 			}
-		}
 
-		senderPeer := c.GetPeerFromPK(block.Sender)
-		fmt.Println("Adding", senderPay, "to", senderPeer.Address)
-		ledger.AddAmount(block.Sender, senderPay)
+			c.runLottery(genesis, slot)
+		}
 	}
-
-	return ledger, true
 }
 
-func (c *Client) startBlocks() {
-	// Only start the block if the cliens has a King key
-	for _, key := range c.genesisBlock.KingKeys {
-		if key == c.ownPeer.Pk {
-			go c.blockTimer()
-			return
-		}
-	}
+func (c *Client) getCurrentSlot() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.currentBlockID
 }
 
-func (c *Client) blockTimer() {
-	ticker := time.NewTicker(SLOT_LENGTH)
+// Moves the client on to the slot. Returns false if it has already reached it
+func (c *Client) advanceSlot(slot int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	for {
-		select {
-		case <-ticker.C:
-			c.currentBlockID++
+	if slot <= c.currentBlockID {
+		return false
+	}
+	c.currentBlockID = slot
 
-			draw := GenerateDraw(c.genesisBlock.Seed, c.currentBlockID, c.sk)
-			val := c.CalculateDrawValue(c.genesisBlock.Seed, c.currentBlockID, draw, c.pk)
+	return true
+}
 
-			if val.Cmp(HARDNESS) < 0 {
-				continue
-			}
+// Draws for the slot, and makes and sends a block if the draw wins. Returns true if it won
+func (c *Client) runLottery(genesis *GenesisBlock, slot int) bool {
+	metrics.Inc("lottery_slots_total", "client", c.ownPeer.Address)
 
-			fmt.Println("Got a valid draw from", c.ownPeer.Address, "with val", val.String())
-			printArrow()
+	draw := GenerateDraw(genesis.Seed, slot, c.sk)
+	val := CalculateDrawValue(genesis.Seed, slot, draw, c.pk)
 
-			block := c.generateBlock()
-			block.Draw = draw
-			msg := Message{ID: BLOCK_MESSAGE, Value: block}
-			c.handleBlock(block, msg)
-		}
+	if val.Cmp(genesis.hardness()) < 0 {
+		return false
 	}
-}
 
-func (c *Client) Initialize(targetIP string, pair KeyPair) {
+	metrics.Inc("lottery_wins_total", "client", c.ownPeer.Address)
 
-	c.pk = pair.Pk
-	c.sk = pair.Sk
+	block := c.generateBlock(slot)
+	c.log.Info(LOG_CONSENSUS, "Got a valid draw", "slot", slot, "value", val.String(), "trace", shortHash(block.Signature))
+
+	msg := c.traceOrigin(Message{ID: BLOCK_MESSAGE, Value: block}, shortHash(block.Signature))
+	c.handleBlock(block, msg)
+
+	return true
+}
 
-	c.outboundMessages = make(chan Message)
+func (c *Client) Initialize(targetIP string, pair KeyPair, topology Topology) {
+	c.setup(pair, topology)
 
 	// Connect to a peer in the network, and get the list of peers
 	c.getPeerList(targetIP)
 
 	// Start listening for new connections
-	var ln = c.setupListeningServer()
+	c.start(c.setupListeningServer())
+}
+
+// Sets up the fields of a new client, before it connects to anyone
+func (c *Client) setup(pair KeyPair, topology Topology) {
+	c.pk = pair.Pk
+	c.sk = pair.Sk
+	c.log = logger.With("pk", shortHash(pair.Pk.toString()))
+
+	c.outboundMessages = make(chan Message, SEND_QUEUE_SIZE)
+	c.stopped = make(chan struct{})
+	c.reputation = NewReputation()
+	c.events = NewEventBus()
+	c.faults = NewFaults()
+	c.tracer = NewTracer()
+	c.proofWaiters = NewProofWaiters()
+	c.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	c.topology = topology
+}
+
+// Starts accepting connections on the listener, and joins the network
+func (c *Client) start(ln net.Listener) {
 	go c.listenForConnections(ln)
 
 	// Start broadcasting messagesages
 	go c.broadcastMessages()
 
 	c.addSelfToList()
+	c.registerMetrics()
+
+	c.peerManager = NewPeerManager(c)
 
 	if !c.firstPeer || true {
 		c.connectToPeers()
 		c.broadcastSelf()
 	}
+
+	// Keep the connections alive, and replace the ones that drop
+	go c.peerManager.run()
 }
@@ -2,18 +2,21 @@ package main
 
 import (
 	"strconv"
+	"strings"
 )
 
+// The fields are separated, so they can't run into each other. The keys never contain the separator,
+// and the amount is last, so an ID with a separator in it can't be mistaken for another transaction
 func GenerateMessageFromTransaction(t *SignedTransaction) []byte {
-	return []byte(t.From + t.To + t.ID + string(t.Amount))
+	return []byte(strings.Join([]string{"transaction", t.From, t.To, t.ID, strconv.Itoa(t.Amount)}, "|"))
 }
 
 func GenerateMessageFromBlock(block *Block) []byte {
-	idBytes := []byte(strconv.Itoa(block.ID) + block.PreviousBlock + block.Sender)
-
-	for i := 0; i < len(block.Transactions); i++ {
-		idBytes = append(idBytes, []byte(block.Transactions[i])...)
-	}
+	return GenerateMessageFromHeader(&block.BlockHeader)
+}
 
-	return idBytes
+// The transactions are covered by the root, so the header is all that is signed. The fields are
+// separated like those of a transaction, since the slot and the previous block are both digits
+func GenerateMessageFromHeader(header *BlockHeader) []byte {
+	return []byte(strings.Join([]string{"block", strconv.Itoa(header.ID), header.PreviousBlock, header.Sender, header.TxRoot, header.StateRoot}, "|"))
 }
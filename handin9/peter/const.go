@@ -2,6 +2,7 @@ package main
 
 import (
 	"math/big"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,6 +11,54 @@ var MAX_INT = 999999999
 var PREMIUM_ACCOUNT = 1000000
 var SLOT_LENGTH = 1 * time.Second
 var HARDNESS = new(big.Int)
+var BLOCK_REWARD = 10 // Paid to the sender of a block, on top of 1 AU for each transaction in it
+
+var MAX_MESSAGE_SIZE = 4 * 1024 * 1024 // The largest frame a peer is allowed to send, in bytes
+var READ_TIMEOUT = 20 * time.Second    // How long a connection may be silent before it is closed
+var WRITE_TIMEOUT = 10 * time.Second   // How long a single message may take to send
+
+var PROTOCOL_VERSION = 4 // 3 separates the fields of the signed transactions, and 4 those of the block headers
+var HANDSHAKE_TIMEOUT = 10 * time.Second
+var FEATURES = []string{"gossip", "pex"} // The features this node supports, sent in the handshake
+var SECURE_TRANSPORT atomic.Int32        // One of the SECURE_ settings. Atomic, since the secure command changes it while connections are made
+
+var TARGET_OUTBOUND = 10                    // How many connections each client dials
+var PEER_MANAGER_INTERVAL = 1 * time.Second // How often dropped connections are replaced
+var HEARTBEAT_INTERVAL = 5 * time.Second    // How often connections are pinged, must be well below READ_TIMEOUT
+var RECONNECT_BACKOFF = 1 * time.Second     // The wait after the first failed dial, doubled on each failure
+var MAX_RECONNECT_BACKOFF = 1 * time.Minute // The longest wait between two dials to the same peer
+var MAX_DIAL_FAILURES = 5                   // Failed dials in a row before a peer is considered gone
+
+var USEFUL_MESSAGE_SCORE = 1     // Added to a peer's score for each new, valid message
+var INVALID_MESSAGE_PENALTY = 20 // Subtracted from a peer's score for each invalid message
+var MAX_PEER_SCORE = 100         // The highest score a peer can build up
+var BAN_THRESHOLD = -100         // Peers with a score below this are disconnected and banned
+var BAN_DURATION = 10 * time.Minute
+
+var SEND_QUEUE_SIZE = 1000            // How many messages can wait to be sent to a single peer
+var MAX_CONSECUTIVE_DROPS = 100       // Dropped messages in a row before a slow peer is disconnected
+var REORDER_TIMEOUT = 1 * time.Second // The longest the faults hold a message back, if no other message comes after it
+
+var ADDRESS_BOOK_SIZE = 1000           // The most peers a client remembers
+var ADDRESS_MAX_AGE = 30 * time.Minute // Peers which haven't been seen for this long aren't passed on
+var ADDR_SAMPLE_SIZE = 100             // The most peers sent in one ADDR message
+var ADDR_RELAY_MAX = 10                // ADDR messages with at most this many peers are announcements, and are relayed
+var ADDR_RELAY_FANOUT = 2              // How many connections an announcement is relayed to
+var PEX_INTERVAL = 30 * time.Second    // How often a client announces itself and asks for addresses
+
+var EVENT_BUFFER_SIZE = 100 // How many events can wait for a subscriber before they are dropped
+
+var MAX_TRACES = 1000 // How many traced messages each client remembers
+
+var MAX_ORPHANS = 1000 // How many blocks without a known previous block a client keeps
+
+var PROOF_TIMEOUT = 5 * time.Second // How long a light client waits for a full node to answer a proof request
+
+var FINALITY_DEPTH = 6   // How many blocks have to be on top of a block before a snapshot is taken of it
+var SNAPSHOT_VERSION = 2 // The version of the snapshot file format
+
+var CHAIN_VERSION = 2 // The version of the chain file format. 2 writes blocks and transactions like the JSON-RPC methods
+var NO_SLOT = -1      // The slot of a client whose slots haven't started yet, see importChain
 
 func InitConsts() {
 	HARDNESS.SetString("115000314463448182374999132042548534444981265722011819651007388685651270719986080000", 10)
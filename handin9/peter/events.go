@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const EVENT_NEW_TRANSACTION = "newTransaction" // A new, valid transaction was accepted
+const EVENT_NEW_BLOCK = "newBlock"             // A new, valid block was accepted
+const EVENT_HEAD_CHANGED = "headChanged"       // The newest block of the longest chain changed, possibly by a reorg
+const EVENT_PEER_JOINED = "peerJoined"         // A connection to a peer was opened
+const EVENT_PEER_LEFT = "peerLeft"             // A connection to a peer was closed
+
+var EVENT_TYPES = []string{EVENT_NEW_TRANSACTION, EVENT_NEW_BLOCK, EVENT_HEAD_CHANGED, EVENT_PEER_JOINED, EVENT_PEER_LEFT}
+
+// Something that happened in a client. Data is one of the JSON types, so events can be sent as they are
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type HeadChangedJSON struct {
+	Previous   BlockJSON `json:"previous"`
+	Head       BlockJSON `json:"head"`
+	Height     int       `json:"height"`
+	Reorg      bool      `json:"reorg"`      // True if the new head isn't a descendant of the previous one
+	ReorgDepth int       `json:"reorgDepth"` // How many blocks of the previous chain were abandoned
+}
+
+// Delivers events to any number of subscribers. Publishing never blocks: a subscriber which
+// doesn't keep up misses events, which are counted in Dropped
+type EventBus struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]map[string]bool // The channel of each subscriber, and the types it wants
+	dropped     atomic.Uint64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]map[string]bool)}
+}
+
+// Returns a channel with the events of the given types, or all events if no types are given.
+// The returned function unsubscribes, and closes the channel
+func (b *EventBus) Subscribe(types ...string) (<-chan Event, func()) {
+	wanted := make(map[string]bool)
+	for _, t := range types {
+		wanted[t] = true
+	}
+
+	events := make(chan Event, EVENT_BUFFER_SIZE)
+
+	b.lock.Lock()
+	b.subscribers[events] = wanted
+	b.lock.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.lock.Lock()
+			delete(b.subscribers, events)
+			b.lock.Unlock()
+			close(events)
+		})
+	}
+
+	return events, unsubscribe
+}
+
+func (b *EventBus) Publish(eventType string, data interface{}) {
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for events, wanted := range b.subscribers {
+		if len(wanted) > 0 && !wanted[eventType] {
+			continue
+		}
+
+		select {
+		case events <- event:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+func (b *EventBus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// Subscribes to the events of the client. See EventBus.Subscribe
+func (c *Client) Subscribe(types ...string) (<-chan Event, func()) {
+	return c.events.Subscribe(types...)
+}
+
+// Returns how many blocks of the chain ending in oldHead are not part of the chain ending in newHead.
+// Both chains are walked back from their heads, the higher one first, only until they meet
+func (s *State) reorgDepth(oldHead *Block, newHead *Block) int {
+	depth := 0
+	for oldHead != nil && newHead != nil && oldHead.Signature != newHead.Signature {
+		if s.heights[oldHead.Signature] >= s.heights[newHead.Signature] {
+			oldHead = s.getBlockBySignature(oldHead.PreviousBlock)
+			depth++
+		} else {
+			newHead = s.getBlockBySignature(newHead.PreviousBlock)
+		}
+	}
+
+	return depth
+}
+
+// Publishes a headChanged event, if the head has changed
+func (c *Client) publishHeadChange(oldHead *Block, newHead *Block, height int, depth int) {
+	if oldHead == newHead {
+		return
+	}
+
+	c.events.Publish(EVENT_HEAD_CHANGED, HeadChangedJSON{
+		Previous:   blockToJSON(oldHead),
+		Head:       blockToJSON(newHead),
+		Height:     height,
+		Reorg:      depth > 0,
+		ReorgDepth: depth,
+	})
+}
+
+// Streams events as server-sent events. The types can be picked with ?types=newBlock,headChanged
+func (rpc *RPCServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	var types []string
+	if param := r.URL.Query().Get("types"); param != "" {
+		types = strings.Split(param, ",")
+	}
+
+	events, unsubscribe := rpc.client.Subscribe(types...)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-rpc.client.stopped:
+			return
+
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
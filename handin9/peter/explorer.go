@@ -0,0 +1,524 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A small block explorer, served next to the JSON-RPC methods under /explorer/. It shows the chain
+// with its forks, the details of each block, the balance history of each account and the mempool.
+// The pages are built from a copy of the state the client itself uses, which is taken under the lock:
+// getLongestBlock picks the chain, and the history index, which applies the blocks to the ledger like
+// generateLedgerForBlock does, gives the balances and the balance history of each account. A light
+// client doesn't have the ledger, so it asks a full node for a proof of the balance instead.
+
+var EXPLORER_PAGE_SIZE = 100 // How many blocks the chain view shows
+
+type ExplorerBlock struct {
+	Signature    string
+	Previous     string
+	Sender       string
+	SenderName   string // The address of the sender, if it is a known peer
+	Slot         int
+	Height       int
+	Transactions int
+	Status       string // head, chain, fork or tip
+}
+
+type ExplorerTransaction struct {
+	ID       string
+	From     string
+	FromName string
+	To       string
+	ToName   string
+	Amount   int
+	Missing  bool // The block refers to a transaction this client doesn't have
+}
+
+type ExplorerAccount struct {
+	Pk      string
+	Name    string
+	Balance int
+}
+
+type ExplorerChainPage struct {
+	Head          ExplorerBlock
+	Blocks        []ExplorerBlock
+	Total         int
+	Forks         int
+	Orphans       int
+	Light         bool // A light client has no balances
+	BalanceHeight int  // The height the balances are at. It is below the head while transactions are missing
+	Accounts      []ExplorerAccount
+}
+
+type ExplorerBlockPage struct {
+	Block        ExplorerBlock
+	TxRoot       string
+	StateRoot    string
+	Draw         string
+	DrawValue    string
+	Children     []ExplorerBlock
+	Transactions []ExplorerTransaction
+}
+
+type ExplorerHistoryEntry struct {
+	Block   ExplorerBlock
+	Change  int
+	Balance int
+	Reason  string
+}
+
+type ExplorerAccountPage struct {
+	Account       ExplorerAccount
+	Light         bool   // The balance is proven by a full node, and there is no history
+	Unknown       string // Why the balance is unknown, if it is
+	BalanceHeight int
+	History       []ExplorerHistoryEntry // Newest first
+	Pending       []ExplorerTransaction
+}
+
+type ExplorerMempoolPage struct {
+	Transactions []ExplorerTransaction
+}
+
+// What the pages are built from. It is copied from the state under the lock, so the pages are built,
+// and the draws calculated, without holding up the client. Blocks don't change once they are added,
+// so they are shared
+type explorerView struct {
+	light         bool
+	seed          int
+	head          *Block
+	blocks        []*Block
+	bySignature   map[string]*Block
+	heights       map[string]int
+	names         map[string]string            // The addresses of the known peers, by public key
+	transactions  map[string]SignedTransaction // The transactions the page shows
+	pending       []string
+	forks         int
+	orphans       int
+	ledger        *Ledger // The balances after the last block in the history, nil for a light client
+	balanceHeight int
+	history       []HistoryEntry // The history of the account, on the account page
+}
+
+func (rpc *RPCServer) handleExplorer(w http.ResponseWriter, r *http.Request) {
+	c := rpc.client
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/explorer"), "/")
+	parts := strings.SplitN(path, "/", 2)
+
+	var account string
+	if parts[0] == "account" && len(parts) == 2 && isValidKeyString(parts[1]) {
+		account = parts[1]
+	}
+
+	view := c.explorerView(account)
+	if view == nil {
+		http.Error(w, "the client hasn't joined a network yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	var name string
+	var data interface{}
+	switch {
+	case path == "":
+		name, data = "chain", view.chain()
+	case parts[0] == "mempool":
+		name, data = "mempool", view.mempool()
+	case parts[0] == "block" && len(parts) == 2:
+		if page, ok := view.block(parts[1]); ok {
+			name, data = "block", page
+		}
+	case account != "":
+		page := view.account(account)
+
+		// A light client has no ledger, so it asks a full node for a proof of the balance
+		if view.light {
+			balance, height, err := c.provenBalance(account)
+			if err != nil {
+				page.Unknown = err.Error()
+			}
+			page.Account.Balance, page.BalanceHeight = balance, height
+		}
+
+		name, data = "account", page
+	}
+
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := explorerTemplates.ExecuteTemplate(w, name, data); err != nil {
+		c.log.Warn(LOG_NETWORK, "Unable to render the explorer", "page", name, "error", err)
+	}
+}
+
+// Copies what the pages need from the state. account is the account of the account page, if it is
+// one. Returns nil if the client doesn't have a genesis block yet
+func (c *Client) explorerView(account string) *explorerView {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.genesisBlock == nil {
+		return nil
+	}
+
+	view := &explorerView{
+		light:        c.light,
+		seed:         c.genesisBlock.Seed,
+		head:         c.getLongestBlock(MAX_INT),
+		blocks:       append([]*Block{}, c.blocks...),
+		bySignature:  make(map[string]*Block),
+		heights:      make(map[string]int),
+		names:        make(map[string]string),
+		transactions: make(map[string]SignedTransaction),
+		pending:      c.pendingTransactions(),
+		forks:        c.countForks(),
+		orphans:      c.numOrphans,
+	}
+
+	for _, block := range c.blocks {
+		view.bySignature[block.Signature] = block
+		view.heights[block.Signature] = c.heights[block.Signature]
+
+		for _, id := range block.Transactions {
+			if transaction, ok := c.transactionsByID[id]; ok {
+				view.transactions[id] = transaction
+			}
+		}
+	}
+
+	for _, id := range view.pending {
+		view.transactions[id] = c.transactionsByID[id]
+	}
+
+	for _, peer := range c.peers {
+		view.names[peer.Pk] = peer.Address
+	}
+
+	if c.updateHistory(); c.history != nil {
+		view.ledger = c.history.ledger.Copy()
+		view.balanceHeight = len(c.history.chain) - 1
+	}
+
+	if account != "" {
+		view.history = c.State.accountHistory(account, 0, -1)
+	}
+
+	return view
+}
+
+// The methods below build the pages from the view
+
+// Returns the signatures of the blocks on the longest chain
+func (v *explorerView) longestChain() map[string]bool {
+	chain := make(map[string]bool)
+	for block := v.head; block != nil; block = v.bySignature[block.PreviousBlock] {
+		chain[block.Signature] = true
+	}
+
+	return chain
+}
+
+func (v *explorerView) blocksWithChildren() map[string]bool {
+	hasChild := make(map[string]bool)
+	for _, block := range v.blocks {
+		hasChild[block.PreviousBlock] = true
+	}
+
+	return hasChild
+}
+
+func (v *explorerView) blockSummary(block *Block, chain map[string]bool, hasChild map[string]bool) ExplorerBlock {
+	status := "fork"
+	if block == v.head {
+		status = "head"
+	} else if chain[block.Signature] {
+		status = "chain"
+	} else if !hasChild[block.Signature] {
+		status = "tip"
+	}
+
+	return ExplorerBlock{
+		Signature:    block.Signature,
+		Previous:     block.PreviousBlock,
+		Sender:       block.Sender,
+		SenderName:   v.names[block.Sender],
+		Slot:         block.ID,
+		Height:       v.heights[block.Signature],
+		Transactions: len(block.Transactions),
+		Status:       status,
+	}
+}
+
+func (v *explorerView) transaction(id string) ExplorerTransaction {
+	transaction, ok := v.transactions[id]
+	if !ok {
+		return ExplorerTransaction{ID: id, Missing: true}
+	}
+
+	return ExplorerTransaction{
+		ID:       id,
+		From:     transaction.From,
+		FromName: v.names[transaction.From],
+		To:       transaction.To,
+		ToName:   v.names[transaction.To],
+		Amount:   transaction.Amount,
+	}
+}
+
+func (v *explorerView) chain() ExplorerChainPage {
+	chain := v.longestChain()
+	hasChild := v.blocksWithChildren()
+
+	all := append([]*Block{}, v.blocks...)
+	sort.SliceStable(all, func(i, j int) bool {
+		hi, hj := v.heights[all[i].Signature], v.heights[all[j].Signature]
+		if hi != hj {
+			return hi > hj
+		}
+
+		return all[i].ID > all[j].ID
+	})
+
+	page := ExplorerChainPage{
+		Head:          v.blockSummary(v.head, chain, hasChild),
+		Total:         len(all),
+		Forks:         v.forks,
+		Orphans:       v.orphans,
+		Light:         v.light,
+		BalanceHeight: v.balanceHeight,
+	}
+
+	for i, block := range all {
+		if i >= EXPLORER_PAGE_SIZE {
+			break
+		}
+
+		page.Blocks = append(page.Blocks, v.blockSummary(block, chain, hasChild))
+	}
+
+	if v.ledger != nil {
+		for pk, balance := range v.ledger.Accounts {
+			page.Accounts = append(page.Accounts, ExplorerAccount{pk, v.names[pk], balance})
+		}
+
+		sort.Slice(page.Accounts, func(i, j int) bool {
+			if page.Accounts[i].Balance != page.Accounts[j].Balance {
+				return page.Accounts[i].Balance > page.Accounts[j].Balance
+			}
+
+			return page.Accounts[i].Pk < page.Accounts[j].Pk
+		})
+	}
+
+	return page
+}
+
+func (v *explorerView) block(signature string) (ExplorerBlockPage, bool) {
+	block := v.bySignature[signature]
+	if block == nil {
+		return ExplorerBlockPage{}, false
+	}
+
+	chain := v.longestChain()
+	hasChild := v.blocksWithChildren()
+
+	page := ExplorerBlockPage{Block: v.blockSummary(block, chain, hasChild), TxRoot: block.TxRoot, StateRoot: block.StateRoot}
+
+	if block.Draw != nil {
+		page.Draw = block.Draw.String()
+
+		if isValidKeyString(block.Sender) {
+			page.DrawValue = CalculateDrawValue(v.seed, block.ID, block.Draw, GeneratePublicKeyFromString(block.Sender)).String()
+		}
+	}
+
+	for _, other := range v.blocks {
+		if other.PreviousBlock == block.Signature {
+			page.Children = append(page.Children, v.blockSummary(other, chain, hasChild))
+		}
+	}
+
+	for _, id := range block.Transactions {
+		page.Transactions = append(page.Transactions, v.transaction(id))
+	}
+
+	return page, true
+}
+
+func (v *explorerView) account(pk string) ExplorerAccountPage {
+	chain := v.longestChain()
+	hasChild := v.blocksWithChildren()
+
+	page := ExplorerAccountPage{Account: ExplorerAccount{Pk: pk, Name: v.names[pk]}, Light: v.light, BalanceHeight: v.balanceHeight}
+
+	// Merge the entries of each block into one change
+	for _, entry := range v.history {
+		reason := entry.Kind
+		if entry.Transaction != "" {
+			reason += " " + entry.Transaction
+		}
+
+		last := len(page.History) - 1
+		if last >= 0 && page.History[last].Block.Signature == entry.Block {
+			page.History[last].Change += entry.Change
+			page.History[last].Balance = entry.Balance
+			page.History[last].Reason += ", " + reason
+			continue
+		}
+
+		block := v.bySignature[entry.Block]
+		page.History = append(page.History, ExplorerHistoryEntry{
+			Block:   v.blockSummary(block, chain, hasChild),
+			Change:  entry.Change,
+			Balance: entry.Balance,
+			Reason:  reason,
+		})
+	}
+
+	if v.ledger != nil {
+		page.Account.Balance = v.ledger.Accounts[pk]
+	}
+
+	// Newest first
+	for i, j := 0, len(page.History)-1; i < j; i, j = i+1, j-1 {
+		page.History[i], page.History[j] = page.History[j], page.History[i]
+	}
+
+	for _, id := range v.pending {
+		transaction := v.transactions[id]
+		if transaction.From == pk || transaction.To == pk {
+			page.Pending = append(page.Pending, v.transaction(id))
+		}
+	}
+
+	return page
+}
+
+func (v *explorerView) mempool() ExplorerMempoolPage {
+	var page ExplorerMempoolPage
+	for _, id := range v.pending {
+		page.Transactions = append(page.Transactions, v.transaction(id))
+	}
+
+	return page
+}
+
+var explorerTemplates = template.Must(template.New("explorer").Funcs(template.FuncMap{"short": shortHash}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}} - explorer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+code { font-size: 0.9em; }
+.head { font-weight: bold; }
+.fork, .tip { color: #a60; }
+.missing { color: #a00; }
+</style>
+</head>
+<body>
+<p><a href="/explorer/">Chain</a> | <a href="/explorer/mempool">Mempool</a></p>
+<h1>{{.}}</h1>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "account-link"}}<a href="/explorer/account/{{.Pk}}"><code>{{short .Pk}}</code></a>{{if .Name}} ({{.Name}}){{end}}{{end}}
+
+{{define "block-row"}}<tr class="{{.Status}}">
+<td>{{.Height}}</td>
+<td>{{.Slot}}</td>
+<td><a href="/explorer/block/{{.Signature}}"><code>{{short .Signature}}</code></a></td>
+<td><a href="/explorer/account/{{.Sender}}"><code>{{short .Sender}}</code></a>{{if .SenderName}} ({{.SenderName}}){{end}}</td>
+<td>{{.Transactions}}</td>
+<td>{{.Status}}</td>
+</tr>{{end}}
+
+{{define "transaction-rows"}}<table>
+<tr><th>ID</th><th>From</th><th>To</th><th>Amount</th></tr>
+{{range .}}{{if .Missing}}<tr class="missing"><td>{{.ID}}</td><td colspan="3">not received by this client</td></tr>
+{{else}}<tr>
+<td>{{.ID}}</td>
+<td><a href="/explorer/account/{{.From}}"><code>{{short .From}}</code></a>{{if .FromName}} ({{.FromName}}){{end}}</td>
+<td><a href="/explorer/account/{{.To}}"><code>{{short .To}}</code></a>{{if .ToName}} ({{.ToName}}){{end}}</td>
+<td>{{.Amount}}</td>
+</tr>
+{{end}}{{end}}</table>{{end}}
+
+{{define "chain"}}{{template "header" "Chain"}}
+<p>The head is <a href="/explorer/block/{{.Head.Signature}}"><code>{{short .Head.Signature}}</code></a> at height {{.Head.Height}}, in slot {{.Head.Slot}}.
+There are {{.Total}} blocks, {{.Forks}} fork(s) and {{.Orphans}} orphan(s).</p>
+<h2>Blocks</h2>
+<p>Showing the {{len .Blocks}} highest of {{.Total}} blocks. Blocks which aren't on the longest chain are forks, and tips if nothing builds on them.</p>
+<table>
+<tr><th>Height</th><th>Slot</th><th>Block</th><th>Sender</th><th>Transactions</th><th>Status</th></tr>
+{{range .Blocks}}{{template "block-row" .}}
+{{end}}</table>
+<h2>Accounts</h2>
+{{if .Light}}<p>A light client only has the headers of the blocks, so it doesn't know the balances. The page of an account asks a full node for a proof of its balance.</p>
+{{else}}<p>The balances at height {{.BalanceHeight}}.</p>
+<table>
+<tr><th>Account</th><th>Balance</th></tr>
+{{range .Accounts}}<tr><td>{{template "account-link" .}}</td><td>{{.Balance}}</td></tr>
+{{end}}</table>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "block"}}{{template "header" "Block"}}
+<table>
+<tr><th>Signature</th><td><code>{{.Block.Signature}}</code></td></tr>
+<tr><th>Slot</th><td>{{.Block.Slot}}</td></tr>
+<tr><th>Height</th><td>{{.Block.Height}}</td></tr>
+<tr><th>Status</th><td>{{.Block.Status}}</td></tr>
+<tr><th>Sender</th><td><a href="/explorer/account/{{.Block.Sender}}"><code>{{short .Block.Sender}}</code></a>{{if .Block.SenderName}} ({{.Block.SenderName}}){{end}}</td></tr>
+<tr><th>Previous</th><td>{{if .Block.Previous}}<a href="/explorer/block/{{.Block.Previous}}"><code>{{short .Block.Previous}}</code></a>{{else}}none, this is the genesis block{{end}}</td></tr>
+<tr><th>Transaction root</th><td><code>{{.TxRoot}}</code></td></tr>
+<tr><th>State root</th><td><code>{{.StateRoot}}</code></td></tr>
+<tr><th>Draw</th><td><code>{{short .Draw}}</code></td></tr>
+<tr><th>Draw value</th><td><code>{{.DrawValue}}</code></td></tr>
+</table>
+<h2>Children</h2>
+{{if .Children}}<table>
+<tr><th>Height</th><th>Slot</th><th>Block</th><th>Sender</th><th>Transactions</th><th>Status</th></tr>
+{{range .Children}}{{template "block-row" .}}
+{{end}}</table>{{else}}<p>No blocks build on this one yet.</p>{{end}}
+<h2>Transactions</h2>
+{{if .Transactions}}{{template "transaction-rows" .Transactions}}{{else}}<p>The block has no transactions.</p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "account"}}{{template "header" "Account"}}
+<p><code>{{.Account.Pk}}</code>{{if .Account.Name}} ({{.Account.Name}}){{end}}</p>
+{{if .Unknown}}<p>The balance is unknown: {{.Unknown}}.</p>
+{{else if .Light}}<p>The balance at height {{.BalanceHeight}} is {{.Account.Balance}} AU, proven by a full node.</p>
+{{else}}<p>The balance at height {{.BalanceHeight}} of the longest chain is {{.Account.Balance}} AU.</p>{{end}}
+<h2>History</h2>
+{{if .Light}}<p>A light client doesn't have the transactions, so it has no history.</p>
+{{else if .History}}<table>
+<tr><th>Height</th><th>Block</th><th>Change</th><th>Balance</th><th>Reason</th></tr>
+{{range .History}}<tr>
+<td>{{.Block.Height}}</td>
+<td><a href="/explorer/block/{{.Block.Signature}}"><code>{{short .Block.Signature}}</code></a></td>
+<td>{{.Change}}</td>
+<td>{{.Balance}}</td>
+<td>{{.Reason}}</td>
+</tr>
+{{end}}</table>{{else}}<p>No block on the longest chain has changed the balance.</p>{{end}}
+<h2>Pending transactions</h2>
+{{if .Pending}}{{template "transaction-rows" .Pending}}{{else}}<p>None.</p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "mempool"}}{{template "header" "Mempool"}}
+<p>{{len .Transactions}} transaction(s) aren't in any block yet.</p>
+{{if .Transactions}}{{template "transaction-rows" .Transactions}}{{end}}
+{{template "footer"}}{{end}}
+`))
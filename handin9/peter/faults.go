@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults which are injected into the messages a client sends, to test how the network copes with
+// a bad connection. The chances are per message. Faults are applied by the writer of each connection,
+// so the handshake is never affected, and a delay holds up the messages behind it, like a slow link.
+type FaultConfig struct {
+	Drop      float64       // The chance a message is lost
+	Duplicate float64       // The chance a message is sent twice
+	Reorder   float64       // The chance a message is held back, and sent after the next one, or on its own after REORDER_TIMEOUT
+	Corrupt   float64       // The chance a transaction or block is changed, so its signature no longer matches. See corruptMessage
+	Delay     time.Duration // Added before every message
+	Jitter    time.Duration // A random extra delay, up to Jitter
+}
+
+type Faults struct {
+	lock    sync.Mutex
+	config  FaultConfig
+	cut     map[string]bool // The public keys of the peers on the other side of a partition
+	random  *rand.Rand
+	seed    int64
+	sources map[string]*rand.Rand // A source for each peer once seeded, by public key
+	lost    int                   // Messages which were dropped or cut off
+}
+
+func NewFaults() *Faults {
+	return &Faults{cut: make(map[string]bool), random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Makes the faults the same on every run with the seed. The connections are written concurrently,
+// so each peer gets a source of its own, and the faults don't depend on the order of the writes
+func (f *Faults) Seed(seed int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.seed = seed
+	f.sources = make(map[string]*rand.Rand)
+}
+
+// The number of messages which were dropped or cut off by a partition
+func (f *Faults) Lost() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.lost
+}
+
+// Returns the source of randomness for the messages to the peer
+func (f *Faults) source(pc *PeerConn) *rand.Rand {
+	if f.sources == nil || pc.remote == nil {
+		return f.random
+	}
+
+	source := f.sources[pc.remote.Pk]
+	if source == nil {
+		hash := fnv.New64a()
+		hash.Write([]byte(pc.remote.Pk))
+		source = rand.New(rand.NewSource(f.seed ^ int64(hash.Sum64())))
+		f.sources[pc.remote.Pk] = source
+	}
+
+	return source
+}
+
+func (f *Faults) Config() FaultConfig {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.config
+}
+
+func (f *Faults) SetConfig(config FaultConfig) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.config = config
+}
+
+// Cuts this client off from the peers with the public keys. No messages are sent to or accepted from them
+func (f *Faults) SetCut(pks []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.cut = make(map[string]bool)
+	for _, pk := range pks {
+		f.cut[pk] = true
+	}
+}
+
+func (f *Faults) isCut(pc *PeerConn) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return pc.remote != nil && f.cut[pc.remote.Pk]
+}
+
+func chance(random *rand.Rand, p float64) bool {
+	return p > 0 && random.Float64() < p
+}
+
+// Returns the messages to send in place of msg, and how long to wait before sending them.
+// held is the message the connection is holding back to reorder, if any
+func (f *Faults) apply(pc *PeerConn, msg Message, held *Message) ([]Message, *Message, time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if pc.remote != nil && f.cut[pc.remote.Pk] {
+		f.lost++
+		return nil, held, 0
+	}
+
+	config := f.config
+	random := f.source(pc)
+
+	delay := config.Delay
+	if config.Jitter > 0 {
+		delay += time.Duration(random.Int63n(int64(config.Jitter)))
+	}
+
+	if chance(random, config.Drop) {
+		f.lost++
+		return nil, held, delay
+	}
+
+	if chance(random, config.Corrupt) {
+		msg = corruptMessage(msg)
+	}
+
+	messages := []Message{msg}
+	if chance(random, config.Duplicate) {
+		messages = append(messages, msg)
+	}
+
+	// Hold this message back, and send it after the next one
+	if held == nil && chance(random, config.Reorder) {
+		return nil, &msg, delay
+	}
+
+	if held != nil {
+		messages = append(messages, *held)
+	}
+
+	return messages, nil, delay
+}
+
+// Returns a copy of a transaction or block message with a changed field, so its signature is
+// no longer valid. A block only has its header signed, so the state root is changed. Other messages
+// are returned as they are
+func corruptMessage(msg Message) Message {
+	switch value := msg.Value.(type) {
+	case SignedTransaction:
+		value.Amount++
+		msg.Value = value
+		return msg
+
+	case Block:
+		value.StateRoot = "corrupted" + value.StateRoot
+		msg.Value = value
+		return msg
+
+	case *Block:
+		block := *value
+		block.StateRoot = "corrupted" + block.StateRoot
+		msg.Value = &block
+		return msg
+	}
+
+	return msg
+}
+
+// Parses faults of the form drop=0.1 delay=50ms. "off" turns all faults off
+func parseFaultConfig(params []string) (FaultConfig, error) {
+	var config FaultConfig
+
+	for _, param := range params {
+		if strings.ToLower(param) == "off" {
+			return FaultConfig{}, nil
+		}
+
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return config, errors.New("expected name=value, got " + param)
+		}
+
+		var err error
+		switch parts[0] {
+		case "drop":
+			config.Drop, err = strconv.ParseFloat(parts[1], 64)
+		case "duplicate":
+			config.Duplicate, err = strconv.ParseFloat(parts[1], 64)
+		case "reorder":
+			config.Reorder, err = strconv.ParseFloat(parts[1], 64)
+		case "corrupt":
+			config.Corrupt, err = strconv.ParseFloat(parts[1], 64)
+		case "delay":
+			config.Delay, err = time.ParseDuration(parts[1])
+		case "jitter":
+			config.Jitter, err = time.ParseDuration(parts[1])
+		default:
+			err = errors.New("unknown fault")
+		}
+
+		if err != nil {
+			return config, errors.New("invalid " + param + ": " + err.Error())
+		}
+	}
+
+	return config, nil
+}
+
+// Parses groups of client indices of the form [0,1,2]
+func parsePartitionGroups(params []string, numClients int) ([][]int, error) {
+	var groups [][]int
+	seen := make(map[int]bool)
+
+	for _, param := range params {
+		if !strings.HasPrefix(param, "[") || !strings.HasSuffix(param, "]") {
+			return nil, errors.New("expected a group like [0,1,2], got " + param)
+		}
+
+		var group []int
+		for _, str := range strings.Split(strings.Trim(param, "[]"), ",") {
+			index, err := strconv.Atoi(strings.TrimSpace(str))
+			if err != nil || index < 0 || index >= numClients {
+				return nil, errors.New("invalid client index " + str)
+			}
+
+			if seen[index] {
+				return nil, errors.New("client " + str + " is in more than one group")
+			}
+			seen[index] = true
+
+			group = append(group, index)
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
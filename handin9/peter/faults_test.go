@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCorruptedMessagesAreInvalid(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestState(t, keys)
+	s.currentBlockID = 10
+
+	transaction := signTestTransaction("t1", keys[0], keys[1], 10)
+	corrupted := corruptMessage(Message{ID: TRANSACTION_MESSAGE, Value: transaction}).Value.(SignedTransaction)
+	if verdict := s.applyTransaction(corrupted); verdict != VERDICT_INVALID {
+		t.Errorf("corrupted transaction: got verdict %d, expected %d", verdict, VERDICT_INVALID)
+	}
+
+	s.applyTransaction(transaction)
+	block := signTestBlock(s, 1, s.genesisBlock.Block, keys[0], []string{transaction.ID})
+	corruptedBlock := corruptMessage(Message{ID: BLOCK_MESSAGE, Value: *block}).Value.(Block)
+	if verdict := s.applyBlock(&corruptedBlock); verdict != VERDICT_INVALID {
+		t.Errorf("corrupted block: got verdict %d, expected %d", verdict, VERDICT_INVALID)
+	}
+
+	// The original is still valid, so the corruption didn't change it
+	if verdict := s.applyBlock(block); verdict != VERDICT_USEFUL {
+		t.Errorf("original block: got verdict %d, expected %d", verdict, VERDICT_USEFUL)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An account and the amount it has in the genesis block
+type Allocation struct {
+	Account string
+	Amount  int
+}
+
+// The message signed in ParamsSignature. It covers everything in the genesis block which isn't in the
+// block itself. The fields are separated, so digits can't move from one field to the next
+func (g *GenesisBlock) paramsMessage() []byte {
+	var allocations []string
+	for _, allocation := range g.Allocations {
+		allocations = append(allocations, allocation.Account+"="+strconv.Itoa(allocation.Amount))
+	}
+
+	hardness := ""
+	if g.Hardness != nil {
+		hardness = g.Hardness.String()
+	}
+
+	start := ""
+	if !g.StartTime.IsZero() {
+		start = strconv.FormatInt(g.StartTime.UnixNano(), 10)
+	}
+
+	return []byte(strings.Join([]string{"genesis", strconv.Itoa(g.Seed), strings.Join(g.KingKeys, ","), strings.Join(allocations, ","), g.SlotLength.String(), hardness, start}, "|"))
+}
+
+// Creates the genesis block itself, and signs both it and the parameters with the creator's key
+func (g *GenesisBlock) Sign(creator KeyPair) {
+	block := NewBlock(0, "", creator.Pk.toString(), []string{}, merkleRoot(nil), GenerateDraw(g.Seed, 0, creator.Sk))
+	block.StateRoot = g.stateRoot(block.Sender)
+	block.Signature = Sign(GenerateMessageFromBlock(block), creator.Sk).String()
+
+	g.Block = block
+	g.ParamsSignature = Sign(g.paramsMessage(), creator.Sk).String()
+}
+
+// Returns true if both the block and the parameters are signed by the sender of the block
+func (g *GenesisBlock) isValid() bool {
+	if g.Block == nil || !isValidKeyString(g.Sender) || !g.Block.isValid() || g.StateRoot != g.stateRoot(g.Sender) {
+		return false
+	}
+
+	signature, ok := new(big.Int).SetString(g.ParamsSignature, 10)
+
+	return ok && Verify(g.paramsMessage(), signature, GeneratePublicKeyFromString(g.Sender))
+}
+
+// Returns the balances before the first block, including the genesis block
+func (g *GenesisBlock) allocationLedger() *Ledger {
+	ledger := MakeLedger()
+	for _, allocation := range g.Allocations {
+		ledger.AddAmount(allocation.Account, allocation.Amount)
+	}
+
+	return ledger
+}
+
+// Returns the state root after the genesis block, which only pays its sender, and has no transactions
+func (g *GenesisBlock) stateRoot(sender string) string {
+	ledger := g.allocationLedger()
+	ledger.AddAmount(sender, BLOCK_REWARD)
+
+	return stateRoot(ledger.Root(), usedRoot("", nil))
+}
+
+func (g *GenesisBlock) slotLength() time.Duration {
+	if g.SlotLength <= 0 {
+		return SLOT_LENGTH
+	}
+
+	return g.SlotLength
+}
+
+func (g *GenesisBlock) hardness() *big.Int {
+	if g.Hardness == nil {
+		return HARDNESS
+	}
+
+	return g.Hardness
+}
+
+// Returns the slot at the time, or 0 if the chain hasn't started yet. Only used when StartTime is set
+func (g *GenesisBlock) slotAt(t time.Time) int {
+	if t.Before(g.StartTime) {
+		return 0
+	}
+
+	return 1 + int(t.Sub(g.StartTime)/g.slotLength())
+}
+
+func loadGenesisBlock(path string) (*GenesisBlock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var genesis GenesisBlock
+	if err := json.Unmarshal(data, &genesis); err != nil || genesis.Block == nil {
+		return nil, errors.New("invalid genesis file " + path)
+	}
+
+	if !genesis.isValid() {
+		return nil, errors.New("the genesis block in " + path + " isn't signed by its sender")
+	}
+
+	return &genesis, nil
+}
+
+func saveGenesisBlock(genesis *GenesisBlock, path string) error {
+	data, err := json.MarshalIndent(genesis, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// A flag which can be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Parses an allocation of the form account=amount, where the account is a public key or a key file.
+// Key files which don't exist are created, which is handy when setting up a new network
+func parseAllocation(str string) (Allocation, error) {
+	index := strings.LastIndex(str, "=")
+	if index == -1 {
+		return Allocation{}, errors.New("expected account=amount, got " + str)
+	}
+
+	amount, err := strconv.Atoi(str[index+1:])
+	if err != nil || amount < 0 {
+		return Allocation{}, errors.New("invalid amount in " + str)
+	}
+
+	account, err := parseAccount(str[:index])
+	if err != nil {
+		return Allocation{}, err
+	}
+
+	return Allocation{account, amount}, nil
+}
+
+// Returns the public key, given either the key itself or a key file, which is created if it doesn't exist
+func parseAccount(str string) (string, error) {
+	if isValidKeyString(str) {
+		return str, nil
+	}
+
+	pair, err := loadOrCreateKey(str)
+	if err != nil {
+		return "", err
+	}
+
+	return pair.Pk.toString(), nil
+}
+
+// Writes a signed genesis file. The kings take part in the lottery, and any account can have an allocation.
+//
+//	peter genesis -key creator.json -king node1/key.json -alloc node1/key.json=1000000 -alloc wallet.json=500 -start 2026-01-01T12:00:00Z
+func runGenesis(args []string) error {
+	flags := flag.NewFlagSet("genesis", flag.ContinueOnError)
+	out := flags.String("out", "genesis.json", "the file to write the genesis block to")
+	keyFile := flags.String("key", "key.json", "the key file of the creator, created if it doesn't exist")
+	seed := flags.Int("seed", SEED, "the seed of the lottery")
+	slotLength := flags.Duration("slot", SLOT_LENGTH, "the length of a slot")
+	hardness := flags.String("hardness", HARDNESS.String(), "the lowest draw value which wins a slot")
+	start := flags.String("start", "", "when the first slot begins, in RFC 3339. Defaults to one minute from now")
+	var kings listFlag
+	flags.Var(&kings, "king", "an account which takes part in the lottery, as a public key or a key file, which is created if it doesn't exist. Can be given more than once")
+	var allocations listFlag
+	flags.Var(&allocations, "alloc", "an initial balance as account=amount, where the account is a public key or a key file, which is created if it doesn't exist. Can be given more than once")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(kings) == 0 {
+		return errors.New("at least one -king is required, or nobody can make blocks")
+	}
+
+	if *slotLength <= 0 {
+		return errors.New("the slot length has to be positive")
+	}
+
+	genesis := &GenesisBlock{Seed: *seed, SlotLength: *slotLength}
+
+	var ok bool
+	if genesis.Hardness, ok = new(big.Int).SetString(*hardness, 10); !ok {
+		return errors.New("invalid hardness " + *hardness)
+	}
+
+	genesis.StartTime = time.Now().Add(time.Minute).Truncate(time.Second)
+	if *start != "" {
+		startTime, err := time.Parse(time.RFC3339, *start)
+		if err != nil {
+			return err
+		}
+		genesis.StartTime = startTime
+	}
+
+	isKing := make(map[string]bool)
+	for _, str := range kings {
+		king, err := parseAccount(str)
+		if err != nil {
+			return err
+		}
+
+		if isKing[king] {
+			return errors.New("the account in " + str + " is a king more than once")
+		}
+		isKing[king] = true
+
+		genesis.KingKeys = append(genesis.KingKeys, king)
+	}
+
+	seen := make(map[string]bool)
+	for _, str := range allocations {
+		allocation, err := parseAllocation(str)
+		if err != nil {
+			return err
+		}
+
+		if seen[allocation.Account] {
+			return errors.New("more than one allocation for the account in " + str)
+		}
+		seen[allocation.Account] = true
+
+		genesis.Allocations = append(genesis.Allocations, allocation)
+	}
+
+	creator, err := loadOrCreateKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	genesis.Sign(creator)
+
+	if err := saveGenesisBlock(genesis, *out); err != nil {
+		return err
+	}
+
+	fmt.Println("Wrote genesis block", shortHash(genesis.Hash()), "to", *out+". The first slot begins at", genesis.StartTime.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first message each side sends when a connection opens
+type Hello struct {
+	Version       int
+	GenesisHash   string // Empty if the node is still joining, and doesn't know the genesis block yet
+	Pk            string
+	ListenAddress string // Empty if the node isn't listening yet
+	Features      []string
+	Nonce         string // A random challenge, which the other side has to sign
+	Join          bool   // Set by a node which only asks for the genesis block and peers, see serveJoin
+}
+
+// Proves that the sender of a Hello owns the secret key for its Pk
+type HelloAck struct {
+	Signature string
+}
+
+type Disconnect struct {
+	Reason string
+}
+
+func (h *Hello) HasFeature(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Client) genesisHash() string {
+	genesis := c.getGenesisBlock()
+	if genesis == nil {
+		return ""
+	}
+
+	return genesis.Hash()
+}
+
+// The fields of a Hello which are signed in the handshake, separated so they can't run into each other
+func (h *Hello) transcript() string {
+	return strings.Join([]string{strconv.Itoa(h.Version), h.GenesisHash, h.Pk, h.ListenAddress, strings.Join(h.Features, ","), h.Nonce, strconv.FormatBool(h.Join)}, "|")
+}
+
+// The message signed to prove possession of a key. It covers the Hello of the signer and the Hello it
+// got, with the other side's nonce, so the signature can't be replayed, and neither Hello can be
+// changed on the way. Otherwise the "secure" feature could be stripped to fall back to plaintext
+func generateHandshakeMessage(signer *Hello, other *Hello) []byte {
+	return []byte("hello" + strconv.Itoa(PROTOCOL_VERSION) + "|" + signer.transcript() + "|" + other.transcript())
+}
+
+func generateNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// Runs the HELLO exchange on a new connection. Both sides send a Hello, check that the other side
+// is on the same chain and protocol, and then prove possession of their key by signing the other's nonce.
+// If the peers are incompatible, a disconnect message is sent with the reason, and an error is returned.
+// join is set when the connection is only used to get the genesis block and peers
+func (c *Client) performHandshake(pc *PeerConn, join bool) error {
+	pc.SetReadTimeout(HANDSHAKE_TIMEOUT)
+	defer pc.SetReadTimeout(READ_TIMEOUT)
+
+	hello := Hello{
+		Version:       PROTOCOL_VERSION,
+		GenesisHash:   c.genesisHash(),
+		Pk:            c.pk.toString(),
+		ListenAddress: c.ownPeer.Address,
+		Features:      c.features(),
+		Nonce:         generateNonce(),
+		Join:          join,
+	}
+
+	if err := pc.WriteMessage(Message{ID: HELLO_MESSAGE, Value: hello}); err != nil {
+		return err
+	}
+
+	msg, err := c.readHandshakeMessage(pc, HELLO_MESSAGE)
+	if err != nil {
+		return err
+	}
+	remote, ok := msg.Value.(Hello)
+	if !ok {
+		return c.rejectPeer(pc, "malformed hello")
+	}
+
+	if reason := c.checkCompatibility(&hello, &remote, pc.dialed); reason != "" {
+		return c.rejectPeer(pc, reason)
+	}
+
+	signature := Sign(generateHandshakeMessage(&hello, &remote), c.sk)
+	if err := pc.WriteMessage(Message{ID: HELLO_ACK_MESSAGE, Value: HelloAck{signature.String()}}); err != nil {
+		return err
+	}
+
+	msg, err = c.readHandshakeMessage(pc, HELLO_ACK_MESSAGE)
+	if err != nil {
+		return err
+	}
+	ack, ok := msg.Value.(HelloAck)
+	if !ok {
+		return c.rejectPeer(pc, "malformed hello ack")
+	}
+
+	remoteSignature, ok := new(big.Int).SetString(ack.Signature, 10)
+	if !ok || !Verify(generateHandshakeMessage(&remote, &hello), remoteSignature, GeneratePublicKeyFromString(remote.Pk)) {
+		return c.rejectPeer(pc, "invalid proof of possession for public key")
+	}
+
+	pc.remote = &remote
+
+	if hello.HasFeature("secure") && remote.HasFeature("secure") {
+		if err := c.performKeyExchange(pc, &hello); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the reason the remote peer is incompatible, or an empty string if it's compatible. dialed is
+// the address this side dialed, or empty if the remote peer dialed
+func (c *Client) checkCompatibility(local *Hello, remote *Hello, dialed string) string {
+	if remote.Version != local.Version {
+		return fmt.Sprint("unsupported protocol version ", remote.Version, ", expected ", local.Version)
+	}
+
+	// A node which is still joining doesn't know the genesis block, so it can't be compared yet. It
+	// only asks for the genesis block, so a connection used for gossip has to know it on both sides
+	if local.GenesisHash == "" || remote.GenesisHash == "" {
+		if !local.Join && !remote.Join {
+			return "unknown genesis block, which is only allowed when joining"
+		}
+	} else if local.GenesisHash != remote.GenesisHash {
+		return "different genesis block " + shortHash(remote.GenesisHash) + ", expected " + shortHash(local.GenesisHash)
+	}
+
+	if !isValidKeyString(remote.Pk) {
+		return "malformed public key"
+	}
+
+	if remote.Pk == local.Pk {
+		return "connected to self"
+	}
+
+	if ban, banned := c.reputation.IsBanned(remote.Pk, remote.ListenAddress); banned {
+		return "banned until " + ban.Until.Format(time.Stamp) + ": " + ban.Reason
+	}
+
+	// A peer which dialed may not claim the address of a peer whose key was proven by dialing the
+	// address. The peer which answers at an address it was dialed on owns it, so its key may change
+	if dialed == "" {
+		if known := c.getBoundPeer(remote.ListenAddress); known != nil && known.Pk != remote.Pk {
+			return "public key doesn't match the known peer at " + remote.ListenAddress
+		}
+	}
+
+	if SECURE_TRANSPORT.Load() == SECURE_REQUIRED && !remote.HasFeature("secure") {
+		return "the connection has to be encrypted, but the peer doesn't support it"
+	}
+
+	if !remote.HasFeature("gossip") {
+		return "peer does not support gossip"
+	}
+
+	return ""
+}
+
+// Reads the next message, and makes sure that it is the expected part of the handshake
+func (c *Client) readHandshakeMessage(pc *PeerConn, expectedID string) (Message, error) {
+	msg, err := pc.ReadMessage()
+	if err != nil {
+		return msg, err
+	}
+
+	if msg.ID == DISCONNECT_MESSAGE {
+		disconnect, _ := msg.Value.(Disconnect)
+		return msg, errors.New("peer disconnected: " + disconnect.Reason)
+	}
+
+	if msg.ID != expectedID {
+		return msg, c.rejectPeer(pc, "expected "+expectedID+" but got "+msg.ID)
+	}
+
+	return msg, nil
+}
+
+// Tells the other side why the connection is closed, and closes it
+func (c *Client) rejectPeer(pc *PeerConn, reason string) error {
+	pc.WriteMessage(Message{ID: DISCONNECT_MESSAGE, Value: Disconnect{reason}})
+	pc.Close()
+	return errors.New("rejected peer: " + reason)
+}
+
+// Checks that a string has the "n:e" format used by PublicKey.toString
+func isValidKeyString(str string) bool {
+	parts := strings.Split(str, ":")
+	if len(parts) != 2 {
+		return false
+	}
+
+	for _, part := range parts {
+		n, ok := new(big.Int).SetString(part, 10)
+		if !ok || n.Sign() <= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[0:12]
+	}
+
+	return hash
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// An index from each account to the changes of its balance on the longest chain. It follows the head:
+// when the chain grows, the new blocks are applied to the ledger of the last indexed block, and when
+// the head moves to another branch, the blocks of the old one are taken out again, back to the block
+// both branches have. A block whose transactions haven't all arrived yet stops the index, until they have.
+
+const (
+	HISTORY_ALLOCATION = "allocation" // The balance of the account in the genesis block, or in the snapshot the client started from
+	HISTORY_SENT       = "sent"
+	HISTORY_RECEIVED   = "received"
+	HISTORY_REWARD     = "reward" // The payment to the sender of a block
+)
+
+type HistoryEntry struct {
+	Height       int
+	Slot         int
+	Block        string // The signature of the block
+	Kind         string // One of the HISTORY_ kinds
+	Transaction  string // The ID of the transaction. Empty for allocations and rewards
+	Counterparty string // The other account of the transaction
+	Change       int
+	Balance      int // The balance of the account after the change
+}
+
+type HistoryIndex struct {
+	chain   []string                  // The signatures of the indexed blocks, by height
+	ledger  *Ledger                   // The balances after the last indexed block
+	entries map[string][]HistoryEntry // By account, oldest first
+}
+
+func newHistoryIndex() *HistoryIndex {
+	return &HistoryIndex{ledger: MakeLedger(), entries: make(map[string][]HistoryEntry)}
+}
+
+func (h *HistoryIndex) add(account string, entry HistoryEntry) {
+	entry.Balance = h.ledger.Accounts[account]
+	h.entries[account] = append(h.entries[account], entry)
+}
+
+// Brings the index up to date with the longest chain
+func (s *State) updateHistory() {
+	// A light client has no transactions to index
+	if s.genesisBlock == nil || s.light {
+		return
+	}
+
+	if s.history == nil {
+		s.history = newHistoryIndex()
+
+		if s.snapshot != nil {
+			s.indexSnapshot()
+		}
+	}
+
+	// Walk back from the head, until a block which is already indexed
+	var blocks []*Block
+	block := s.getLongestBlock(MAX_INT)
+	for block != nil {
+		height := s.heights[block.Signature]
+		if height < len(s.history.chain) && s.history.chain[height] == block.Signature {
+			break
+		}
+
+		blocks = append([]*Block{block}, blocks...) // Unshift the block
+		block = s.getBlockBySignature(block.PreviousBlock)
+	}
+
+	// The head has moved to another branch. The index is only built again if it can't be rewound
+	if block == nil || s.heights[block.Signature] < len(s.history.chain)-1 {
+		if len(s.history.chain) > 0 && !s.rewindHistory(block) {
+			s.history = nil
+			s.updateHistory()
+			return
+		}
+	}
+
+	for _, block := range blocks {
+		if !s.indexBlock(block) {
+			return
+		}
+	}
+}
+
+// Starts the index at the snapshot the client was started from, since it only has the headers before it
+func (s *State) indexSnapshot() {
+	h := s.history
+	base := s.snapshot.block
+
+	for block := base; block != nil; block = s.getBlockBySignature(block.PreviousBlock) {
+		h.chain = append([]string{block.Signature}, h.chain...) // Unshift the block
+	}
+
+	h.ledger = s.snapshot.ledger.Copy()
+
+	var accounts []string
+	for account := range h.ledger.Accounts {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+
+	for _, account := range accounts {
+		h.add(account, HistoryEntry{Height: s.heights[base.Signature], Slot: base.ID, Block: base.Signature, Kind: HISTORY_ALLOCATION, Change: h.ledger.Accounts[account]})
+	}
+}
+
+// Takes the blocks after the block out of the index. Returns false if the block is below the snapshot
+// the client was started from, or the balances after it can't be made
+func (s *State) rewindHistory(block *Block) bool {
+	if block == nil || (s.snapshot != nil && s.heights[block.Signature] < s.heights[s.snapshot.block.Signature]) {
+		return false
+	}
+
+	ledger, ok := s.ledgerAfter(block)
+	if !ok {
+		return false
+	}
+
+	h := s.history
+	height := s.heights[block.Signature]
+
+	for account, entries := range h.entries {
+		kept := len(entries)
+		for kept > 0 && entries[kept-1].Height > height {
+			kept--
+		}
+
+		if kept == 0 {
+			delete(h.entries, account)
+		} else {
+			h.entries[account] = entries[:kept]
+		}
+	}
+
+	h.chain = h.chain[:height+1]
+	h.ledger = ledger.Copy()
+
+	return true
+}
+
+// Applies a block to the index. Returns false if some of its transactions are missing
+func (s *State) indexBlock(block *Block) bool {
+	h := s.history
+	height := s.heights[block.Signature]
+	entry := HistoryEntry{Height: height, Slot: block.ID, Block: block.Signature}
+
+	if block.ID == 0 {
+		for _, allocation := range s.genesisBlock.Allocations {
+			h.ledger.AddAmount(allocation.Account, allocation.Amount)
+
+			allocated := entry
+			allocated.Kind = HISTORY_ALLOCATION
+			allocated.Change = allocation.Amount
+			h.add(allocation.Account, allocated)
+		}
+	}
+
+	// The balances are written after the whole block, like generateLedgerForBlock does
+	applied, reward, ok := s.applyBlockToLedger(block, h.ledger, s.usedBefore(block))
+	if !ok {
+		return false
+	}
+
+	for _, transaction := range applied {
+		amount := transaction.Amount - 1 // Ledger.SignedTransaction keeps 1 AU, which goes to the sender of the block
+
+		sent := entry
+		sent.Kind, sent.Transaction, sent.Counterparty, sent.Change = HISTORY_SENT, transaction.ID, transaction.To, -amount
+		h.add(transaction.From, sent)
+
+		received := entry
+		received.Kind, received.Transaction, received.Counterparty, received.Change = HISTORY_RECEIVED, transaction.ID, transaction.From, amount
+		h.add(transaction.To, received)
+	}
+
+	rewarded := entry
+	rewarded.Kind = HISTORY_REWARD
+	rewarded.Change = reward
+	h.add(block.Sender, rewarded)
+
+	h.chain = append(h.chain, block.Signature)
+	return true
+}
+
+// Returns the changes to the balance of the account in the blocks from the height from up to and
+// including the height to. A negative to means up to the head
+func (s *State) accountHistory(account string, from int, to int) []HistoryEntry {
+	s.updateHistory()
+	if s.history == nil {
+		return nil
+	}
+
+	var entries []HistoryEntry
+	for _, entry := range s.history.entries[account] {
+		if entry.Height >= from && (to < 0 || entry.Height <= to) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Returns the balance of the account after the block at the height, on the longest chain
+func (s *State) balanceAt(account string, height int) int {
+	s.updateHistory()
+	if s.history == nil {
+		return 0
+	}
+
+	balance := 0
+	for _, entry := range s.history.entries[account] {
+		if entry.Height > height {
+			break
+		}
+		balance = entry.Balance
+	}
+
+	return balance
+}
+
+// Returns the height of the last block in the index, which is the head unless transactions are missing
+func (s *State) historyHeight() int {
+	s.updateHistory()
+	if s.history == nil {
+		return -1
+	}
+
+	return len(s.history.chain) - 1
+}
+
+func (c *Client) accountHistory(account string, from int, to int) ([]HistoryEntry, int, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entries := c.State.accountHistory(account, from, to)
+	height := c.historyHeight()
+	if to >= 0 && to < height {
+		height = to
+	}
+
+	return entries, c.balanceAt(account, height), height
+}
+
+// Prints the transactions and the rewards of the account separately, followed by the balance
+func printHistory(client *Client, account string, from int, to int) {
+	entries, balance, height := client.accountHistory(account, from, to)
+
+	name := shortHash(account)
+	if peer := client.GetPeerFromPK(account); peer != nil {
+		name += " (" + peer.Address + ")"
+	}
+
+	fmt.Println("History of", name, "from height", from, "to", height)
+
+	fmt.Println("\nTransactions:")
+	transactions, rewards, rewardTotal := 0, 0, 0
+	for _, entry := range entries {
+		switch entry.Kind {
+		case HISTORY_SENT, HISTORY_RECEIVED:
+			counterparty := shortHash(entry.Counterparty)
+			if peer := client.GetPeerFromPK(entry.Counterparty); peer != nil {
+				counterparty = peer.Address
+			}
+
+			direction := "to"
+			if entry.Kind == HISTORY_RECEIVED {
+				direction = "from"
+			}
+
+			fmt.Println("  Height", entry.Height, "slot", entry.Slot, entry.Kind, entry.Transaction, direction, counterparty+":", formatChange(entry.Change), "AU, balance", entry.Balance)
+			transactions++
+		case HISTORY_ALLOCATION:
+			if entry.Height == 0 {
+				fmt.Println("  Height 0: allocated", entry.Change, "AU in the genesis block, balance", entry.Balance)
+			} else {
+				fmt.Println("  Height", entry.Height, "slot", entry.Slot, "had", entry.Change, "AU in the snapshot the client started from")
+			}
+		}
+	}
+	if transactions == 0 {
+		fmt.Println("  None")
+	}
+
+	fmt.Println("\nBlock rewards:")
+	for _, entry := range entries {
+		if entry.Kind == HISTORY_REWARD {
+			fmt.Println("  Height", entry.Height, "slot", entry.Slot, "block", shortHash(entry.Block)+":", formatChange(entry.Change), "AU, balance", entry.Balance)
+			rewards++
+			rewardTotal += entry.Change
+		}
+	}
+	if rewards == 0 {
+		fmt.Println("  None")
+	} else {
+		fmt.Println("  Made", rewards, "block(s), for", rewardTotal, "AU in total")
+	}
+
+	fmt.Println("\nBalance at height", strconv.Itoa(height)+":", balance, "AU")
+	fmt.Println()
+}
+
+func formatChange(change int) string {
+	if change > 0 {
+		return "+" + strconv.Itoa(change)
+	}
+
+	return strconv.Itoa(change)
+}
@@ -68,16 +68,17 @@ func (l *Ledger) PrintStatus() {
 	}
 }
 
+// Returns true if every account has the same balance in both ledgers. Accounts with nothing are
+// the same as missing ones
 func (l *Ledger) Match(ledger *Ledger) bool {
-	var keys = reflect.ValueOf(l.Accounts).MapKeys()
-
-	for _, key := range keys {
-		keyStr := key.String()
+	return l.Root() == ledger.Root()
+}
 
-		if l.Accounts[keyStr] != ledger.Accounts[keyStr] {
-			return false
-		}
+func (l *Ledger) Copy() *Ledger {
+	ledger := MakeLedger()
+	for account, balance := range l.Accounts {
+		ledger.Accounts[account] = balance
 	}
 
-	return true
+	return ledger
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A light client only keeps the headers of the blocks. It checks the signature and the draw of each
+// header, and that it follows a known header, but it can't check the bodies, so it never makes or
+// relays blocks, and it doesn't keep the transactions of others. Balances and transactions are
+// proven to it by full nodes instead, with Merkle proofs against the roots in its headers.
+// Light clients say so in their Hello, and full nodes only send them headers.
+
+var errUnknownHeader = errors.New("the block isn't among the headers of this client")
+
+// Asks for a proof against the block. For a transaction proof, the block may be left empty, in
+// which case the full node looks for the transaction on its longest chain
+type ProofRequest struct {
+	ID          uint64 // Picked by the light client, and sent back in the response, to tell identical requests apart
+	Block       string
+	Account     string // Set for a balance proof
+	Transaction string // Set for a transaction proof
+}
+
+type ProofResponse struct {
+	Request          ProofRequest
+	Balance          BalanceProof
+	Transaction      SignedTransaction
+	TransactionProof MerkleProof
+	Error            string // Why the proof couldn't be made. Empty if it could
+}
+
+// The requests a light client is waiting for the answer to. They are kept by the connection they
+// were sent on and their ID, so an answer is only taken from the peer which was asked, and two
+// identical requests don't get each other's answers
+type ProofWaiters struct {
+	lock    sync.Mutex
+	nextID  uint64
+	waiting map[proofWaiterKey]proofWaiter
+}
+
+type proofWaiterKey struct {
+	pc *PeerConn
+	id uint64
+}
+
+type proofWaiter struct {
+	request   ProofRequest
+	responses chan ProofResponse
+}
+
+func NewProofWaiters() *ProofWaiters {
+	return &ProofWaiters{waiting: make(map[proofWaiterKey]proofWaiter)}
+}
+
+// Gives the request an ID, and waits for the answer to it from the connection
+func (w *ProofWaiters) wait(pc *PeerConn, request *ProofRequest) chan ProofResponse {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.nextID++
+	request.ID = w.nextID
+
+	responses := make(chan ProofResponse, 1)
+	w.waiting[proofWaiterKey{pc, request.ID}] = proofWaiter{*request, responses}
+
+	return responses
+}
+
+func (w *ProofWaiters) stop(pc *PeerConn, request ProofRequest) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	delete(w.waiting, proofWaiterKey{pc, request.ID})
+}
+
+// Hands the response to the request it answers. Returns false if nothing is waiting for it from
+// the connection, like when the peer wasn't asked, or the answer came too late
+func (w *ProofWaiters) deliver(pc *PeerConn, response ProofResponse) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	key := proofWaiterKey{pc, response.Request.ID}
+	waiter, ok := w.waiting[key]
+	if !ok || waiter.request != response.Request {
+		return false
+	}
+
+	delete(w.waiting, key)
+	waiter.responses <- response
+
+	return true
+}
+
+// Returns what a light peer gets instead of the message: a header instead of a block, and nothing
+// instead of a transaction. Returns false if the message isn't sent to light peers
+func lightMessage(msg Message) (Message, bool) {
+	switch msg.ID {
+	case BLOCK_MESSAGE:
+		var header BlockHeader
+		switch block := msg.Value.(type) {
+		case Block:
+			header = block.BlockHeader
+		case *Block:
+			header = block.BlockHeader
+		default:
+			return msg, false
+		}
+
+		msg.ID = HEADER_MESSAGE
+		msg.Value = header
+		return msg, true
+
+	case TRANSACTION_MESSAGE:
+		return msg, false
+	}
+
+	return msg, true
+}
+
+func isLightPeer(pc *PeerConn) bool {
+	return pc.remote != nil && pc.remote.HasFeature("light")
+}
+
+// A light client only passes on its own transactions, which it has signed itself
+func (c *Client) handleLightTransaction(msg Message) Verdict {
+	transaction, ok := msg.Value.(SignedTransaction)
+	if !ok {
+		return VERDICT_INVALID
+	}
+
+	if transaction.From != c.ownPeer.Pk {
+		return VERDICT_IGNORED
+	}
+
+	c.lock.Lock()
+	for _, id := range c.transactionsSent {
+		if id == transaction.ID {
+			c.lock.Unlock()
+			return VERDICT_DUPLICATE
+		}
+	}
+	c.transactionsSent = append(c.transactionsSent, transaction.ID)
+	c.lock.Unlock()
+
+	c.broadcast(msg)
+
+	return VERDICT_USEFUL
+}
+
+// Makes the proof a light client asked for
+func (s *State) answerProofRequest(request ProofRequest) ProofResponse {
+	response := ProofResponse{Request: request}
+
+	var err error
+	if request.Account != "" {
+		response.Balance, err = s.balanceProof(request.Block, request.Account)
+	} else {
+		signature := request.Block
+		if signature == "" {
+			signature = s.findTransactionBlock(request.Transaction)
+		}
+
+		if signature == "" {
+			err = errors.New("the transaction isn't on the longest chain")
+		} else {
+			response.Transaction = s.transactionsByID[request.Transaction]
+			response.TransactionProof, err = s.transactionProof(signature, request.Transaction)
+		}
+	}
+
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	return response
+}
+
+// Returns the signature of the block on the longest chain with the transaction, or an empty string
+func (s *State) findTransactionBlock(id string) string {
+	for block := s.getLongestBlock(MAX_INT); block != nil; block = s.getBlockBySignature(block.PreviousBlock) {
+		for _, other := range block.Transactions {
+			if other == id {
+				return block.Signature
+			}
+		}
+	}
+
+	return ""
+}
+
+func (c *Client) handleGetProof(pc *PeerConn, request ProofRequest) {
+	if c.light {
+		return
+	}
+
+	c.lock.Lock()
+	response := c.answerProofRequest(request)
+	c.lock.Unlock()
+
+	c.queueMessage(pc, Message{ID: PROOF_MESSAGE, Value: response})
+}
+
+// Asks the connected full nodes for a proof, one at a time, until one of them answers with a proof
+// which check accepts. Peers whose proofs are rejected are punished like for any invalid message
+func (c *Client) requestProof(request ProofRequest, check func(ProofResponse) error) (ProofResponse, error) {
+	err := errors.New("not connected to any full nodes")
+
+	for _, pc := range c.getConnections() {
+		if isLightPeer(pc) {
+			continue
+		}
+
+		responses := c.proofWaiters.wait(pc, &request)
+		c.queueMessage(pc, Message{ID: GET_PROOF_MESSAGE, Value: request})
+
+		select {
+		case response := <-responses:
+			if response.Error != "" {
+				err = errors.New(pc.RemoteAddr() + ": " + response.Error)
+				continue
+			}
+
+			if err = check(response); err != nil {
+				// The header may just not have reached this client yet
+				if !errors.Is(err, errUnknownHeader) {
+					c.log.Warn(LOG_WALLET, "Got an invalid proof", "peer", pc.RemoteAddr(), "error", err)
+					c.scorePeer(pc, VERDICT_INVALID)
+				}
+				continue
+			}
+
+			return response, nil
+
+		case <-time.After(PROOF_TIMEOUT):
+			c.proofWaiters.stop(pc, request)
+			err = errors.New(pc.RemoteAddr() + " didn't answer")
+		}
+	}
+
+	return ProofResponse{}, err
+}
+
+// Returns the balance of the account after the head, proven by a full node, and the height of the head
+func (c *Client) provenBalance(account string) (int, int, error) {
+	c.lock.Lock()
+	head := c.getLongestBlock(MAX_INT)
+	height := c.chainHeight(head)
+	c.lock.Unlock()
+
+	request := ProofRequest{Block: head.Signature, Account: account}
+	response, err := c.requestProof(request, func(response ProofResponse) error {
+		if response.Balance.Account != account {
+			return errors.New("the proof is for another account")
+		}
+
+		return VerifyBalanceProof(head.BlockHeader, response.Balance)
+	})
+
+	return response.Balance.Balance, height, err
+}
+
+// Returns the block on the longest chain with the transaction, proven by a full node
+func (c *Client) provenTransaction(id string) (*Block, error) {
+	var block *Block
+
+	_, err := c.requestProof(ProofRequest{Transaction: id}, func(response ProofResponse) error {
+		c.lock.Lock()
+		block = c.getBlockBySignature(response.TransactionProof.Block)
+		c.lock.Unlock()
+
+		if block == nil {
+			return errUnknownHeader
+		}
+
+		if response.Transaction.ID != id {
+			return errors.New("the proof is for another transaction")
+		}
+
+		return VerifyTransactionProof(block.BlockHeader, response.Transaction, response.TransactionProof)
+	})
+
+	return block, err
+}
+
+// Prints the balance of the account. A light client asks a full node for a proof of it
+func printBalance(client *Client, account string, name string) {
+	if client.light {
+		balance, height, err := client.provenBalance(account)
+		if err != nil {
+			fmt.Println("Unable to get a proof of the balance of", name+":", err.Error())
+			return
+		}
+
+		fmt.Println(name, "has", balance, "AU at height", height, "(proven by a full node)")
+		return
+	}
+
+	ledger, _ := client.generateNewestLedger()
+	if ledger == nil {
+		fmt.Println("Unable to calculate the ledger")
+		return
+	}
+
+	client.lock.Lock()
+	height := client.chainHeight(client.getLongestBlock(MAX_INT))
+	client.lock.Unlock()
+
+	fmt.Println(name, "has", ledger.Accounts[account], "AU at height", height)
+}
+
+// Prints the block on the longest chain of the client which holds the transaction
+func printTransactionProof(client *Client, id string) {
+	var block *Block
+	var err error
+
+	if client.light {
+		block, err = client.provenTransaction(id)
+	} else {
+		client.lock.Lock()
+		block = client.getBlockBySignature(client.findTransactionBlock(id))
+		client.lock.Unlock()
+
+		if block == nil {
+			err = errors.New("it isn't on the longest chain")
+		}
+	}
+
+	if err != nil {
+		fmt.Println("Unable to prove that transaction", id, "is in a block:", err.Error())
+		return
+	}
+
+	client.lock.Lock()
+	height := client.heights[block.Signature]
+	onChain := false
+	for other := client.getLongestBlock(MAX_INT); other != nil; other = client.getBlockBySignature(other.PreviousBlock) {
+		if other == block {
+			onChain = true
+			break
+		}
+	}
+	client.lock.Unlock()
+
+	fmt.Println("Transaction", id, "is in block", shortHash(block.Signature), "at height", height, "in slot", block.ID)
+	if !onChain {
+		fmt.Println("The block isn't on the longest chain of the client")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestProofWaitersMatchConnectionAndID(t *testing.T) {
+	waiters := NewProofWaiters()
+	asked, other := &PeerConn{}, &PeerConn{}
+
+	// Two identical requests, like two balance lookups of the same account at once
+	first := ProofRequest{Account: "1:3"}
+	second := first
+	firstResponses := waiters.wait(asked, &first)
+	secondResponses := waiters.wait(asked, &second)
+
+	if first.ID == second.ID {
+		t.Fatal("identical requests got the same ID")
+	}
+
+	if waiters.deliver(other, ProofResponse{Request: first}) {
+		t.Error("took an answer from a peer which wasn't asked")
+	}
+
+	if !waiters.deliver(asked, ProofResponse{Request: second, Error: "second"}) {
+		t.Fatal("dropped the answer to the second request")
+	}
+
+	select {
+	case response := <-firstResponses:
+		t.Fatalf("the first request got the answer %q to the second", response.Error)
+	case response := <-secondResponses:
+		if response.Error != "second" {
+			t.Fatalf("the second request got the answer %q", response.Error)
+		}
+	}
+
+	// A request which timed out doesn't take a late answer
+	waiters.stop(asked, first)
+	if waiters.deliver(asked, ProofResponse{Request: first}) {
+		t.Error("took an answer to a request which was given up on")
+	}
+}
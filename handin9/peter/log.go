@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A structured, levelled logger. Every line has a level, a subsystem and a message, followed by
+// the fields of the logger and of the call, as key, value pairs. Many clients can share one
+// process, so each client has its own logger, with its address and short public key as fields.
+type Logger struct {
+	fields []interface{}
+}
+
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+	LOG_OFF
+)
+
+// The subsystems, whose levels can be set one by one
+const (
+	LOG_NETWORK   = "network"   // Connections, handshakes and peers
+	LOG_CONSENSUS = "consensus" // Blocks, draws and the lottery
+	LOG_LEDGER    = "ledger"    // Building ledgers from the chain
+	LOG_WALLET    = "wallet"    // Transactions, keys and the node itself
+)
+
+var LOG_SUBSYSTEMS = []string{LOG_NETWORK, LOG_CONSENSUS, LOG_LEDGER, LOG_WALLET}
+
+var LOG_LEVEL_NAMES = map[LogLevel]string{LOG_DEBUG: "debug", LOG_INFO: "info", LOG_WARN: "warn", LOG_ERROR: "error", LOG_OFF: "off"}
+
+// How lines are written, and which are written. Guarded by logLock
+var logLock sync.Mutex
+var logOutput io.Writer = os.Stdout
+var logFormat = "text"
+var logDefaultLevel = LOG_INFO
+var logLevels = make(map[string]LogLevel) // Levels of the subsystems which don't use the default
+
+// The logger for things which don't belong to a single client
+var logger = &Logger{}
+
+func (l *Logger) With(fields ...interface{}) *Logger {
+	var own []interface{}
+	if l != nil {
+		own = l.fields
+	}
+
+	return &Logger{fields: append(append([]interface{}{}, own...), fields...)}
+}
+
+// Returns a logger with the address and short public key of the peer
+func newPeerLogger(peer Peer) *Logger {
+	return logger.With("client", peer.Address, "pk", shortHash(peer.Pk))
+}
+
+func (l *Logger) Debug(subsystem string, msg string, fields ...interface{}) {
+	l.write(LOG_DEBUG, subsystem, msg, fields)
+}
+
+func (l *Logger) Info(subsystem string, msg string, fields ...interface{}) {
+	l.write(LOG_INFO, subsystem, msg, fields)
+}
+
+func (l *Logger) Warn(subsystem string, msg string, fields ...interface{}) {
+	l.write(LOG_WARN, subsystem, msg, fields)
+}
+
+func (l *Logger) Error(subsystem string, msg string, fields ...interface{}) {
+	l.write(LOG_ERROR, subsystem, msg, fields)
+}
+
+func (l *Logger) write(level LogLevel, subsystem string, msg string, fields []interface{}) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	minimum, ok := logLevels[subsystem]
+	if !ok {
+		minimum = logDefaultLevel
+	}
+
+	if level < minimum || level == LOG_OFF {
+		return
+	}
+
+	var all []interface{}
+	if l != nil {
+		all = append(all, l.fields...)
+	}
+	all = append(all, fields...)
+
+	now := time.Now()
+
+	if logFormat == "json" {
+		line := map[string]interface{}{"time": now.Format(time.RFC3339Nano), "level": LOG_LEVEL_NAMES[level], "subsystem": subsystem, "msg": msg}
+		for i := 0; i+1 < len(all); i += 2 {
+			line[fmt.Sprint(all[i])] = logValue(all[i+1])
+		}
+
+		data, err := json.Marshal(line)
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintln(logOutput, string(data))
+		return
+	}
+
+	text := now.Format("15:04:05.000") + " " + strings.ToUpper(LOG_LEVEL_NAMES[level]) + " [" + subsystem + "] " + msg
+	for i := 0; i+1 < len(all); i += 2 {
+		value := fmt.Sprint(logValue(all[i+1]))
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+
+		text += " " + fmt.Sprint(all[i]) + "=" + value
+	}
+
+	fmt.Fprintln(logOutput, text)
+}
+
+// Errors are written as their message, since they are empty objects in JSON
+func logValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+
+	return value
+}
+
+func parseLogLevel(str string) (LogLevel, error) {
+	for level, name := range LOG_LEVEL_NAMES {
+		if name == strings.ToLower(str) {
+			return level, nil
+		}
+	}
+
+	return LOG_INFO, errors.New("unknown log level " + str + ", expected debug, info, warn, error or off")
+}
+
+func isLogSubsystem(str string) bool {
+	for _, subsystem := range LOG_SUBSYSTEMS {
+		if subsystem == str {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sets the levels from a list like "info,network=debug,ledger=off". A level on its own is the default
+func setLogLevels(str string) error {
+	levels := make(map[string]LogLevel)
+	defaultLevel := LOG_INFO
+
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) == 1 {
+			level, err := parseLogLevel(pair[0])
+			if err != nil {
+				return err
+			}
+
+			defaultLevel = level
+			continue
+		}
+
+		if !isLogSubsystem(pair[0]) {
+			return errors.New("unknown subsystem " + pair[0] + ", expected one of " + strings.Join(LOG_SUBSYSTEMS, ", "))
+		}
+
+		level, err := parseLogLevel(pair[1])
+		if err != nil {
+			return err
+		}
+
+		levels[pair[0]] = level
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	logDefaultLevel = defaultLevel
+	logLevels = levels
+	return nil
+}
+
+// Sets the level of a single subsystem, or the default level and every subsystem for "all"
+func setLogLevel(subsystem string, level LogLevel) error {
+	if subsystem != "all" && !isLogSubsystem(subsystem) {
+		return errors.New("unknown subsystem " + subsystem + ", expected all or one of " + strings.Join(LOG_SUBSYSTEMS, ", "))
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if subsystem == "all" {
+		logDefaultLevel = level
+		logLevels = make(map[string]LogLevel)
+	} else {
+		logLevels[subsystem] = level
+	}
+
+	return nil
+}
+
+func setLogFormat(format string) error {
+	if format != "text" && format != "json" {
+		return errors.New("unknown log format " + format + ", expected text or json")
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	logFormat = format
+	return nil
+}
+
+// Returns the level of each subsystem, like "network=debug consensus=info ..."
+func describeLogLevels() string {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	var parts []string
+	for _, subsystem := range LOG_SUBSYSTEMS {
+		level, ok := logLevels[subsystem]
+		if !ok {
+			level = logDefaultLevel
+		}
+
+		parts = append(parts, subsystem+"="+LOG_LEVEL_NAMES[level])
+	}
+
+	return strings.Join(parts, " ") + ", format " + logFormat
+}
@@ -2,12 +2,11 @@ package main
 
 import (
 	"crypto/sha256"
-	"fmt"
 	"math/big"
 	"strconv"
 )
 
-func (c *Client) CalculateDrawValue(seed int, slot int, draw *big.Int, publicKey PublicKey) *big.Int {
+func CalculateDrawValue(seed int, slot int, draw *big.Int, publicKey PublicKey) *big.Int {
 	_, drawMsgStr := GenerateDrawMessage(seed, slot)
 
 	shaMsg := []byte(drawMsgStr + publicKey.toString() + draw.String())
@@ -19,24 +18,24 @@ func (c *Client) CalculateDrawValue(seed int, slot int, draw *big.Int, publicKey
 	return val
 }
 
-func (c *Client) IsValidDraw(seed int, slot int, draw *big.Int, senderPk PublicKey) bool {
+func (s *State) IsValidDraw(seed int, slot int, draw *big.Int, senderPk PublicKey) bool {
 	// Make sure it's a king who signed the message
 	isKing := false
-	for _, key := range c.genesisBlock.KingKeys {
+	for _, key := range s.genesisBlock.KingKeys {
 		if senderPk.toString() == key {
 			isKing = true
 			break
 		}
 	}
 	if !isKing {
-		fmt.Println("Invalid draw: Isn't king")
+		s.log.Warn(LOG_CONSENSUS, "Invalid draw: the sender isn't a king", "slot", slot)
 		return false
 	}
 
 	// Make sure that the value is above the hardness
-	val := c.CalculateDrawValue(seed, slot, draw, senderPk)
-	if val.Cmp(HARDNESS) < 0 {
-		fmt.Println("Invalid draw: the value is too low")
+	val := CalculateDrawValue(seed, slot, draw, senderPk)
+	if val.Cmp(s.genesisBlock.hardness()) < 0 {
+		s.log.Warn(LOG_CONSENSUS, "Invalid draw: the value is too low", "slot", slot)
 		return false
 	}
 
@@ -44,7 +43,7 @@ func (c *Client) IsValidDraw(seed int, slot int, draw *big.Int, senderPk PublicK
 	valid := Verify(drawMsg, draw, senderPk)
 
 	if !valid {
-		fmt.Println("Invalid draw: could verify the draw with the signature")
+		s.log.Warn(LOG_CONSENSUS, "Invalid draw: couldn't verify the draw with the signature", "slot", slot)
 	}
 
 	return valid
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -19,21 +20,25 @@ import (
 
 var networks = []*Network{}
 
-func createClient(ip string) *Client {
+// Creates a client which joins the network of the peer at ip, or starts a new network. A light client
+// only keeps block headers, so it has to join an existing network. Returns nil if it can't
+func createClient(ip string, light bool) *Client {
 
 	client := &Client{}
+	client.light = light
 
 	// Check if the client connects to an already existing network
-	for i := 0; i < len(networks); i++ {
-		network := networks[i]
+	if network := findNetwork(ip); network != nil {
+		network.AddClient(client, ip)
 
-		if network.ContainsClientWithIP(ip) {
-			network.AddClient(client, ip)
+		fmt.Println("[Added client to existing network]")
+		time.Sleep(1 * time.Second)
+		return client
+	}
 
-			fmt.Println("[Added client to existing network]")
-			time.Sleep(1 * time.Second)
-			return client
-		}
+	if light {
+		fmt.Println("A light client has to join an existing network, since it can't make the genesis block")
+		return nil
 	}
 
 	// If we got down here, it's a new network
@@ -46,6 +51,87 @@ func createClient(ip string) *Client {
 	return client
 }
 
+// Returns the network with a client at the ip, or nil if there is none
+func findNetwork(ip string) *Network {
+	for i := 0; i < len(networks); i++ {
+		if networks[i].ContainsClientWithIP(ip) {
+			return networks[i]
+		}
+	}
+
+	return nil
+}
+
+// Creates a client which starts from the snapshot, and joins the network of the peer at ip
+func createClientFromSnapshot(ip string, snapshot *Snapshot) (*Client, error) {
+	network := findNetwork(ip)
+	if network == nil {
+		return nil, errors.New("a client started from a snapshot has to join an existing network")
+	}
+
+	if len(network.Clients) > 0 && network.Clients[0].genesisHash() != snapshot.Genesis.Hash() {
+		return nil, errors.New("the snapshot is of another chain than the network")
+	}
+
+	client := &Client{}
+	if err := client.setGenesisBlock(&snapshot.Genesis); err != nil {
+		return nil, err
+	}
+
+	if err := client.importSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+
+	network.AddClient(client, ip)
+	time.Sleep(1 * time.Second)
+
+	return client, nil
+}
+
+// Returns the slot a client joining the network is at. A genesis block with a start time decides it.
+// Without one, the clients of the network count the slots from when the lottery was started, and a
+// new network hasn't counted any yet
+func networkSlot(network *Network, genesis *GenesisBlock) int {
+	if !genesis.StartTime.IsZero() {
+		return genesis.slotAt(time.Now())
+	}
+
+	if network != nil && len(network.Clients) > 0 {
+		return network.Clients[0].getCurrentSlot()
+	}
+
+	return NO_SLOT
+}
+
+// Creates a client which starts with the blocks and transactions of the chain, and joins the network
+// of the peer at ip, or starts a new network with the genesis block of the chain
+func createClientFromChain(ip string, chain *Chain) (*Client, error) {
+	network := findNetwork(ip)
+	if network != nil && len(network.Clients) > 0 && network.Clients[0].genesisHash() != chain.Genesis.Hash() {
+		return nil, errors.New("the chain is of another genesis block than the network")
+	}
+
+	client := &Client{}
+	if err := client.setGenesisBlock(chain.Genesis); err != nil {
+		return nil, err
+	}
+
+	if err := client.importChain(chain, networkSlot(network, chain.Genesis)); err != nil {
+		return nil, err
+	}
+
+	if network == nil {
+		fmt.Println("[Creating a new network for the client]")
+		network = &Network{Topology: RingTopology{}}
+		networks = append(networks, network)
+	}
+
+	network.AddClient(client, ip)
+	time.Sleep(1 * time.Second)
+
+	return client, nil
+}
+
 func sendTransaction(from *Client, to *Client, amount int) bool {
 	if from.ownPeer == to.ownPeer {
 		fmt.Println("from and to cannot be the same")
@@ -53,8 +139,7 @@ func sendTransaction(from *Client, to *Client, amount int) bool {
 		fmt.Println("Cannot make a transaction of less than 1 AU")
 	} else {
 
-		id := from.ownPeer.Address + "-" + strconv.Itoa(from.transactionID)
-		from.transactionID++
+		id := from.ownPeer.Address + "-" + strconv.Itoa(from.nextTransactionID())
 
 		transaction := SignedTransaction{ID: id, From: from.ownPeer.Pk, To: to.ownPeer.Pk, Amount: amount}
 
@@ -64,7 +149,7 @@ func sendTransaction(from *Client, to *Client, amount int) bool {
 		transaction.Signature = signature.String()
 
 		if transaction.isValid() {
-			var message = Message{ID: TRANSACTION_MESSAGE, Value: transaction}
+			var message = from.traceOrigin(Message{ID: TRANSACTION_MESSAGE, Value: transaction}, id)
 
 			//fmt.Println("Sending transaction with id ", id, " from ", from.ownPeer.Address, " to ", to.ownPeer.Address, " for ", amount, "Msg:", message)
 
@@ -108,6 +193,34 @@ func checkRange(index int, len int) {
 	}
 }
 
+// Parses a network index and a client index. Returns a nil network if either of them is invalid
+func parseClientIndex(networkParam string, clientParam string) (*Network, int) {
+	networkIndex, errNetwork := strconv.Atoi(networkParam)
+	clientIndex, errClient := strconv.Atoi(clientParam)
+
+	checkError(errNetwork, "Invalid network index")
+	checkError(errClient, "Invalid client index")
+
+	if gotError {
+		return nil, 0
+	}
+
+	checkRange(networkIndex, len(networks))
+
+	if gotError {
+		return nil, 0
+	}
+
+	network := networks[networkIndex]
+	checkRange(clientIndex, len(network.Clients))
+
+	if gotError {
+		return nil, 0
+	}
+
+	return network, clientIndex
+}
+
 func benchmarkTransactions(network *Network) {
 
 	numClients := math.Min(10, float64(len(network.Clients)))
@@ -146,16 +259,20 @@ func benchmarkTransactions(network *Network) {
 		client := network.Clients[i]
 
 		// We only need 90% of the transactions to arrive, because of a bug that makes valid transactions invalid
-		for len(client.transactionsReceived) < sent {
+		for client.transactionCount() < sent {
 			time.Sleep(1 * time.Millisecond)
 		}
 
-		fmt.Println("Client", i, "has ", len(client.transactionsReceived), "transactions")
+		fmt.Println("Client", i, "has ", client.transactionCount(), "transactions")
 	}
 
 	t := time.Now()
 	elapsed := t.Sub(start)
 	fmt.Println("Time elapsed:", elapsed)
+
+	metrics.Set("benchmark_transactions", float64(sent))
+	metrics.Set("benchmark_duration_seconds", elapsed.Seconds())
+	metrics.Set("benchmark_transactions_per_second", float64(sent)/elapsed.Seconds())
 	printArrow()
 }
 
@@ -165,18 +282,42 @@ var terminate = false
 var fullIP = regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}:\d{1,5}$`)
 var onlyPort = regexp.MustCompile(`^:\d{1,5}$`)
 
-func main() {
-
-	// Register gob interfaces - need for en-/decoding
+// Register gob interfaces - need for en-/decoding. This is done in init, so the tests have them too
+func init() {
 	gob.Register(Peer{})
 	gob.Register([]Peer{})
 	gob.Register(SignedTransaction{})
 	gob.Register(Block{})
+	gob.Register(BlockHeader{})
+	gob.Register(ProofRequest{})
+	gob.Register(ProofResponse{})
 	gob.Register(GenesisBlock{})
 	gob.Register(InitInfo{})
+	gob.Register(Hello{})
+	gob.Register(HelloAck{})
+	gob.Register(Disconnect{})
+	gob.Register(KeyExchange{})
+	gob.Register(Addresses{})
+}
 
+func main() {
 	InitConsts()
 
+	// Run a single node, or write a genesis file, instead of the REPL
+	if len(os.Args) > 1 && os.Args[1] == "node" {
+		if err := runNode(os.Args[2:]); err != nil {
+			fmt.Println("Unable to run the node:", err.Error())
+			os.Exit(1)
+		}
+		return
+	} else if len(os.Args) > 1 && os.Args[1] == "genesis" {
+		if err := runGenesis(os.Args[2:]); err != nil {
+			fmt.Println("Unable to write the genesis file:", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Start listening for user input
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -222,7 +363,29 @@ func handleCommand(text string) {
 		return false
 	}
 
-	if cmCheck("createClient cc", 1) {
+	// Like cmCheck, for commands which take optional arguments after the required ones
+	cmCheckMin := func(exptectedString string, minArgs int) bool {
+		for _, str := range strings.Split(exptectedString, " ") {
+			if strings.ToLower(str) == command {
+				if len(params) >= minArgs {
+					return true
+				}
+
+				invalidCommand = true
+				fmt.Println("Invalid number of arguments. Expected at least", minArgs, "but got", len(params))
+			}
+		}
+
+		return false
+	}
+
+	if cmCheckMin("createClient cc", 1) {
+		light := len(params) > 1 && params[1] == "light"
+		if len(params) > 1 && !light {
+			fmt.Println("Expected \"light\" or nothing after the IP")
+			return
+		}
+
 		fmt.Println("Creating a new client")
 
 		ip := params[0]
@@ -234,8 +397,9 @@ func handleCommand(text string) {
 			fmt.Println("This is not a valid ip. Using", ip)
 		}
 
-		createClient(ip)
-		fmt.Println("Finished creating client")
+		if createClient(ip, light) != nil {
+			fmt.Println("Finished creating client")
+		}
 
 	} else if cmCheck("trans", 4) {
 		networkIndex, errNetwork := strconv.Atoi(params[0])
@@ -339,11 +503,26 @@ func handleCommand(text string) {
 			var first *Ledger
 			var matches = 0
 
+			lightClients := 0
+
 			for j := 0; j < numClients; j++ {
 				fmt.Println("Client", j)
-				ledger, _ := network.Clients[i].generateNewestLedger()
+
+				// A light client has no ledger to compare
+				if client := network.Clients[j]; client.light {
+					client.lock.Lock()
+					fmt.Println("A light client with", len(client.blocks), "headers, at height", client.chainHeight(client.getLongestBlock(MAX_INT)))
+					client.lock.Unlock()
+
+					fmt.Println()
+					lightClients++
+					continue
+				}
+
+				ledger, _ := network.Clients[j].generateNewestLedger()
 				if ledger != nil {
 					ledger.PrintStatus()
+					fmt.Println("Root of the balances:", ledger.Root())
 					fmt.Println()
 
 					if first == nil {
@@ -355,7 +534,13 @@ func handleCommand(text string) {
 				}
 			}
 
-			fmt.Println("Got", matches, "/", numClients, "matches")
+			fmt.Println("Got", matches, "/", numClients-lightClients, "matches")
+
+			if matches == numClients-lightClients {
+				fmt.Println("All ledgers have converged")
+			} else {
+				fmt.Println("The ledgers have not converged")
+			}
 		}
 	} else if cmCheck("list ls", 0) {
 		for i := 0; i < len(networks); i++ {
@@ -363,11 +548,19 @@ func handleCommand(text string) {
 			network := networks[i]
 			length := len(network.Clients)
 
-			fmt.Println("Network", i, "contains", length, "client(s)")
+			fmt.Println("Network", i, "contains", length, "client(s), and uses the", network.Topology.Name(), "topology")
 
 			for j := 0; j < length; j++ {
 				client := network.Clients[j]
-				fmt.Println("Client", j, "is connected to", len(client.peers), "peers, and has ip", client.ownPeer.Address, " and key:", client.ownPeer.Pk[0:50]+"...")
+				secure := 0
+				for _, pc := range client.getConnections() {
+					if pc.IsSecure() {
+						secure++
+					}
+				}
+
+				fmt.Println("Client", j, "is connected to", len(client.getPeers()), "peers, and has ip", client.ownPeer.Address, " and key:", client.ownPeer.Pk[0:50]+"...")
+				fmt.Println("Client", j, "has", len(client.getConnections()), "connection(s), of which", secure, "are encrypted")
 			}
 
 			fmt.Println()
@@ -388,8 +581,10 @@ func handleCommand(text string) {
 
 		go benchmarkTransactions(network)
 
+	} else if cmCheck("metrics", 0) {
+		metrics.WriteText(os.Stdout)
 	} else if cmCheck("keys", 0) {
-		fmt.Println("Listing all King keys in each network\n")
+		fmt.Print("Listing all King keys in each network\n\n")
 		for networkIndex, network := range networks {
 
 			fmt.Println("Network", networkIndex)
@@ -401,37 +596,94 @@ func handleCommand(text string) {
 			fmt.Println()
 		}
 	} else if cmCheck("help", 0) {
-		fmt.Println("Displaying a list of all commands:\n")
+		fmt.Print("Displaying a list of all commands:\n\n")
 
-		fmt.Println("createClient | cc\t<ip : string>")
-		fmt.Println("Creates a new client and adds it to an exsisting network, if the IP matches another peer\n")
+		fmt.Println("createClient | cc\t<ip : string> [light]")
+		fmt.Print("Creates a new client and adds it to an exsisting network, if the IP matches another peer. A light client only keeps block headers, and asks full nodes for proofs of balances and transactions\n\n")
 
 		fmt.Println("setup\t<numClients : int>")
-		fmt.Println("Setup a number of clients in a network, that will connect to each other randomly\n")
+		fmt.Print("Setup a number of clients in a network, that will connect to each other randomly\n\n")
 
 		fmt.Println("trans\t<network : int> <from index : int> <to index : int> <amount : int>")
-		fmt.Println("Makes a transaction between two clients. Use \"list\" to see all clients in the network alongside their index\n")
+		fmt.Print("Makes a transaction between two clients. Use \"list\" to see all clients in the network alongside their index\n\n")
 
 		fmt.Println("calc")
-		fmt.Println("Calculates the average Val for a 90% threshold. This is used to calculate an estimated hardness\n")
+		fmt.Print("Calculates the average Val for a 90% threshold. This is used to calculate an estimated hardness\n\n")
 
 		fmt.Println("start\t<network : int>")
-		fmt.Println("Begins running the lottery for a network of clients. Do not call this function more than once per network\n")
+		fmt.Print("Begins running the lottery for a network of clients. Do not call this function more than once per network\n\n")
 
 		fmt.Println("status")
-		fmt.Println("Goes through each network and prints the ledger for each client, alongside how many ledgers match\n")
+		fmt.Print("Goes through each network and prints the ledger for each client, alongside how many ledgers match\n\n")
 
 		fmt.Println("list | ls\t")
-		fmt.Println("Lists all the peers in each network\n")
+		fmt.Print("Lists all the peers in each network\n\n")
 
 		fmt.Println("benchmark | bm\t<network : int>")
-		fmt.Println("Runs a benchmark on a network, where 1000 transactions are sent randomly between all peers. This will display the time it takse for all the transactions to arrive\n")
+		fmt.Print("Runs a benchmark on a network, where 1000 transactions are sent randomly between all peers. This will display the time it takse for all the transactions to arrive\n\n")
+
+		fmt.Println("metrics\t")
+		fmt.Print("Prints the metrics of every client, and the results of the last benchmark, in the Prometheus text format\n\n")
 
 		fmt.Println("keys\t")
-		fmt.Println("Lists all the king keys for each network\n")
+		fmt.Print("Lists all the king keys for each network\n\n")
+
+		fmt.Println("leave\t<network : int> <client : int>")
+		fmt.Print("Makes a client leave the network. The other peers will reconnect around it, and eventually forget it\n\n")
+
+		fmt.Println("bans\t<network : int> <client : int>")
+		fmt.Print("Lists the score of each connection of a client, and the peers it has banned\n\n")
+
+		fmt.Println("queues\t<network : int> <client : int>")
+		fmt.Print("Shows the outgoing message queue of each connection of a client\n\n")
+
+		fmt.Println("rpc\t<network : int> <client : int> <address : string>")
+		fmt.Print("Serves JSON-RPC for a client on the address, for instance :8080. The methods are getBalance, getBlock, getHead, submitTransaction, listPeers, getMempool, getTransactionProof and getBalanceProof. New blocks, transactions and peers are streamed as server-sent events from /events, metrics are served in the Prometheus text format from /metrics, and a block explorer from /explorer/\n\n")
+
+		fmt.Println("unban\t<network : int> <client : int>")
+		fmt.Print("Clears all the bans of a client\n\n")
+
+		fmt.Println("topology\t<network : int> <ring|random|kademlia|mesh>")
+		fmt.Print("Changes how the clients in a network connect to each other. Clients drop the connections which don't fit the new topology\n\n")
+
+		fmt.Println("secure\t<on|off|required>")
+		fmt.Print("Turns encryption of new connections on or off. Connections are only encrypted if both peers have it turned on. When it is required, peers which don't support it are refused\n\n")
+
+		fmt.Println("partition\t<network : int> <group : [int,int,...]> <group : [int,int,...]> ...")
+		fmt.Print("Splits the clients of a network into groups, which can't send messages to each other. Clients which aren't in a group form one together\n\n")
+
+		fmt.Println("heal\t<network : int>")
+		fmt.Print("Removes the partition of a network. The clients fetch the blocks they have missed, and \"status\" shows if their ledgers have converged\n\n")
+
+		fmt.Println("history\t<network : int> <client : int | pk : string> [from height : int] [to height : int]")
+		fmt.Print("Shows the transactions and block rewards which changed the balance of an account on the longest chain, and the balance at the end of the range\n\n")
+
+		fmt.Println("balance\t<network : int> <client : int> [account : int | pk : string]")
+		fmt.Print("Shows the balance of an account at the head of the client, by default its own. A light client asks a full node for a proof of it, and checks it against its headers\n\n")
+
+		fmt.Println("proof\t<network : int> <client : int> <transaction : string>")
+		fmt.Print("Shows which block on the longest chain has the transaction. A light client asks a full node for a proof of it, and checks it against its headers\n\n")
+
+		fmt.Println("trace\t[id : string]")
+		fmt.Print("Shows how a transaction or block spread through a network: who each client got it from, after how long, and how many duplicates it got. The trace ID of a transaction is its ID, and that of a block is the start of its signature. Without an ID, the recent trace IDs are listed\n\n")
+
+		fmt.Println("snapshot\texport <network : int> <client : int> <file : string> | snapshot import <file : string> <ip : string>")
+		fmt.Print("Exports the balances after the block " + strconv.Itoa(FINALITY_DEPTH) + " blocks below the head of a client, with the headers up to it, or starts a new client from such a file, which joins the network of the peer at the IP and only fetches the newer blocks\n\n")
+
+		fmt.Println("chain\texport <network : int> <client : int> <file : string> | chain import <file : string> <ip : string>")
+		fmt.Print("Writes the genesis block, transactions and blocks of a client, forks included, to a file, or starts a new client from such a file after checking every block in it. The client joins the network of the peer at the IP, or starts a new network if there is none\n\n")
+
+		fmt.Println("log\t[debug|info|warn|error|off] [subsystem : string] | log format <text|json>")
+		fmt.Print("Sets the log level of a subsystem, or of all of them. The subsystems are " + strings.Join(LOG_SUBSYSTEMS, ", ") + ". Without arguments, the current levels are shown\n\n")
+
+		fmt.Println("faults\t<network : int> <off | [drop=0.1] [duplicate=0.1] [reorder=0.1] [corrupt=0.01] [delay=50ms] [jitter=20ms]>")
+		fmt.Print("Injects faults into the messages the clients of a network send. The chances are per message\n\n")
+
+		fmt.Println("simulate | sim\t<clients : int> <slots : int> <seed : int> [latency=50ms] [jitter=20ms] [loss=0.01] [win=0.1] [transactions=2] [topology=ring] [partition=100-200]")
+		fmt.Print("Simulates a network in memory with a virtual clock. The same arguments always give the same result. The partition splits the clients in two halves for the slots in the range\n\n")
 
 		fmt.Println("help\t")
-		fmt.Println("Lists this list of commands\n")
+		fmt.Print("Lists this list of commands\n\n")
 
 		fmt.Println("quit")
 		fmt.Println("Exits the program")
@@ -451,9 +703,9 @@ func handleCommand(text string) {
 			if len(cs) > 0 {
 				index := int(math.Floor(rand.Float64() * float64(len(cs))))
 				prevClient := cs[index]
-				client = createClient(prevClient.ownPeer.Address)
+				client = createClient(prevClient.ownPeer.Address, false)
 			} else {
-				client = createClient("")
+				client = createClient("", false)
 			}
 
 			cs = append(cs, client)
@@ -478,6 +730,442 @@ func handleCommand(text string) {
 		handleCommand("trans 0 0 1 -69") // Invalid
 		handleCommand("trans 0 0 1 10000000")
 		handleCommand("start 0")
+	} else if cmCheck("leave", 2) {
+		network, clientIndex := parseClientIndex(params[0], params[1])
+
+		if network == nil {
+			return
+		}
+
+		network.RemoveClient(clientIndex)
+		fmt.Println("Client", clientIndex, "has left the network")
+
+	} else if cmCheck("bans", 2) {
+		network, clientIndex := parseClientIndex(params[0], params[1])
+
+		if network == nil {
+			return
+		}
+
+		client := network.Clients[clientIndex]
+
+		fmt.Println("Scores of the current connections:")
+		for _, pc := range client.getConnections() {
+			fmt.Println(pc.remote.ListenAddress, "has a score of", client.reputation.Score(pc))
+		}
+
+		bans := client.reputation.Bans()
+		fmt.Println("There are", len(bans), "banned peer(s)")
+		for _, ban := range bans {
+			fmt.Println(ban.Address, "is banned until", ban.Until.Format(time.Stamp)+":", ban.Reason, "Key:", ban.Pk[0:50]+"...")
+		}
+
+	} else if cmCheck("queues", 2) {
+		network, clientIndex := parseClientIndex(params[0], params[1])
+
+		if network == nil {
+			return
+		}
+
+		for _, pc := range network.Clients[clientIndex].getConnections() {
+			queue := pc.queue
+			fmt.Println(pc.remote.ListenAddress, "has", queue.Depth(), "/", queue.Capacity(), "queued message(s).", queue.Sent(), "sent and", queue.Dropped(), "dropped")
+		}
+
+	} else if cmCheck("rpc", 3) {
+		network, clientIndex := parseClientIndex(params[0], params[1])
+
+		if network == nil {
+			return
+		}
+
+		client := network.Clients[clientIndex]
+		if client.rpc != nil {
+			fmt.Println("The client is already serving JSON-RPC")
+			return
+		}
+
+		rpc := NewRPCServer(client)
+		if err := rpc.Start(params[2]); err != nil {
+			fmt.Println("Unable to start the JSON-RPC server:", err.Error())
+			return
+		}
+		client.rpc = rpc
+
+	} else if cmCheck("unban", 2) {
+		network, clientIndex := parseClientIndex(params[0], params[1])
+
+		if network == nil {
+			return
+		}
+
+		count := network.Clients[clientIndex].reputation.ClearBans()
+		fmt.Println("Cleared", count, "ban(s)")
+
+	} else if cmCheck("topology", 2) {
+		index, err := strconv.Atoi(params[0])
+
+		checkError(err, "Invalid index")
+
+		if gotError {
+			return
+		}
+
+		checkRange(index, len(networks))
+
+		if gotError {
+			return
+		}
+
+		topology := GetTopology(params[1])
+		if topology == nil {
+			fmt.Println("Unknown topology. Expected one of:", strings.Join(TopologyNames(), ", "))
+			return
+		}
+
+		networks[index].SetTopology(topology)
+		fmt.Println("Network", index, "now uses the", topology.Name(), "topology")
+
+	} else if cmCheck("secure", 1) {
+		setting, ok := parseSecureSetting(strings.ToLower(params[0]))
+		if !ok {
+			fmt.Println("Expected \"on\", \"off\" or \"required\"")
+			return
+		}
+		SECURE_TRANSPORT.Store(setting)
+
+		switch setting {
+		case SECURE_ON:
+			fmt.Println("New connections will be encrypted when the peer supports it")
+		case SECURE_OFF:
+			fmt.Println("New connections will not be encrypted")
+		case SECURE_REQUIRED:
+			fmt.Println("New connections will be encrypted, and peers which don't support it are refused")
+		}
+	} else if cmCheckMin("history", 2) {
+		index, err := strconv.Atoi(params[0])
+
+		checkError(err, "Invalid index")
+
+		if gotError {
+			return
+		}
+
+		checkRange(index, len(networks))
+
+		if gotError {
+			return
+		}
+
+		network := networks[index]
+		if len(network.Clients) == 0 {
+			fmt.Println("The network has no clients")
+			return
+		}
+
+		// The account is either a client in the network, whose own state is used, or a public key
+		client := network.Clients[0]
+		account := params[1]
+		if clientIndex, err := strconv.Atoi(params[1]); err == nil {
+			checkRange(clientIndex, len(network.Clients))
+
+			if gotError {
+				return
+			}
+
+			client = network.Clients[clientIndex]
+			account = client.ownPeer.Pk
+		} else if !isValidKeyString(account) {
+			fmt.Println("Expected a client index or a public key")
+			return
+		}
+
+		from, to := 0, -1
+		if len(params) > 2 {
+			from, err = strconv.Atoi(params[2])
+			checkError(err, "Invalid height")
+		}
+		if len(params) > 3 {
+			to, err = strconv.Atoi(params[3])
+			checkError(err, "Invalid height")
+		}
+
+		if gotError {
+			return
+		}
+
+		printHistory(client, account, from, to)
+	} else if cmCheckMin("balance", 2) {
+		network, clientIndex := parseClientIndex(params[0], params[1])
+
+		if network == nil {
+			return
+		}
+
+		client := network.Clients[clientIndex]
+		account, name := client.ownPeer.Pk, client.ownPeer.Address
+		if len(params) > 2 {
+			if accountIndex, err := strconv.Atoi(params[2]); err == nil {
+				checkRange(accountIndex, len(network.Clients))
+
+				if gotError {
+					return
+				}
+
+				account, name = network.Clients[accountIndex].ownPeer.Pk, network.Clients[accountIndex].ownPeer.Address
+			} else if isValidKeyString(params[2]) {
+				account, name = params[2], shortHash(params[2])
+			} else {
+				fmt.Println("Expected a client index or a public key")
+				return
+			}
+		}
+
+		printBalance(client, account, name)
+	} else if cmCheck("proof", 3) {
+		network, clientIndex := parseClientIndex(params[0], params[1])
+
+		if network == nil {
+			return
+		}
+
+		printTransactionProof(network.Clients[clientIndex], params[2])
+	} else if cmCheckMin("trace", 0) {
+		if len(params) == 0 {
+			for networkIndex, network := range networks {
+				ids := network.TraceIDs()
+				if len(ids) > 10 {
+					ids = ids[len(ids)-10:]
+				}
+
+				fmt.Println("Network", networkIndex, "recently traced:", strings.Join(ids, " "))
+			}
+			return
+		}
+
+		found := false
+		for networkIndex, network := range networks {
+			trace, err := network.Trace(params[0])
+			if err == errTraceNotSeen {
+				continue
+			} else if err != nil {
+				fmt.Println("Network", networkIndex, "has", err.Error())
+				found = true
+				continue
+			}
+
+			fmt.Println("Network", networkIndex)
+			trace.Print()
+			found = true
+		}
+
+		if !found {
+			fmt.Println("No client has seen", params[0]+". Use \"trace\" to list the recent trace IDs")
+		}
+	} else if cmCheckMin("log", 0) {
+		var err error
+		switch {
+		case len(params) == 0:
+		case len(params) == 2 && strings.ToLower(params[0]) == "format":
+			err = setLogFormat(strings.ToLower(params[1]))
+		case len(params) <= 2:
+			var level LogLevel
+			level, err = parseLogLevel(params[0])
+			if err == nil {
+				subsystem := "all"
+				if len(params) == 2 {
+					subsystem = strings.ToLower(params[1])
+				}
+				err = setLogLevel(subsystem, level)
+			}
+		default:
+			fmt.Println("Expected \"log <level> [subsystem]\" or \"log format <text|json>\"")
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		fmt.Println("Logging", describeLogLevels())
+	} else if cmCheckMin("snapshot", 1) {
+		switch {
+		case len(params) == 4 && params[0] == "export":
+			network, clientIndex := parseClientIndex(params[1], params[2])
+
+			if network == nil {
+				return
+			}
+
+			snapshot, err := network.Clients[clientIndex].exportSnapshot()
+			if err == nil {
+				err = saveSnapshot(snapshot, params[3])
+			}
+
+			if err != nil {
+				fmt.Println("Unable to export a snapshot:", err.Error())
+				return
+			}
+
+			block := snapshot.block()
+			fmt.Println("Wrote a snapshot at height", len(snapshot.Headers), "slot", block.ID, "block", shortHash(block.Signature), "with", len(snapshot.Balances), "balances to", params[3])
+
+		case len(params) == 3 && params[0] == "import":
+			snapshot, err := loadSnapshot(params[1])
+			if err != nil {
+				fmt.Println("Unable to read the snapshot:", err.Error())
+				return
+			}
+
+			ip := params[2]
+			if onlyPort.MatchString(ip) {
+				ip = getOwnAddress() + ip
+			}
+
+			if _, err := createClientFromSnapshot(ip, snapshot); err != nil {
+				fmt.Println("Unable to import the snapshot:", err.Error())
+				return
+			}
+
+			fmt.Println("Started a client from the snapshot at height", len(snapshot.Headers))
+
+		default:
+			fmt.Println("Expected \"snapshot export <network> <client> <file>\" or \"snapshot import <file> <ip>\"")
+		}
+	} else if cmCheckMin("chain", 1) {
+		switch {
+		case len(params) == 4 && params[0] == "export":
+			network, clientIndex := parseClientIndex(params[1], params[2])
+
+			if network == nil {
+				return
+			}
+
+			chain, err := network.Clients[clientIndex].exportChain()
+			if err == nil {
+				err = saveChain(chain, params[3])
+			}
+
+			if err != nil {
+				fmt.Println("Unable to export the chain:", err.Error())
+				return
+			}
+
+			blocks, transactions := chain.count()
+			fmt.Println("Wrote", blocks, "blocks and", transactions, "transactions to", params[3])
+
+		case len(params) == 3 && params[0] == "import":
+			chain, err := loadChain(params[1])
+			if err != nil {
+				fmt.Println("Unable to read the chain:", err.Error())
+				return
+			}
+
+			ip := params[2]
+			if onlyPort.MatchString(ip) {
+				ip = getOwnAddress() + ip
+			}
+
+			client, err := createClientFromChain(ip, chain)
+			if err != nil {
+				fmt.Println("Unable to import the chain:", err.Error())
+				return
+			}
+
+			blocks, transactions := chain.count()
+			client.lock.Lock()
+			height := client.chainHeight(client.getLongestBlock(MAX_INT))
+			client.lock.Unlock()
+
+			fmt.Println("Started a client with", blocks, "blocks and", transactions, "transactions, and a longest chain of height", height)
+
+		default:
+			fmt.Println("Expected \"chain export <network> <client> <file>\" or \"chain import <file> <ip>\"")
+		}
+	} else if cmCheckMin("simulate sim", 3) {
+		config, err := parseSimConfig(params)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		sim, err := NewSimulator(config)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		fmt.Println("Generating keys and running the simulation")
+		sim.Run().Print()
+
+	} else if cmCheckMin("partition", 3) {
+		index, err := strconv.Atoi(params[0])
+
+		checkError(err, "Invalid index")
+
+		if gotError {
+			return
+		}
+
+		checkRange(index, len(networks))
+
+		if gotError {
+			return
+		}
+
+		network := networks[index]
+		groups, err := parsePartitionGroups(params[1:], len(network.Clients))
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		network.Partition(groups)
+		fmt.Println("Network", index, "is split into", len(groups), "groups")
+
+	} else if cmCheck("heal", 1) {
+		index, err := strconv.Atoi(params[0])
+
+		checkError(err, "Invalid index")
+
+		if gotError {
+			return
+		}
+
+		checkRange(index, len(networks))
+
+		if gotError {
+			return
+		}
+
+		networks[index].Heal()
+		fmt.Println("Network", index, "is no longer partitioned")
+
+	} else if cmCheckMin("faults", 2) {
+		index, err := strconv.Atoi(params[0])
+
+		checkError(err, "Invalid index")
+
+		if gotError {
+			return
+		}
+
+		checkRange(index, len(networks))
+
+		if gotError {
+			return
+		}
+
+		config, err := parseFaultConfig(params[1:])
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		networks[index].SetFaults(config)
+		fmt.Printf("Network %d now has the faults %+v\n", index, config)
+
 	} else if cmCheck("quit", 0) {
 		fmt.Println("Thanks for playing")
 		terminate = true
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// Blocks commit to their transactions with a Merkle root in the header, so the signature only covers
+// the header, and a transaction can be proven to be in a block with a path of hashes, without the rest
+// of the block. The leaves are the hashes of the transactions, in the order of the body. Leaves and
+// nodes are hashed with different prefixes, so a node can't pass for a leaf, and a node without a
+// sibling is moved up a level as it is, instead of being paired with itself.
+
+var MERKLE_LEAF_PREFIX = []byte{0}
+var MERKLE_NODE_PREFIX = []byte{1}
+
+// Returns a hash of everything in the transaction, including the signature
+func (t *SignedTransaction) Hash() []byte {
+	sha := sha256.New()
+	sha.Write(GenerateMessageFromTransaction(t))
+	sha.Write([]byte("|" + t.Signature))
+
+	return sha.Sum(nil)
+}
+
+func merkleLeaf(hash []byte) []byte {
+	sha := sha256.New()
+	sha.Write(MERKLE_LEAF_PREFIX)
+	sha.Write(hash)
+
+	return sha.Sum(nil)
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	sha := sha256.New()
+	sha.Write(MERKLE_NODE_PREFIX)
+	sha.Write(left)
+	sha.Write(right)
+
+	return sha.Sum(nil)
+}
+
+// Returns the root over the hashes of the transactions, as hex. The root of no transactions is the hash of nothing
+func merkleRoot(hashes [][]byte) string {
+	if len(hashes) == 0 {
+		empty := sha256.Sum256(nil)
+		return hex.EncodeToString(empty[:])
+	}
+
+	level := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		level[i] = merkleLeaf(hash)
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+		level = next
+	}
+
+	return hex.EncodeToString(level[0])
+}
+
+// One hash on the path from a leaf to the root
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // True if the hash is the left child, and the path so far the right one
+}
+
+// Proves that a transaction is in the body of a block, given only the block's header
+type MerkleProof struct {
+	Block       string       `json:"block"` // The signature of the block
+	Transaction string       `json:"transaction"`
+	Index       int          `json:"index"` // The position of the transaction in the body
+	Path        []MerkleStep `json:"path"`
+}
+
+// Returns the path from the leaf at the index to the root
+func merklePath(hashes [][]byte, index int) []MerkleStep {
+	level := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		level[i] = merkleLeaf(hash)
+	}
+
+	var path []MerkleStep
+	for len(level) > 1 {
+		if index%2 == 1 {
+			path = append(path, MerkleStep{hex.EncodeToString(level[index-1]), true})
+		} else if index+1 < len(level) {
+			path = append(path, MerkleStep{hex.EncodeToString(level[index+1]), false})
+		}
+
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			}
+		}
+
+		level = next
+		index /= 2
+	}
+
+	return path
+}
+
+// Returns the root the path leads to from the transaction
+func (p MerkleProof) root(transaction SignedTransaction) (string, error) {
+	node := merkleLeaf(transaction.Hash())
+
+	for _, step := range p.Path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil || len(sibling) != sha256.Size {
+			return "", errors.New("malformed hash in the proof")
+		}
+
+		if step.Left {
+			node = merkleNode(sibling, node)
+		} else {
+			node = merkleNode(node, sibling)
+		}
+	}
+
+	return hex.EncodeToString(node), nil
+}
+
+// Checks that the transaction is in the block with the header, and that the header is signed by its sender
+func VerifyTransactionProof(header BlockHeader, transaction SignedTransaction, proof MerkleProof) error {
+	if proof.Transaction != transaction.ID || proof.Block != header.Signature {
+		return errors.New("the proof is for another transaction or block")
+	}
+
+	if !header.isValid() {
+		return errors.New("the header isn't signed by its sender")
+	}
+
+	root, err := proof.root(transaction)
+	if err != nil {
+		return err
+	}
+
+	if root != header.TxRoot {
+		return errors.New("the transaction isn't in the block")
+	}
+
+	return nil
+}
+
+// Returns the hashes of the transactions, or false if this client doesn't have all of them
+func (s *State) transactionHashes(ids []string) ([][]byte, bool) {
+	hashes := make([][]byte, len(ids))
+	for i, id := range ids {
+		transaction, ok := s.transactionsByID[id]
+		if !ok {
+			return nil, false
+		}
+
+		hashes[i] = transaction.Hash()
+	}
+
+	return hashes, true
+}
+
+// Returns the Merkle root of the transactions, or false if this client doesn't have all of them
+func (s *State) txRoot(ids []string) (string, bool) {
+	hashes, ok := s.transactionHashes(ids)
+	if !ok {
+		return "", false
+	}
+
+	return merkleRoot(hashes), true
+}
+
+// Returns false if the client has all the transactions of the block, and they don't match its root
+func (s *State) bodyMatchesRoot(block *Block) bool {
+	root, ok := s.txRoot(block.Transactions)
+
+	return !ok || root == block.TxRoot
+}
+
+// Returns a proof that the transaction is in the block
+func (s *State) transactionProof(signature string, id string) (MerkleProof, error) {
+	block := s.getBlockBySignature(signature)
+	if block == nil {
+		return MerkleProof{}, errors.New("no block with that signature")
+	}
+
+	index := -1
+	for i, other := range block.Transactions {
+		if other == id {
+			index = i
+			break
+		}
+	}
+
+	if index == -1 {
+		return MerkleProof{}, errors.New("the transaction isn't in the block")
+	}
+
+	hashes, ok := s.transactionHashes(block.Transactions)
+	if !ok {
+		return MerkleProof{}, errors.New("some of the transactions of the block are missing")
+	}
+
+	return MerkleProof{Block: signature, Transaction: id, Index: index, Path: merklePath(hashes, index)}, nil
+}
+
+// Params: {"block": signature, "transaction": id}. Returns the transaction, the header of the block and the proof
+func (rpc *RPCServer) getTransactionProof(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Block       string `json:"block"`
+		Transaction string `json:"transaction"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	c := rpc.client
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	proof, err := c.transactionProof(p.Block, p.Transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	block := c.getBlockBySignature(p.Block)
+
+	return map[string]interface{}{
+		"transaction": transactionToJSON(c.transactionsByID[p.Transaction]),
+		"header":      headerToJSON(&block.BlockHeader),
+		"proof":       proof,
+	}, nil
+}
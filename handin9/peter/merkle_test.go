@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"testing"
+)
+
+func TestTransactionHashCoversAmount(t *testing.T) {
+	keys := newTestKeys(2)
+
+	// string(rune) turned every amount which isn't a valid rune into the same character
+	seen := make(map[string]int)
+	for _, amount := range []int{1, 2, 0xD800, 0xDFFF, 0x110000, 0x110001, -1} {
+		transaction := SignedTransaction{ID: "t", From: keys[0].Pk.toString(), To: keys[1].Pk.toString(), Amount: amount}
+		message := string(GenerateMessageFromTransaction(&transaction))
+
+		if other, ok := seen[message]; ok {
+			t.Errorf("the amounts %d and %d give the same message", other, amount)
+		}
+		seen[message] = amount
+	}
+
+	// Moving digits from the ID to the amount mustn't give the same message
+	first := SignedTransaction{ID: "t1", From: "1:3", To: "2:3", Amount: 23}
+	second := SignedTransaction{ID: "t12", From: "1:3", To: "2:3", Amount: 3}
+	if bytes.Equal(GenerateMessageFromTransaction(&first), GenerateMessageFromTransaction(&second)) {
+		t.Error("the ID and the amount run into each other")
+	}
+}
+
+func TestHeaderMessageSeparatesFields(t *testing.T) {
+	// Moving digits from the slot to the previous block mustn't give the same message
+	first := BlockHeader{ID: 1, PreviousBlock: "23", Sender: "1:3", TxRoot: "ab", StateRoot: "cd"}
+	second := BlockHeader{ID: 12, PreviousBlock: "3", Sender: "1:3", TxRoot: "ab", StateRoot: "cd"}
+	if bytes.Equal(GenerateMessageFromHeader(&first), GenerateMessageFromHeader(&second)) {
+		t.Error("the slot and the previous block run into each other")
+	}
+
+	// Or from the transaction root to the state root
+	third := BlockHeader{ID: 1, PreviousBlock: "23", Sender: "1:3", TxRoot: "abc", StateRoot: "d"}
+	if bytes.Equal(GenerateMessageFromHeader(&first), GenerateMessageFromHeader(&third)) {
+		t.Error("the roots run into each other")
+	}
+}
+
+func testHashes(n int) [][]byte {
+	var hashes [][]byte
+	for i := 0; i < n; i++ {
+		transaction := SignedTransaction{ID: strconv.Itoa(i), From: "1:3", To: "2:3", Amount: i + 1}
+		hashes = append(hashes, transaction.Hash())
+	}
+
+	return hashes
+}
+
+func TestMerkleRoot(t *testing.T) {
+	hashes := testHashes(3)
+
+	// Three leaves: the first two are paired, and the third is moved up as it is
+	expected := merkleNode(merkleNode(merkleLeaf(hashes[0]), merkleLeaf(hashes[1])), merkleLeaf(hashes[2]))
+	if root := merkleRoot(hashes); root != hex.EncodeToString(expected) {
+		t.Errorf("got the root %s, expected %s", root, hex.EncodeToString(expected))
+	}
+
+	if merkleRoot(hashes[:1]) != hex.EncodeToString(merkleLeaf(hashes[0])) {
+		t.Error("the root of one transaction isn't its leaf")
+	}
+
+	if merkleRoot(nil) == merkleRoot(hashes[:1]) {
+		t.Error("no transactions have the same root as one")
+	}
+
+	// A node can't pass for a leaf, so a block with the two children of a node doesn't have its root
+	swapped := [][]byte{hashes[1], hashes[0], hashes[2]}
+	if merkleRoot(swapped) == merkleRoot(hashes) {
+		t.Error("the order of the transactions doesn't change the root")
+	}
+}
+
+func TestMerklePathLeadsToRoot(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		hashes := testHashes(n)
+		root := merkleRoot(hashes)
+
+		for index := 0; index < n; index++ {
+			proof := MerkleProof{Index: index, Path: merklePath(hashes, index)}
+			transaction := SignedTransaction{ID: strconv.Itoa(index), From: "1:3", To: "2:3", Amount: index + 1}
+
+			if got, err := proof.root(transaction); err != nil || got != root {
+				t.Errorf("%d transactions: the path of transaction %d leads to %s, expected %s", n, index, got, root)
+			}
+		}
+	}
+}
+
+func TestVerifyTransactionProof(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestState(t, keys)
+	s.currentBlockID = 10
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		transaction := signTestTransaction("t"+strconv.Itoa(i), keys[0], keys[1], 10+i)
+		s.applyTransaction(transaction)
+		ids = append(ids, transaction.ID)
+	}
+
+	block := signTestBlock(s, 1, s.genesisBlock.Block, keys[0], ids)
+	if verdict := s.applyBlock(block); verdict != VERDICT_USEFUL {
+		t.Fatalf("got verdict %d for the block", verdict)
+	}
+
+	proof, err := s.transactionProof(block.Signature, "t3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction := s.transactionsByID["t3"]
+	if err := VerifyTransactionProof(block.BlockHeader, transaction, proof); err != nil {
+		t.Fatalf("a valid proof was rejected: %v", err)
+	}
+
+	changed := transaction
+	changed.Amount++
+	if VerifyTransactionProof(block.BlockHeader, changed, proof) == nil {
+		t.Error("accepted a proof for a transaction with another amount")
+	}
+
+	other := s.transactionsByID["t2"]
+	if VerifyTransactionProof(block.BlockHeader, other, proof) == nil {
+		t.Error("accepted a proof for another transaction")
+	}
+
+	forged := proof
+	forged.Path = append([]MerkleStep{}, proof.Path...)
+	forged.Path[0].Left = !forged.Path[0].Left
+	if VerifyTransactionProof(block.BlockHeader, transaction, forged) == nil {
+		t.Error("accepted a proof with a changed path")
+	}
+
+	unsigned := block.BlockHeader
+	unsigned.Signature = Sign([]byte("something else"), keys[0].Sk).String()
+	proof.Block = unsigned.Signature
+	if VerifyTransactionProof(unsigned, transaction, proof) == nil {
+		t.Error("accepted a proof against a header which isn't signed by its sender")
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A registry of counters, gauges and histograms, which is written in the Prometheus text format.
+// There is one registry for the whole process, and every series of a client has a client label,
+// so a process running a whole Network can be scraped through any of its clients.
+type Registry struct {
+	lock       sync.Mutex
+	families   map[string]*metricFamily
+	collectors map[string]func() // Run right before the metrics are written, to update gauges
+}
+
+type metricFamily struct {
+	kind    string // counter, gauge or histogram
+	help    string
+	buckets []float64
+	series  map[string]*metricSeries // By the formatted labels
+}
+
+type metricSeries struct {
+	labels  []string // Name, value pairs
+	value   float64  // The value of a counter or gauge, or the sum of a histogram
+	count   uint64
+	buckets []uint64 // How many observations were at most the bucket's bound, for histograms
+}
+
+// Buckets for latencies in seconds, from 10µs to 10s
+var LATENCY_BUCKETS = []float64{0.00001, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+var metrics = newDefaultRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*metricFamily), collectors: make(map[string]func())}
+}
+
+func newDefaultRegistry() *Registry {
+	r := NewRegistry()
+
+	r.Describe("peer_connections", "gauge", "The number of open connections to peers")
+	r.Describe("messages_received_total", "counter", "Messages received from peers, by type")
+	r.Describe("messages_sent_total", "counter", "Messages sent to peers, by type")
+	r.Describe("invalid_transactions_total", "counter", "Transactions which were rejected as invalid")
+	r.Describe("invalid_blocks_total", "counter", "Blocks which were rejected as invalid")
+	r.Describe("mempool_size", "gauge", "Received transactions which aren't in any block yet")
+	r.Describe("chain_height", "gauge", "The number of blocks on the longest chain, after the genesis block")
+	r.Describe("chain_forks", "gauge", "The number of chain tips other than the head")
+	r.Describe("reorgs_total", "counter", "Head changes where the new head doesn't descend from the old one")
+	r.DescribeHistogram("reorg_depth", "How many blocks were abandoned by each reorg", []float64{1, 2, 3, 5, 10, 20, 50})
+	r.Describe("lottery_slots_total", "counter", "Slots the client has taken part in the lottery for")
+	r.Describe("lottery_wins_total", "counter", "Slots the client has won. Divide by lottery_slots_total for the wins per slot")
+	r.DescribeHistogram("signature_verify_seconds", "How long it takes to verify a signature", LATENCY_BUCKETS)
+	r.Describe("benchmark_transactions", "gauge", "The number of transactions sent by the last benchmark")
+	r.Describe("benchmark_duration_seconds", "gauge", "How long it took the transactions of the last benchmark to reach every client")
+	r.Describe("benchmark_transactions_per_second", "gauge", "The throughput of the last benchmark")
+
+	return r
+}
+
+func (r *Registry) Describe(name string, kind string, help string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.families[name] = &metricFamily{kind: kind, help: help, series: make(map[string]*metricSeries)}
+}
+
+func (r *Registry) DescribeHistogram(name string, help string, buckets []float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.families[name] = &metricFamily{kind: "histogram", help: help, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+// Returns the series with the labels, which are name, value pairs. Has to be called with the lock held
+func (r *Registry) getSeries(name string, labels []string) *metricSeries {
+	family, ok := r.families[name]
+	if !ok {
+		panic("metric " + name + " hasn't been described")
+	}
+
+	key := formatLabels(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{labels: labels, buckets: make([]uint64, len(family.buckets))}
+		family.series[key] = series
+	}
+
+	return series
+}
+
+func (r *Registry) Add(name string, delta float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.getSeries(name, labels).value += delta
+}
+
+func (r *Registry) Inc(name string, labels ...string) {
+	r.Add(name, 1, labels...)
+}
+
+func (r *Registry) Set(name string, value float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.getSeries(name, labels).value = value
+}
+
+func (r *Registry) Observe(name string, value float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	series := r.getSeries(name, labels)
+	series.value += value
+	series.count++
+
+	for i, bound := range r.families[name].buckets {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+}
+
+func (r *Registry) ObserveSince(name string, start time.Time, labels ...string) {
+	r.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// Adds a function which updates gauges right before the metrics are written. A collector with
+// the same key replaces the old one
+func (r *Registry) AddCollector(key string, collect func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.collectors[key] = collect
+}
+
+// Removes the collector with the key, and every series with the label, for instance when a client leaves
+func (r *Registry) Remove(key string, labelName string, labelValue string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.collectors, key)
+
+	for _, family := range r.families {
+		for formatted, series := range family.series {
+			for i := 0; i+1 < len(series.labels); i += 2 {
+				if series.labels[i] == labelName && series.labels[i+1] == labelValue {
+					delete(family.series, formatted)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Writes every metric in the Prometheus text format, sorted by name and labels
+func (r *Registry) WriteText(w io.Writer) {
+	r.lock.Lock()
+	var collectors []func()
+	for _, collect := range r.collectors {
+		collectors = append(collectors, collect)
+	}
+	r.lock.Unlock()
+
+	for _, collect := range collectors {
+		collect()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := r.families[name]
+		if len(family.series) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, family.kind)
+
+		var keys []string
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := family.series[key]
+
+			if family.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", name, key, formatValue(series.value))
+				continue
+			}
+
+			for i, bound := range family.buckets {
+				labels := append(append([]string{}, series.labels...), "le", formatValue(bound))
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labels), series.buckets[i])
+			}
+			labels := append(append([]string{}, series.labels...), "le", "+Inf")
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labels), series.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, key, formatValue(series.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, key, series.count)
+		}
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escaper.Replace(labels[i+1])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (rpc *RPCServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteText(w)
+}
+
+// Registers the gauges of a client, which are updated whenever the metrics are written
+func (c *Client) registerMetrics() {
+	address := c.ownPeer.Address
+
+	metrics.AddCollector(address, func() {
+		metrics.Set("peer_connections", float64(len(c.getConnections())), "client", address)
+
+		c.lock.Lock()
+		if c.genesisBlock == nil {
+			c.lock.Unlock()
+			return
+		}
+		mempool := len(c.pendingTransactions())
+		height := c.chainHeight(c.getLongestBlock(MAX_INT))
+		forks := c.countForks()
+		c.lock.Unlock()
+
+		metrics.Set("mempool_size", float64(mempool), "client", address)
+		metrics.Set("chain_height", float64(height), "client", address)
+		metrics.Set("chain_forks", float64(forks), "client", address)
+	})
+}
+
+// Returns the blocks which have a child, by signature
+func (s *State) blocksWithChildren() map[string]bool {
+	hasChild := make(map[string]bool)
+	for _, block := range s.blocks {
+		hasChild[block.PreviousBlock] = true
+	}
+
+	return hasChild
+}
+
+// Returns the number of chain tips, other than the head
+func (s *State) countForks() int {
+	hasChild := s.blocksWithChildren()
+
+	tips := 0
+	for _, block := range s.blocks {
+		if !hasChild[block.Signature] {
+			tips++
+		}
+	}
+
+	if tips == 0 {
+		return 0
+	}
+
+	return tips - 1
+}
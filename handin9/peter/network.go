@@ -1,9 +1,12 @@
 package main
 
+import "time"
+
 type Network struct {
 	Clients  []*Client
 	KingKeys []KeyPair
 	KeyIndex int
+	Topology Topology // How the clients in the network connect to each other
 }
 
 func (n *Network) Initialize(initClient *Client, ip string) {
@@ -18,6 +21,7 @@ func (n *Network) Initialize(initClient *Client, ip string) {
 	}
 
 	n.KeyIndex = 0
+	n.Topology = RingTopology{}
 
 	// Save the client
 	n.Clients = []*Client{}
@@ -25,10 +29,7 @@ func (n *Network) Initialize(initClient *Client, ip string) {
 	n.AddClient(initClient, ip)
 
 	// Generate genesis block
-	block := &Block{0, "", initClient.ownPeer.Pk, []string{}, "", GenerateDraw(SEED, 0, initClient.sk)}
-	initClient.SignBlock(block)
-	genesisBlock := GenesisBlock{block, publicKingKeys, SEED}
-	initClient.setGenesisBlock(&genesisBlock)
+	initClient.setGenesisBlock(NewGenesisBlock(KeyPair{initClient.pk, initClient.sk}, publicKingKeys, SEED, time.Time{}))
 }
 
 func (n *Network) GetNextKey() KeyPair {
@@ -43,7 +44,60 @@ func (n *Network) GetNextKey() KeyPair {
 
 func (n *Network) AddClient(client *Client, ip string) {
 	n.Clients = append(n.Clients, client)
-	client.Initialize(ip, n.GetNextKey())
+	client.Initialize(ip, n.GetNextKey(), n.Topology)
+}
+
+// Changes the topology of every client in the network
+func (n *Network) SetTopology(topology Topology) {
+	n.Topology = topology
+
+	for _, client := range n.Clients {
+		client.setTopology(topology)
+	}
+}
+
+// Stops a client and removes it from the network
+func (n *Network) RemoveClient(index int) {
+	client := n.Clients[index]
+	n.Clients = append(n.Clients[:index], n.Clients[index+1:]...)
+	client.Stop()
+}
+
+// Splits the clients into groups, which can't reach each other. Clients which aren't in any group
+// form a group of their own
+func (n *Network) Partition(groups [][]int) {
+	groupOf := make(map[int]int)
+	for i := range n.Clients {
+		groupOf[i] = -1
+	}
+	for group, indices := range groups {
+		for _, index := range indices {
+			groupOf[index] = group
+		}
+	}
+
+	for i, client := range n.Clients {
+		var cut []string
+		for j, other := range n.Clients {
+			if groupOf[i] != groupOf[j] {
+				cut = append(cut, other.ownPeer.Pk)
+			}
+		}
+
+		client.faults.SetCut(cut)
+	}
+}
+
+func (n *Network) Heal() {
+	for _, client := range n.Clients {
+		client.faults.SetCut(nil)
+	}
+}
+
+func (n *Network) SetFaults(config FaultConfig) {
+	for _, client := range n.Clients {
+		client.faults.SetConfig(config)
+	}
 }
 
 func (n *Network) ContainsClientWithIP(ip string) bool {
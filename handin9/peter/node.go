@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A node runs exactly one client per process, configured by flags or a JSON file instead of
+// the REPL, so it can run under systemd or in a container without any stdin.
+//
+//	peter node -config node.json
+//	peter node -listen :7000 -bootstrap 10.0.0.2:7000,10.0.0.3:7000 -datadir /var/lib/peter
+//
+// Flags override the values from the config file.
+type NodeConfig struct {
+	Listen    string   `json:"listen"`    // The address to listen on, for instance :7000
+	Advertise string   `json:"advertise"` // The address other peers should dial. Defaults to this machine's IP and the port
+	Bootstrap []string `json:"bootstrap"` // Peers to join the network through, tried in order
+	KeyFile   string   `json:"keyFile"`   // Created if it doesn't exist. Defaults to key.json in the data directory
+	DataDir   string   `json:"dataDir"`
+	Genesis   string   `json:"genesis"`   // The genesis file. Defaults to genesis.json in the data directory, if it exists
+	Snapshot  string   `json:"snapshot"`  // A snapshot to start from, instead of fetching the whole chain
+	RPC       string   `json:"rpc"`       // The address to serve JSON-RPC on, or empty to not serve it
+	Topology  string   `json:"topology"`  // One of the names from TopologyNames
+	Log       string   `json:"log"`       // The log levels, like "info,network=debug"
+	LogFormat string   `json:"logFormat"` // text or json
+	Secure    string   `json:"secure"`    // on, off, or required to refuse peers which don't support encryption
+}
+
+// The key file of a node. The keys are in the same format as in the blocks and transactions
+type KeyFile struct {
+	Pk string `json:"pk"`
+	Sk string `json:"sk"`
+}
+
+func defaultNodeConfig() NodeConfig {
+	return NodeConfig{Listen: ":7000", DataDir: ".", Topology: RingTopology{}.Name(), Log: "info", LogFormat: "text", Secure: "on"}
+}
+
+// Parses the arguments after "node". A config file is read first, and the flags which are set override it
+func parseNodeConfig(args []string) (NodeConfig, error) {
+	config := defaultNodeConfig()
+
+	flags := flag.NewFlagSet("node", flag.ContinueOnError)
+	configFile := flags.String("config", "", "a JSON file with the configuration")
+	listen := flags.String("listen", config.Listen, "the address to listen on")
+	advertise := flags.String("advertise", "", "the address other peers should dial")
+	bootstrap := flags.String("bootstrap", "", "a comma separated list of peers to join the network through")
+	keyFile := flags.String("key", "", "the key file, created if it doesn't exist")
+	dataDir := flags.String("datadir", config.DataDir, "the directory the node keeps its files in")
+	genesis := flags.String("genesis", "", "the genesis file")
+	snapshot := flags.String("snapshot", "", "a snapshot file to start from")
+	rpc := flags.String("rpc", "", "the address to serve JSON-RPC on")
+	topology := flags.String("topology", config.Topology, "one of "+strings.Join(TopologyNames(), ", "))
+	logLevels := flags.String("log", config.Log, "the log levels, like info,network=debug. The subsystems are "+strings.Join(LOG_SUBSYSTEMS, ", "))
+	logFormat := flags.String("log-format", config.LogFormat, "text or json")
+	secure := flags.String("secure", config.Secure, "on, off, or required to refuse peers which don't support encryption")
+
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return config, err
+		}
+
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("invalid config file %s: %w", *configFile, err)
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listen = *listen
+		case "advertise":
+			config.Advertise = *advertise
+		case "bootstrap":
+			config.Bootstrap = strings.Split(*bootstrap, ",")
+		case "key":
+			config.KeyFile = *keyFile
+		case "datadir":
+			config.DataDir = *dataDir
+		case "genesis":
+			config.Genesis = *genesis
+		case "snapshot":
+			config.Snapshot = *snapshot
+		case "rpc":
+			config.RPC = *rpc
+		case "topology":
+			config.Topology = *topology
+		case "log":
+			config.Log = *logLevels
+		case "log-format":
+			config.LogFormat = *logFormat
+		case "secure":
+			config.Secure = *secure
+		}
+	})
+
+	if config.KeyFile == "" {
+		config.KeyFile = filepath.Join(config.DataDir, "key.json")
+	}
+
+	// A node which started a network saved the genesis block in its data directory, so it uses it again on a restart
+	if config.Genesis == "" {
+		if _, err := os.Stat(filepath.Join(config.DataDir, "genesis.json")); err == nil {
+			config.Genesis = filepath.Join(config.DataDir, "genesis.json")
+		}
+	}
+
+	if GetTopology(config.Topology) == nil {
+		return config, errors.New("unknown topology " + config.Topology + ", expected one of " + strings.Join(TopologyNames(), ", "))
+	}
+
+	setting, ok := parseSecureSetting(config.Secure)
+	if !ok {
+		return config, errors.New("unknown secure setting " + config.Secure + ", expected on, off or required")
+	}
+	SECURE_TRANSPORT.Store(setting)
+
+	if err := setLogLevels(config.Log); err != nil {
+		return config, err
+	}
+
+	if err := setLogFormat(config.LogFormat); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// Reads the key pair from the file, or generates one and saves it there if the file doesn't exist
+func loadOrCreateKey(path string) (KeyPair, error) {
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Info(LOG_WALLET, "Generating a new key", "file", path)
+		pair := KeyGen(2000)
+
+		data, err := json.MarshalIndent(KeyFile{pair.Pk.toString(), pair.Sk.toString()}, "", "  ")
+		if err != nil {
+			return pair, err
+		}
+
+		return pair, os.WriteFile(path, data, 0600)
+	} else if err != nil {
+		return KeyPair{}, err
+	}
+
+	var keys KeyFile
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return KeyPair{}, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+
+	if !isValidKeyString(keys.Pk) || !isValidKeyString(keys.Sk) {
+		return KeyPair{}, errors.New("invalid key file " + path + ": malformed key")
+	}
+
+	return KeyPair{GeneratePublicKeyFromString(keys.Pk), GenerateSecretKeyFromString(keys.Sk)}, nil
+}
+
+// Starts a single client from the config, and runs it until the process gets SIGINT or SIGTERM
+func runNode(args []string) error {
+	config, err := parseNodeConfig(args)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return err
+	}
+
+	pair, err := loadOrCreateKey(config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	client := &Client{}
+	client.setup(pair, GetTopology(config.Topology))
+
+	if config.Genesis != "" {
+		genesis, err := loadGenesisBlock(config.Genesis)
+		if err != nil {
+			return err
+		}
+
+		if err := client.setGenesisBlock(genesis); err != nil {
+			return fmt.Errorf("invalid genesis file %s: %w", config.Genesis, err)
+		}
+		client.log.Info(LOG_CONSENSUS, "Loaded genesis block", "genesis", shortHash(genesis.Hash()), "file", config.Genesis)
+	}
+
+	if config.Snapshot != "" {
+		snapshot, err := loadSnapshot(config.Snapshot)
+		if err != nil {
+			return err
+		}
+
+		// The snapshot has the genesis block, so it doesn't need a genesis file
+		if client.getGenesisBlock() == nil {
+			if err := client.setGenesisBlock(&snapshot.Genesis); err != nil {
+				return fmt.Errorf("unable to import %s: %w", config.Snapshot, err)
+			}
+		}
+
+		if err := client.importSnapshot(snapshot); err != nil {
+			return fmt.Errorf("unable to import %s: %w", config.Snapshot, err)
+		}
+
+		block := snapshot.block()
+		client.log.Info(LOG_CONSENSUS, "Started from a snapshot", "height", len(snapshot.Headers), "slot", block.ID, "block", shortHash(block.Signature), "file", config.Snapshot)
+	}
+
+	// Join through the first bootstrap peer which answers
+	joined := false
+	for _, address := range config.Bootstrap {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+
+		if client.getPeerList(address) {
+			joined = true
+			break
+		}
+	}
+
+	if !joined && len(config.Bootstrap) > 0 {
+		client.log.Warn(LOG_NETWORK, "Unable to join through any of the bootstrap peers")
+	}
+
+	// Without a genesis file or a network to join, this node starts a new network with itself as the only king
+	if client.getGenesisBlock() == nil {
+		if len(config.Bootstrap) > 0 {
+			return errors.New("no genesis block: pass a genesis file, or make sure a bootstrap peer is reachable")
+		}
+
+		genesis := NewGenesisBlock(pair, []string{pair.Pk.toString()}, SEED, time.Now().Truncate(time.Second))
+		path := filepath.Join(config.DataDir, "genesis.json")
+		if err := saveGenesisBlock(genesis, path); err != nil {
+			return err
+		}
+
+		if err := client.setGenesisBlock(genesis); err != nil {
+			return err
+		}
+		client.log.Info(LOG_CONSENSUS, "Started a new network", "genesis", shortHash(genesis.Hash()), "file", path)
+	}
+
+	ln, err := client.listen(config.Listen, config.Advertise)
+	if err != nil {
+		return err
+	}
+	client.start(ln)
+
+	if config.RPC != "" {
+		rpc := NewRPCServer(client)
+		if err := rpc.Start(config.RPC); err != nil {
+			client.Stop()
+			return err
+		}
+		client.rpc = rpc
+	}
+
+	client.startBlocks()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	client.log.Info(LOG_NETWORK, "Leaving the network", "signal", sig.String())
+	client.Stop()
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrMessageTooLarge = errors.New("message exceeds the maximum message size")
+var ErrMalformedMessage = errors.New("malformed message") // Wraps the errors which aren't from the connection itself
+var ErrMessageSpansFrames = errors.New("message doesn't end with its frame")
+
+// A PeerConn wraps a net.Conn and owns the single gob encoder/decoder pair
+// used for the lifetime of the connection. Every message is written as one
+// length-prefixed frame, and a message is only read from one frame, so the
+// size of a message is known (and checked) before any of it is decoded.
+type PeerConn struct {
+	conn net.Conn
+
+	enc    *gob.Encoder
+	encBuf bytes.Buffer
+	dec    *gob.Decoder
+	frames *frameReader
+
+	remote     *Hello       // What the other side sent in the handshake, nil until it has completed
+	dialed     string       // The address this side dialed, or empty if the other side dialed
+	sendCipher *frameCipher // Encrypts outgoing frames once a secure channel is set up
+
+	queue *SendQueue    // Messages waiting to be written, once the connection has been added to a client
+	done  chan struct{} // Closed when the connection is closed
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func NewPeerConn(conn net.Conn) *PeerConn {
+	pc := &PeerConn{conn: conn, queue: NewSendQueue(), done: make(chan struct{})}
+	pc.enc = gob.NewEncoder(&pc.encBuf)
+	pc.frames = &frameReader{conn: conn, timeout: READ_TIMEOUT}
+	pc.dec = gob.NewDecoder(pc.frames)
+	return pc
+}
+
+func (pc *PeerConn) RemoteAddr() string {
+	return pc.conn.RemoteAddr().String()
+}
+
+// Changes how long a read may wait for the next frame
+func (pc *PeerConn) SetReadTimeout(timeout time.Duration) {
+	pc.frames.timeout = timeout
+}
+
+// Encodes the message into a single frame and writes it to the connection
+func (pc *PeerConn) WriteMessage(msg Message) error {
+	pc.writeLock.Lock()
+	defer pc.writeLock.Unlock()
+
+	pc.encBuf.Reset()
+	if err := pc.enc.Encode(&msg); err != nil {
+		// The encoder may have sent half a type definition, so the stream can't be trusted anymore
+		pc.Close()
+		return err
+	}
+
+	if pc.encBuf.Len() > MAX_MESSAGE_SIZE {
+		pc.Close()
+		return ErrMessageTooLarge
+	}
+
+	payload := pc.encBuf.Bytes()
+	if pc.sendCipher != nil {
+		payload = pc.sendCipher.seal(payload)
+	}
+
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+
+	pc.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	if _, err := pc.conn.Write(frame); err != nil {
+		pc.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Blocks until the next message has been read from the connection. If the peer sent something which
+// can't be read, like a frame which is too large or can't be decoded, the error wraps ErrMalformedMessage
+func (pc *PeerConn) ReadMessage() (Message, error) {
+	var msg = Message{}
+	pc.frames.connErr = nil
+	pc.frames.nextMessage()
+	err := pc.dec.Decode(&msg)
+
+	if err != nil && pc.frames.connErr == nil {
+		err = fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	return msg, err
+}
+
+func (pc *PeerConn) Close() {
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		pc.conn.Close()
+	})
+}
+
+// frameReader turns the stream of frames back into the continuous byte
+// stream that the gob decoder expects. It implements io.ByteReader, so the
+// decoder never reads ahead of the frame it is currently decoding. Each
+// message may only use one frame, so a message can't grow past the maximum
+// size by going on into the next frame.
+type frameReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	cipher  *frameCipher // Decrypts incoming frames once a secure channel is set up
+	connErr error        // The last error from reading the connection, as opposed to a broken frame
+	frame   []byte
+	pos     int
+	read    bool // A frame has been read for the current message
+}
+
+// Starts a new message. What is left of the current frame counts as the frame of the message
+func (r *frameReader) nextMessage() {
+	r.read = r.pos < len(r.frame)
+}
+
+func (r *frameReader) nextFrame() error {
+	if r.read {
+		return ErrMessageSpansFrames
+	}
+
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+
+	var header [4]byte
+	if _, err := io.ReadFull(r.conn, header[:]); err != nil {
+		r.connErr = err
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > uint32(MAX_MESSAGE_SIZE+FRAME_OVERHEAD) {
+		return ErrMessageTooLarge
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r.conn, frame); err != nil {
+		r.connErr = err
+		return err
+	}
+
+	if r.cipher != nil {
+		var err error
+		frame, err = r.cipher.open(frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.frame = frame
+	r.pos = 0
+	r.read = true
+	return nil
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for r.pos >= len(r.frame) {
+		if err := r.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.frame[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+func (r *frameReader) ReadByte() (byte, error) {
+	for r.pos >= len(r.frame) {
+		if err := r.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	b := r.frame[r.pos]
+	r.pos++
+	return b, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"net"
+	"testing"
+)
+
+// Writes the payload as one length-prefixed frame
+func writeTestFrame(conn net.Conn, payload []byte) error {
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+
+	_, err := conn.Write(frame)
+	return err
+}
+
+func TestReadMessageFromOneFrame(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	pc := NewPeerConn(local)
+	sender := NewPeerConn(remote)
+
+	message := Message{ID: TRANSACTION_MESSAGE, Value: SignedTransaction{ID: "t1", Amount: 5}}
+	go sender.WriteMessage(message)
+
+	received, err := pc.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if transaction, ok := received.Value.(SignedTransaction); !ok || transaction.ID != "t1" {
+		t.Errorf("got %v, expected the transaction", received.Value)
+	}
+}
+
+func TestMessageSpanningFramesIsRejected(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	pc := NewPeerConn(local)
+
+	var payload bytes.Buffer
+	message := Message{ID: TRANSACTION_MESSAGE, Value: SignedTransaction{ID: "t1", Amount: 5}}
+	if err := gob.NewEncoder(&payload).Encode(&message); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message is split over two frames, which each fit the maximum size. The second one is never
+	// read, so its write fails when the pipe is closed
+	half := payload.Len() / 2
+	go func() {
+		if writeTestFrame(remote, payload.Bytes()[:half]) == nil {
+			writeTestFrame(remote, payload.Bytes()[half:])
+		}
+	}()
+
+	if _, err := pc.ReadMessage(); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("got %v, expected a malformed message", err)
+	}
+}
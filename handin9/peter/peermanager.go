@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// The PeerManager keeps a client connected to TARGET_OUTBOUND peers. Dropped connections are
+// redialed with exponential backoff, every connection is kept alive with heartbeats, and peers
+// which can't be reached after MAX_DIAL_FAILURES attempts are evicted and announced as gone.
+type PeerManager struct {
+	client *Client
+
+	lock     sync.Mutex
+	outbound map[string]*PeerConn      // Connections this client dialed, by the peer's listen address
+	backoff  map[string]*backoffStatus // Peers which recently couldn't be reached, by address
+}
+
+type backoffStatus struct {
+	failures    int
+	nextAttempt time.Time
+}
+
+func NewPeerManager(client *Client) *PeerManager {
+	return &PeerManager{
+		client:   client,
+		outbound: make(map[string]*PeerConn),
+		backoff:  make(map[string]*backoffStatus),
+	}
+}
+
+func (pm *PeerManager) run() {
+	maintainTicker := time.NewTicker(PEER_MANAGER_INTERVAL)
+	heartbeatTicker := time.NewTicker(HEARTBEAT_INTERVAL)
+	exchangeTicker := time.NewTicker(PEX_INTERVAL)
+
+	defer maintainTicker.Stop()
+	defer heartbeatTicker.Stop()
+	defer exchangeTicker.Stop()
+
+	for {
+		select {
+		case <-pm.client.stopped:
+			return
+
+		case <-maintainTicker.C:
+			pm.fillSlots()
+
+		case <-heartbeatTicker.C:
+			pm.sendHeartbeats()
+
+		case <-exchangeTicker.C:
+			pm.client.exchangePeers()
+		}
+	}
+}
+
+func (pm *PeerManager) outboundCount() int {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	return len(pm.outbound)
+}
+
+// Dials peers from the known peer list until the target number of outbound connections is reached
+func (pm *PeerManager) fillSlots() {
+	candidates, target := pm.client.candidatePeers()
+
+	for _, peer := range candidates {
+		if pm.outboundCount() >= target {
+			return
+		}
+
+		if pm.shouldDial(peer) {
+			pm.dial(peer)
+		}
+	}
+}
+
+// A peer is skipped if it's already connected, in either direction, or if it's backing off
+func (pm *PeerManager) shouldDial(peer Peer) bool {
+	if pm.client.isConnectedTo(peer.Address) {
+		return false
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	if _, ok := pm.outbound[peer.Address]; ok {
+		return false
+	}
+
+	if status, ok := pm.backoff[peer.Address]; ok && time.Now().Before(status.nextAttempt) {
+		return false
+	}
+
+	return true
+}
+
+func (pm *PeerManager) dial(peer Peer) {
+	conn, err := net.DialTimeout("tcp", peer.Address, HANDSHAKE_TIMEOUT)
+	if err != nil {
+		pm.client.log.Info(LOG_NETWORK, "Unable to connect to peer", "peer", peer.Address)
+		pm.recordFailure(peer)
+		return
+	}
+
+	pc := NewPeerConn(conn)
+	pc.dialed = peer.Address
+	if !pm.client.openConnection(pc) {
+		pm.recordFailure(peer)
+		return
+	}
+
+	pm.lock.Lock()
+	pm.outbound[peer.Address] = pc
+	delete(pm.backoff, peer.Address)
+	pm.lock.Unlock()
+
+	go func() {
+		pm.client.handleConnection(pc)
+		pm.connectionClosed(peer.Address, pc)
+	}()
+}
+
+// Closes the outbound connections to peers which the topology doesn't want any more.
+// The slots are refilled with the preferred peers on the next tick
+func (pm *PeerManager) rebalance() {
+	candidates, target := pm.client.candidatePeers()
+
+	wanted := make(map[string]bool)
+	for i := 0; i < target && i < len(candidates); i++ {
+		wanted[candidates[i].Address] = true
+	}
+
+	pm.lock.Lock()
+	var unwanted []*PeerConn
+	for address, pc := range pm.outbound {
+		if !wanted[address] {
+			unwanted = append(unwanted, pc)
+			delete(pm.outbound, address)
+		}
+	}
+	pm.lock.Unlock()
+
+	for _, pc := range unwanted {
+		pm.client.removeConnection(pc)
+	}
+}
+
+// Frees the slot of an outbound connection, so it can be refilled on the next tick
+func (pm *PeerManager) connectionClosed(address string, pc *PeerConn) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	if pm.outbound[address] == pc {
+		delete(pm.outbound, address)
+	}
+}
+
+func (pm *PeerManager) recordFailure(peer Peer) {
+	pm.lock.Lock()
+
+	status, ok := pm.backoff[peer.Address]
+	if !ok {
+		status = &backoffStatus{}
+		pm.backoff[peer.Address] = status
+	}
+
+	status.failures++
+
+	delay := RECONNECT_BACKOFF << uint(status.failures-1)
+	if delay > MAX_RECONNECT_BACKOFF || delay <= 0 {
+		delay = MAX_RECONNECT_BACKOFF
+	}
+	status.nextAttempt = time.Now().Add(delay)
+
+	evict := status.failures >= MAX_DIAL_FAILURES
+	if evict {
+		delete(pm.backoff, peer.Address)
+	}
+
+	pm.lock.Unlock()
+
+	if evict {
+		pm.client.log.Info(LOG_NETWORK, "Peer is unreachable, removing it from the peer list", "peer", peer.Address)
+		pm.client.peerLeft(peer)
+	}
+}
+
+// Pings every connection. Connections which stay silent for longer than READ_TIMEOUT are closed by their reader
+func (pm *PeerManager) sendHeartbeats() {
+	for _, pc := range pm.client.getConnections() {
+		pm.client.queueMessage(pc, Message{ID: PING_MESSAGE})
+	}
+}
+
+// Removes a peer which has left the network, and tells the rest of the network about it
+func (c *Client) peerLeft(peer Peer) {
+	if !c.removePeer(peer.Address) {
+		return
+	}
+
+	c.broadcast(Message{ID: PEER_LEFT_MESSAGE, Value: peer})
+}
+
+func (c *Client) handlePeerLeft(peer Peer) {
+	// If the peer says that this client left, it's corrected by announcing this client again
+	if peer.Address == c.ownPeer.Address {
+		c.broadcastSelf()
+		return
+	}
+
+	// The peer is still alive from our point of view, so the notice isn't passed on
+	if c.isConnectedTo(peer.Address) {
+		return
+	}
+
+	c.peerLeft(peer)
+}
+
+// Checks if there is an open connection to the peer listening on the address
+func (c *Client) isConnectedTo(address string) bool {
+	for _, pc := range c.getConnections() {
+		if pc.remote != nil && pc.remote.ListenAddress == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Makes the client leave the network. It stops listening, and closes all of its connections,
+// which the other peers will notice and replace
+func (c *Client) Stop() {
+	close(c.stopped)
+	if c.listener != nil {
+		c.listener.Close()
+	}
+
+	if c.rpc != nil {
+		c.rpc.Stop()
+	}
+
+	for _, pc := range c.getConnections() {
+		c.removeConnection(pc)
+	}
+
+	metrics.Remove(c.ownPeer.Address, "client", c.ownPeer.Address)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Peer exchange. Instead of every client keeping the whole network, each client keeps a bounded
+// address book, and asks its connections for a random sample of theirs (GETADDR/ADDR). New clients
+// announce themselves in an ADDR with a single entry, which is relayed to a few random connections.
+
+// A peer, and the last time anyone has seen it alive
+type TimedPeer struct {
+	Peer     Peer
+	LastSeen time.Time
+}
+
+// The value of an ADDR message
+type Addresses struct {
+	Peers []TimedPeer
+}
+
+// Adds a peer to the address book, or refreshes the time it was last seen. Returns true if it's new
+func (s *State) markPeerSeen(peer Peer, seen time.Time) bool {
+	if s.peerSeen == nil {
+		s.peerSeen = make(map[string]time.Time)
+	}
+
+	isNew := s.addPeer(peer)
+
+	if seen.After(s.peerSeen[peer.Address]) {
+		s.peerSeen[peer.Address] = seen
+	}
+
+	return isNew
+}
+
+// Binds the key of the peer to the address of the connection, if this side dialed the address the
+// peer listens on, since the handshake proved that the peer at the address has the key. It replaces
+// the key in the address book, which may have come from an ADDR. Those are never trusted, since
+// anyone can claim any address in them
+func (s *State) bindDialedPeer(pc *PeerConn) {
+	if pc.remote == nil || pc.dialed == "" || pc.dialed != pc.remote.ListenAddress {
+		return
+	}
+
+	if known := s.GetPeerFromIP(pc.dialed); known != nil {
+		known.Pk = pc.remote.Pk
+	}
+
+	s.markPeerSeen(Peer{pc.dialed, pc.remote.Pk}, time.Now())
+
+	if s.boundPeers == nil {
+		s.boundPeers = make(map[string]bool)
+	}
+	s.boundPeers[pc.dialed] = true
+}
+
+// Returns the peer at the address, if its key was proven by dialing it
+func (s *State) getBoundPeer(address string) *Peer {
+	if !s.boundPeers[address] {
+		return nil
+	}
+
+	return s.GetPeerFromIP(address)
+}
+
+// Returns up to n random peers, which have been seen within ADDRESS_MAX_AGE
+func (s *State) samplePeers(n int, now time.Time) []TimedPeer {
+	var fresh []TimedPeer
+	for _, peer := range s.peers {
+		seen := s.peerSeen[peer.Address]
+		if now.Sub(seen) <= ADDRESS_MAX_AGE {
+			fresh = append(fresh, TimedPeer{peer, seen})
+		}
+	}
+
+	s.random.Shuffle(len(fresh), func(i, j int) {
+		fresh[i], fresh[j] = fresh[j], fresh[i]
+	})
+
+	if len(fresh) > n {
+		fresh = fresh[:n]
+	}
+
+	return fresh
+}
+
+// Keeps the address book below ADDRESS_BOOK_SIZE by forgetting the peers which were seen the longest time ago
+func (s *State) trimAddressBook(self string) {
+	excess := len(s.peers) - ADDRESS_BOOK_SIZE
+	if excess <= 0 {
+		return
+	}
+
+	stalest := append([]Peer{}, s.peers...)
+	sort.SliceStable(stalest, func(i, j int) bool {
+		return s.peerSeen[stalest[i].Address].Before(s.peerSeen[stalest[j].Address])
+	})
+
+	for _, peer := range stalest {
+		if excess == 0 {
+			break
+		}
+
+		if peer.Address != self {
+			s.removePeer(peer.Address)
+			delete(s.peerSeen, peer.Address)
+			excess--
+		}
+	}
+}
+
+// Adds the addresses from an ADDR message to the address book. Announcements of a few new peers
+// are relayed to ADDR_RELAY_FANOUT random connections, so they spread without flooding the network
+func (c *Client) handleAddresses(from *PeerConn, addresses Addresses) Verdict {
+	if len(addresses.Peers) > ADDR_SAMPLE_SIZE {
+		return VERDICT_INVALID
+	}
+
+	now := time.Now()
+	var newPeers []TimedPeer
+
+	c.lock.Lock()
+	for _, timed := range addresses.Peers {
+		if timed.Peer.Address == "" || !isValidKeyString(timed.Peer.Pk) {
+			c.lock.Unlock()
+			return VERDICT_INVALID
+		}
+
+		// Nobody can have seen a peer in the future
+		if timed.LastSeen.After(now) {
+			timed.LastSeen = now
+		}
+
+		if now.Sub(timed.LastSeen) > ADDRESS_MAX_AGE {
+			continue
+		}
+
+		if c.markPeerSeen(timed.Peer, timed.LastSeen) {
+			newPeers = append(newPeers, timed)
+		}
+	}
+	c.trimAddressBook(c.ownPeer.Address)
+	c.lock.Unlock()
+
+	if len(newPeers) == 0 {
+		return VERDICT_DUPLICATE
+	}
+
+	if len(addresses.Peers) <= ADDR_RELAY_MAX {
+		relay := Message{ID: ADDR_MESSAGE, Value: Addresses{newPeers}}
+		for _, pc := range c.randomConnections(ADDR_RELAY_FANOUT, from) {
+			c.queueMessage(pc, relay)
+		}
+	}
+
+	return VERDICT_USEFUL
+}
+
+func (c *Client) handleGetAddresses(pc *PeerConn) {
+	c.lock.Lock()
+	c.markPeerSeen(c.ownPeer, time.Now())
+	sample := c.samplePeers(ADDR_SAMPLE_SIZE, time.Now())
+	c.lock.Unlock()
+
+	c.queueMessage(pc, Message{ID: ADDR_MESSAGE, Value: Addresses{sample}})
+}
+
+// Returns up to n random connections, other than the one given
+func (c *Client) randomConnections(n int, except *PeerConn) []*PeerConn {
+	var connections []*PeerConn
+	for _, pc := range c.getConnections() {
+		if pc != except {
+			connections = append(connections, pc)
+		}
+	}
+
+	c.lock.Lock()
+	c.random.Shuffle(len(connections), func(i, j int) {
+		connections[i], connections[j] = connections[j], connections[i]
+	})
+	c.lock.Unlock()
+
+	if len(connections) > n {
+		connections = connections[:n]
+	}
+
+	return connections
+}
+
+// Refreshes the peers this client is connected to, announces this client again, and asks a random
+// connection for more addresses
+func (c *Client) exchangePeers() {
+	now := time.Now()
+
+	c.lock.Lock()
+	c.markPeerSeen(c.ownPeer, now)
+	c.lock.Unlock()
+
+	// Only the address this side dialed is known to be the peer's. The one an inbound peer claims may be anyone's
+	for _, pc := range c.getConnections() {
+		if pc.remote != nil && pc.dialed != "" && pc.dialed == pc.remote.ListenAddress {
+			c.lock.Lock()
+			c.markPeerSeen(Peer{pc.remote.ListenAddress, pc.remote.Pk}, now)
+			c.lock.Unlock()
+		}
+	}
+
+	c.broadcastSelf()
+
+	for _, pc := range c.randomConnections(1, nil) {
+		c.queueMessage(pc, Message{ID: GETADDR_MESSAGE})
+	}
+}
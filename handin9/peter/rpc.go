@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+// An embedded JSON-RPC 2.0 server. It serves the same Client as the REPL, so scripts can use a
+// node without reading its output. Requests are POSTed to the root path.
+type RPCServer struct {
+	client  *Client
+	server  *http.Server
+	methods map[string]func(params json.RawMessage) (interface{}, error)
+}
+
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      interface{}     `json:"id"`
+}
+
+type RPCResponse struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *RPCError   `json:"error,omitempty"`
+	ID      interface{} `json:"id"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// The error codes defined by JSON-RPC 2.0
+const RPC_PARSE_ERROR = -32700
+const RPC_INVALID_REQUEST = -32600
+const RPC_METHOD_NOT_FOUND = -32601
+const RPC_INVALID_PARAMS = -32602
+const RPC_SERVER_ERROR = -32000
+
+// Returned by a method when the params can't be used, so the right error code is sent
+type invalidParamsError struct {
+	message string
+}
+
+func (e invalidParamsError) Error() string {
+	return e.message
+}
+
+// Blocks and transactions as they are sent over JSON. Big numbers are sent as strings,
+// since most JSON parsers can't handle numbers that large.
+type HeaderJSON struct {
+	ID            int    `json:"id"`
+	PreviousBlock string `json:"previousBlock"`
+	Sender        string `json:"sender"`
+	TxRoot        string `json:"txRoot"`
+	StateRoot     string `json:"stateRoot"`
+	Signature     string `json:"signature"`
+	Draw          string `json:"draw"`
+}
+
+type BlockJSON struct {
+	HeaderJSON
+	Transactions []string `json:"transactions"`
+}
+
+type TransactionJSON struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    int    `json:"amount"`
+	Signature string `json:"signature"`
+}
+
+type PeerJSON struct {
+	Address   string    `json:"address"`
+	Pk        string    `json:"pk"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Connected bool      `json:"connected"`
+}
+
+func headerToJSON(header *BlockHeader) HeaderJSON {
+	draw := ""
+	if header.Draw != nil {
+		draw = header.Draw.String()
+	}
+
+	return HeaderJSON{header.ID, header.PreviousBlock, header.Sender, header.TxRoot, header.StateRoot, header.Signature, draw}
+}
+
+func blockToJSON(block *Block) BlockJSON {
+	return BlockJSON{headerToJSON(&block.BlockHeader), block.Transactions}
+}
+
+func (h HeaderJSON) toHeader() (BlockHeader, error) {
+	draw, ok := new(big.Int).SetString(h.Draw, 10)
+	if !ok {
+		return BlockHeader{}, errors.New("the block has a malformed draw")
+	}
+
+	return BlockHeader{h.ID, h.PreviousBlock, h.Sender, h.TxRoot, h.StateRoot, h.Signature, draw}, nil
+}
+
+func (b BlockJSON) toBlock() (*Block, error) {
+	header, err := b.toHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Block{header, BlockBody{b.Transactions}}, nil
+}
+
+func connectionToJSON(pc *PeerConn) PeerJSON {
+	peer := PeerJSON{Address: pc.RemoteAddr(), Connected: true}
+	if pc.remote != nil {
+		peer.Address = pc.remote.ListenAddress
+		peer.Pk = pc.remote.Pk
+	}
+
+	return peer
+}
+
+func transactionToJSON(t SignedTransaction) TransactionJSON {
+	return TransactionJSON{t.ID, t.From, t.To, t.Amount, t.Signature}
+}
+
+func (t TransactionJSON) toTransaction() SignedTransaction {
+	return SignedTransaction{ID: t.ID, From: t.From, To: t.To, Amount: t.Amount, Signature: t.Signature}
+}
+
+func NewRPCServer(client *Client) *RPCServer {
+	rpc := &RPCServer{client: client}
+
+	rpc.methods = map[string]func(params json.RawMessage) (interface{}, error){
+		"getBalance":          rpc.getBalance,
+		"getBlock":            rpc.getBlock,
+		"getHead":             rpc.getHead,
+		"submitTransaction":   rpc.submitTransaction,
+		"listPeers":           rpc.listPeers,
+		"getMempool":          rpc.getMempool,
+		"getTransactionProof": rpc.getTransactionProof,
+		"getBalanceProof":     rpc.getBalanceProof,
+	}
+
+	return rpc
+}
+
+// The handlers served next to the JSON-RPC endpoint. Other parts of the node add theirs here
+func (rpc *RPCServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", rpc.handleRPC)
+	mux.HandleFunc("/events", rpc.handleEvents)
+	mux.HandleFunc("/metrics", rpc.handleMetrics)
+	mux.HandleFunc("/explorer/", rpc.handleExplorer)
+	return mux
+}
+
+// Starts serving on the address in the background. Returns an error if it can't listen
+func (rpc *RPCServer) Start(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	rpc.server = &http.Server{Handler: rpc.routes(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := rpc.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			rpc.client.log.Error(LOG_NETWORK, "RPC server stopped", "error", err)
+		}
+	}()
+
+	rpc.client.log.Info(LOG_NETWORK, "Serving JSON-RPC", "address", ln.Addr().String())
+	return nil
+}
+
+func (rpc *RPCServer) Stop() {
+	if rpc.server != nil {
+		rpc.server.Close()
+	}
+}
+
+func (rpc *RPCServer) handleRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests have to be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var request RPCRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(MAX_MESSAGE_SIZE)))
+	if err := decoder.Decode(&request); err != nil {
+		writeRPCResponse(w, RPCResponse{Error: &RPCError{RPC_PARSE_ERROR, err.Error()}})
+		return
+	}
+
+	response := RPCResponse{ID: request.ID}
+
+	method, ok := rpc.methods[request.Method]
+	if request.JSONRPC != "2.0" {
+		response.Error = &RPCError{RPC_INVALID_REQUEST, "jsonrpc has to be \"2.0\""}
+	} else if !ok {
+		response.Error = &RPCError{RPC_METHOD_NOT_FOUND, "unknown method " + request.Method}
+	} else {
+		result, err := method(request.Params)
+
+		var invalidParams invalidParamsError
+		if errors.As(err, &invalidParams) {
+			response.Error = &RPCError{RPC_INVALID_PARAMS, err.Error()}
+		} else if err != nil {
+			response.Error = &RPCError{RPC_SERVER_ERROR, err.Error()}
+		} else {
+			response.Result = result
+		}
+	}
+
+	writeRPCResponse(w, response)
+}
+
+func writeRPCResponse(w http.ResponseWriter, response RPCResponse) {
+	response.JSONRPC = "2.0"
+	json.NewEncoder(w).Encode(response)
+}
+
+// Decodes the params of a request into v. Missing params are treated as an empty object
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(params, v); err != nil {
+		return invalidParamsError{"invalid params: " + err.Error()}
+	}
+
+	return nil
+}
+
+// Params: {"account": <public key or address of a peer>}
+func (rpc *RPCServer) getBalance(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Account string `json:"account"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	pk := p.Account
+	if peer := rpc.client.GetPeerFromIP(p.Account); peer != nil {
+		pk = peer.Pk
+	}
+
+	if !isValidKeyString(pk) {
+		return nil, invalidParamsError{"account has to be a public key, or the address of a known peer"}
+	}
+
+	ledger, _ := rpc.client.generateNewestLedger()
+	if ledger == nil {
+		return nil, errors.New("unable to calculate the ledger")
+	}
+
+	return map[string]interface{}{"account": pk, "balance": ledger.Accounts[pk]}, nil
+}
+
+// Params: {"signature": <signature>} for a single block, or {"id": <id>} for all blocks with the ID,
+// since there can be more than one when the chain has forked
+func (rpc *RPCServer) getBlock(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Signature string `json:"signature"`
+		ID        *int   `json:"id"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	if p.Signature == "" && p.ID == nil {
+		return nil, invalidParamsError{"either signature or id is required"}
+	}
+
+	c := rpc.client
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if p.Signature != "" {
+		block := c.getBlockBySignature(p.Signature)
+		if block == nil {
+			return nil, errors.New("no block with that signature")
+		}
+
+		return blockToJSON(block), nil
+	}
+
+	blocks := []BlockJSON{}
+	for _, block := range c.blocks {
+		if block.ID == *p.ID {
+			blocks = append(blocks, blockToJSON(block))
+		}
+	}
+
+	return blocks, nil
+}
+
+// Returns the newest block of the longest chain, and the length of that chain
+func (rpc *RPCServer) getHead(params json.RawMessage) (interface{}, error) {
+	head, height := rpc.client.getHead()
+
+	return map[string]interface{}{"block": blockToJSON(head), "height": height}, nil
+}
+
+// Params: {"transaction": {"id", "from", "to", "amount", "signature"}}. The transaction has to be
+// signed by the sender already. It is validated and gossiped exactly like one from a peer
+func (rpc *RPCServer) submitTransaction(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Transaction TransactionJSON `json:"transaction"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	transaction := p.Transaction.toTransaction()
+	verdict := rpc.client.handleTransaction(rpc.client.traceOrigin(Message{ID: TRANSACTION_MESSAGE, Value: transaction}, transaction.ID))
+
+	switch verdict {
+	case VERDICT_USEFUL:
+		return map[string]interface{}{"accepted": true}, nil
+	case VERDICT_DUPLICATE:
+		return map[string]interface{}{"accepted": false, "reason": "already known"}, nil
+	default:
+		return nil, invalidParamsError{"invalid transaction"}
+	}
+}
+
+func (rpc *RPCServer) listPeers(params json.RawMessage) (interface{}, error) {
+	c := rpc.client
+
+	c.lock.Lock()
+	peers := []PeerJSON{}
+	for _, peer := range c.peers {
+		peers = append(peers, PeerJSON{Address: peer.Address, Pk: peer.Pk, LastSeen: c.peerSeen[peer.Address]})
+	}
+	c.lock.Unlock()
+
+	for i := range peers {
+		peers[i].Connected = c.isConnectedTo(peers[i].Address)
+	}
+
+	return peers, nil
+}
+
+// Returns the received transactions which aren't in any block yet
+func (rpc *RPCServer) getMempool(params json.RawMessage) (interface{}, error) {
+	return rpc.client.getMempool(), nil
+}
+
+// Returns the newest block of the longest chain, and how many blocks there are after the genesis block
+func (c *Client) getHead() (*Block, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	head := c.getLongestBlock(MAX_INT)
+	return head, c.chainHeight(head)
+}
+
+func (c *Client) getMempool() []TransactionJSON {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pending := make(map[string]bool)
+	for _, id := range c.pendingTransactions() {
+		pending[id] = true
+	}
+
+	mempool := []TransactionJSON{}
+	for _, transaction := range c.transactionsReceived {
+		if pending[transaction.ID] {
+			mempool = append(mempool, transactionToJSON(transaction))
+		}
+	}
+
+	return mempool
+}
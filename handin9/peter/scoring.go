@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What handling a message from a peer amounted to. It decides how the peer's score changes
+type Verdict int
+
+const (
+	VERDICT_USEFUL    Verdict = iota // A new and valid transaction or block
+	VERDICT_DUPLICATE                // Valid, but already known. This is normal for gossip
+	VERDICT_IGNORED                  // Couldn't be used right now, for instance a block without its previous block
+	VERDICT_INVALID                  // A bad signature, an invalid draw or a malformed message
+	VERDICT_ORPHAN                   // A valid block whose previous block is missing. It's kept until that arrives
+)
+
+// Keeps the score of each connection, and the peers which are currently banned
+type Reputation struct {
+	lock    sync.Mutex
+	scores  map[*PeerConn]int
+	carried map[string]int // The negative scores of closed connections, by public key, so reconnecting doesn't clear them
+	bans    map[string]Ban // By public key
+}
+
+type Ban struct {
+	Address string
+	Pk      string
+	Reason  string
+	Until   time.Time
+}
+
+func NewReputation() *Reputation {
+	return &Reputation{
+		scores:  make(map[*PeerConn]int),
+		carried: make(map[string]int),
+		bans:    make(map[string]Ban),
+	}
+}
+
+// Updates the score of a connection. Returns true if the peer has dropped below the threshold and was banned
+func (r *Reputation) Record(pc *PeerConn, verdict Verdict) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	score, ok := r.scores[pc]
+	if !ok && pc.remote != nil {
+		score = r.carried[pc.remote.Pk]
+	}
+
+	switch verdict {
+	case VERDICT_USEFUL:
+		score += USEFUL_MESSAGE_SCORE
+		if score > MAX_PEER_SCORE {
+			score = MAX_PEER_SCORE
+		}
+	case VERDICT_INVALID:
+		score -= INVALID_MESSAGE_PENALTY
+	}
+
+	r.scores[pc] = score
+
+	if score >= BAN_THRESHOLD || pc.remote == nil {
+		return false
+	}
+
+	delete(r.carried, pc.remote.Pk)
+	r.bans[pc.remote.Pk] = Ban{
+		Address: pc.remote.ListenAddress,
+		Pk:      pc.remote.Pk,
+		Reason:  fmt.Sprint("score dropped to ", score),
+		Until:   time.Now().Add(BAN_DURATION),
+	}
+
+	return true
+}
+
+func (r *Reputation) Score(pc *PeerConn) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.scores[pc]
+}
+
+// Forgets the score of a connection which has been closed. A negative score is kept for the peer's next connection
+func (r *Reputation) Forget(pc *PeerConn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if score, ok := r.scores[pc]; ok && pc.remote != nil {
+		if score < 0 {
+			r.carried[pc.remote.Pk] = score
+		} else {
+			delete(r.carried, pc.remote.Pk)
+		}
+	}
+
+	delete(r.scores, pc)
+}
+
+// Returns the ban on a public key or address, if there is one which hasn't expired
+func (r *Reputation) IsBanned(pk string, address string) (Ban, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key, ban := range r.bans {
+		if time.Now().After(ban.Until) {
+			delete(r.bans, key)
+			continue
+		}
+
+		if ban.Pk == pk || (address != "" && ban.Address == address) {
+			return ban, true
+		}
+	}
+
+	return Ban{}, false
+}
+
+// Returns all bans which haven't expired, with the one expiring first at the front
+func (r *Reputation) Bans() []Ban {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var bans []Ban
+	for key, ban := range r.bans {
+		if time.Now().After(ban.Until) {
+			delete(r.bans, key)
+		} else {
+			bans = append(bans, ban)
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+
+	return bans
+}
+
+func (r *Reputation) ClearBans() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	count := len(r.bans)
+	r.bans = make(map[string]Ban)
+	return count
+}
+
+// Scores the message from a connection, and disconnects the peer if it gets banned.
+// Returns false if the connection was closed
+func (c *Client) scorePeer(pc *PeerConn, verdict Verdict) bool {
+	if !c.reputation.Record(pc, verdict) {
+		return true
+	}
+
+	c.log.Warn(LOG_NETWORK, "Banning peer because of invalid messages", "peer", pc.remote.ListenAddress, "duration", BAN_DURATION)
+	c.rejectPeer(pc, "banned for sending invalid messages")
+	return false
+}
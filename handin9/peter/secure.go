@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+var FRAME_OVERHEAD = 16 // The size of the AES-GCM tag added to each encrypted frame
+
+// The settings of SECURE_TRANSPORT, which decide how new connections are secured
+const (
+	SECURE_ON       int32 = iota // Encrypt connections to peers which also support it. The default
+	SECURE_OFF                   // Don't encrypt connections
+	SECURE_REQUIRED              // Refuse connections to peers which don't support encryption
+)
+
+// Returns the setting named "on", "off" or "required"
+func parseSecureSetting(name string) (int32, bool) {
+	switch name {
+	case "on":
+		return SECURE_ON, true
+	case "off":
+		return SECURE_OFF, true
+	case "required":
+		return SECURE_REQUIRED, true
+	}
+
+	return 0, false
+}
+
+// Sent by both sides right after the handshake, when they both support the "secure" feature.
+// The ephemeral key is signed with the long-term key from the Hello, which authenticates the channel.
+// The Hellos are signed in the handshake, so the feature can't be stripped by someone in between.
+type KeyExchange struct {
+	EphemeralKey []byte
+	Signature    string
+}
+
+// AES-GCM for one direction of a connection. The nonce is a counter, so it is never reused for a key
+type frameCipher struct {
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func newFrameCipher(key []byte) (*frameCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &frameCipher{aead: aead}, nil
+}
+
+func (fc *frameCipher) nextNonce() []byte {
+	nonce := make([]byte, fc.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], fc.counter)
+	fc.counter++
+	return nonce
+}
+
+func (fc *frameCipher) seal(plaintext []byte) []byte {
+	return fc.aead.Seal(nil, fc.nextNonce(), plaintext, nil)
+}
+
+// Frames have to be opened in the order they were sealed, since both sides count them
+func (fc *frameCipher) open(ciphertext []byte) ([]byte, error) {
+	plaintext, err := fc.aead.Open(nil, fc.nextNonce(), ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("unable to decrypt frame, the connection has been tampered with")
+	}
+
+	return plaintext, nil
+}
+
+func (pc *PeerConn) IsSecure() bool {
+	pc.writeLock.Lock()
+	defer pc.writeLock.Unlock()
+
+	return pc.sendCipher != nil
+}
+
+// The features this client sends in its Hello
+func (c *Client) features() []string {
+	features := append([]string{}, FEATURES...)
+
+	if SECURE_TRANSPORT.Load() != SECURE_OFF {
+		features = append(features, "secure")
+	}
+
+	if c.light {
+		features = append(features, "light")
+	}
+
+	return features
+}
+
+// The message signed in a key exchange. It includes both nonces from the handshake,
+// so a key exchange can't be replayed on another connection
+func generateKeyExchangeMessage(ephemeralKey []byte, localNonce string, remoteNonce string) []byte {
+	return []byte("keyexchange" + hex.EncodeToString(ephemeralKey) + localNonce + remoteNonce)
+}
+
+// Derives the key used for frames sent by the side which picked fromNonce
+func deriveFrameKey(shared []byte, fromNonce string, toNonce string) []byte {
+	sha := sha256.New()
+	sha.Write(shared)
+	sha.Write([]byte(fromNonce))
+	sha.Write([]byte(toNonce))
+	return sha.Sum(nil)
+}
+
+// Sets up an encrypted channel on a connection which has completed the handshake.
+// Each side sends an X25519 key signed by its long-term key, and the shared secret is turned
+// into one AES-GCM key per direction.
+func (c *Client) performKeyExchange(pc *PeerConn, local *Hello) error {
+	remote := pc.remote
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	publicKey := ephemeral.PublicKey().Bytes()
+	signature := Sign(generateKeyExchangeMessage(publicKey, local.Nonce, remote.Nonce), c.sk)
+	exchange := KeyExchange{EphemeralKey: publicKey, Signature: signature.String()}
+
+	if err := pc.WriteMessage(Message{ID: KEY_EXCHANGE_MESSAGE, Value: exchange}); err != nil {
+		return err
+	}
+
+	msg, err := c.readHandshakeMessage(pc, KEY_EXCHANGE_MESSAGE)
+	if err != nil {
+		return err
+	}
+	remoteExchange, ok := msg.Value.(KeyExchange)
+	if !ok {
+		return c.rejectPeer(pc, "malformed key exchange")
+	}
+
+	remoteSignature, ok := new(big.Int).SetString(remoteExchange.Signature, 10)
+	remoteMessage := generateKeyExchangeMessage(remoteExchange.EphemeralKey, remote.Nonce, local.Nonce)
+	if !ok || !Verify(remoteMessage, remoteSignature, GeneratePublicKeyFromString(remote.Pk)) {
+		return c.rejectPeer(pc, "key exchange isn't signed by the peer's key")
+	}
+
+	remoteKey, err := ecdh.X25519().NewPublicKey(remoteExchange.EphemeralKey)
+	if err != nil {
+		return c.rejectPeer(pc, "invalid ephemeral key")
+	}
+
+	shared, err := ephemeral.ECDH(remoteKey)
+	if err != nil {
+		return c.rejectPeer(pc, "invalid ephemeral key")
+	}
+
+	sendCipher, err := newFrameCipher(deriveFrameKey(shared, local.Nonce, remote.Nonce))
+	if err != nil {
+		return err
+	}
+	receiveCipher, err := newFrameCipher(deriveFrameKey(shared, remote.Nonce, local.Nonce))
+	if err != nil {
+		return err
+	}
+
+	// Both key exchange frames have been fully read and written, so every frame from here on is encrypted
+	pc.writeLock.Lock()
+	pc.sendCipher = sendCipher
+	pc.writeLock.Unlock()
+	pc.frames.cipher = receiveCipher
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Each connection has its own bounded queue of outgoing messages, which is emptied by a writer
+// goroutine. Queueing never blocks: if a peer is too slow to keep up, messages to it are dropped,
+// and after MAX_CONSECUTIVE_DROPS drops in a row the peer is disconnected. This way one stuck
+// peer can't hold up the gossip to everyone else.
+type SendQueue struct {
+	messages         chan Message
+	sent             atomic.Uint64
+	dropped          atomic.Uint64
+	consecutiveDrops atomic.Int32
+}
+
+func NewSendQueue() *SendQueue {
+	return &SendQueue{messages: make(chan Message, SEND_QUEUE_SIZE)}
+}
+
+// The number of messages waiting to be sent
+func (q *SendQueue) Depth() int {
+	return len(q.messages)
+}
+
+func (q *SendQueue) Capacity() int {
+	return cap(q.messages)
+}
+
+func (q *SendQueue) Sent() uint64 {
+	return q.sent.Load()
+}
+
+func (q *SendQueue) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+// Adds a message to the queue of a connection without blocking. Returns false if it was dropped,
+// or if it isn't sent to the peer, like transactions to light clients
+func (c *Client) queueMessage(pc *PeerConn, msg Message) bool {
+	if isLightPeer(pc) {
+		var ok bool
+		if msg, ok = lightMessage(msg); !ok {
+			return false
+		}
+	}
+
+	c.activity.Add(1)
+
+	select {
+	case pc.queue.messages <- msg:
+		pc.queue.consecutiveDrops.Store(0)
+
+		// The writer may have stopped before the message was added
+		if isClosed(pc) {
+			c.dropQueued(pc)
+		}
+		return true
+	default:
+	}
+
+	c.activity.Add(-1)
+	pc.queue.dropped.Add(1)
+
+	if pc.queue.consecutiveDrops.Add(1) == int32(MAX_CONSECUTIVE_DROPS) {
+		c.log.Warn(LOG_NETWORK, "Peer can't keep up with the messages sent to it, disconnecting", "peer", pc.RemoteAddr())
+		c.removeConnection(pc)
+	}
+
+	return false
+}
+
+// Sends the queued messages of a connection, until the connection is closed
+func (c *Client) writeMessages(pc *PeerConn) {
+	var held *Message          // A message the faults hold back, to send it out of order
+	var flush <-chan time.Time // Fires when the held message has waited long enough for another one
+
+	defer c.dropQueued(pc)
+
+	for {
+		select {
+		case <-pc.done:
+			return
+
+		case <-flush:
+			// Nothing came after the held message, so it is sent on its own
+			msg := *held
+			held, flush = nil, nil
+
+			if !c.writeQueued(pc, msg) {
+				return
+			}
+
+		case msg := <-pc.queue.messages:
+			var messages []Message
+			var delay time.Duration
+			wasHeld := held != nil
+			messages, held, delay = c.faults.apply(pc, msg, held)
+
+			if held == nil {
+				flush = nil
+			} else if !wasHeld {
+				flush = time.After(REORDER_TIMEOUT)
+			}
+
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+
+			for _, msg := range messages {
+				if !c.writeQueued(pc, msg) {
+					c.activity.Add(-1)
+					return
+				}
+			}
+
+			c.activity.Add(-1)
+		}
+	}
+}
+
+// Writes a message from the queue. Only the messages which are written count as sent, so
+// the ones the faults drop or hold back don't
+func (c *Client) writeQueued(pc *PeerConn, msg Message) bool {
+	if !c.sendMessage(pc, msg) {
+		return false
+	}
+
+	pc.queue.sent.Add(1)
+	metrics.Inc("messages_sent_total", "client", c.ownPeer.Address, "type", msg.ID)
+
+	return true
+}
+
+// Empties the queue of a closed connection
+func (c *Client) dropQueued(pc *PeerConn) {
+	for {
+		select {
+		case <-pc.queue.messages:
+			c.activity.Add(-1)
+		default:
+			return
+		}
+	}
+}
+
+func isClosed(pc *PeerConn) bool {
+	select {
+	case <-pc.done:
+		return true
+	default:
+		return false
+	}
+}
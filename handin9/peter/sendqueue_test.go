@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeldMessageIsFlushed(t *testing.T) {
+	setLogLevels("off")
+	defer func(timeout time.Duration) { REORDER_TIMEOUT = timeout }(REORDER_TIMEOUT)
+	REORDER_TIMEOUT = 10 * time.Millisecond
+
+	keys := newTestKeys(1)
+	client := &Client{}
+	client.setup(keys[0], RingTopology{})
+	client.faults.SetConfig(FaultConfig{Reorder: 1})
+
+	local, remote := net.Pipe()
+	pc := NewPeerConn(local)
+	pc.remote = &Hello{Pk: "peer"}
+	defer pc.Close()
+
+	go client.writeMessages(pc)
+
+	if !client.queueMessage(pc, Message{ID: PING_MESSAGE}) {
+		t.Fatal("the message wasn't queued")
+	}
+
+	// The message is held back, waiting for another one which never comes
+	received := make(chan Message)
+	go func() {
+		msg, err := NewPeerConn(remote).ReadMessage()
+		if err == nil {
+			received <- msg
+		}
+	}()
+
+	select {
+	case msg := <-received:
+		if msg.ID != PING_MESSAGE {
+			t.Fatalf("got a %s message", msg.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the held message was never sent")
+	}
+
+	// It is counted once the write has returned
+	waitFor(func() bool { return pc.queue.Sent() > 0 })
+	if sent := pc.queue.Sent(); sent != 1 {
+		t.Errorf("counted %d messages as sent", sent)
+	}
+}
+
+// Polls the condition until it holds, or a second has passed
+func waitFor(condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDroppedMessagesArentSent(t *testing.T) {
+	setLogLevels("off")
+
+	keys := newTestKeys(1)
+	client := &Client{}
+	client.setup(keys[0], RingTopology{})
+	client.faults.SetConfig(FaultConfig{Drop: 1})
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	pc := NewPeerConn(local)
+	pc.remote = &Hello{Pk: "peer"}
+	defer pc.Close()
+
+	go client.writeMessages(pc)
+
+	for i := 0; i < 5; i++ {
+		client.queueMessage(pc, Message{ID: PING_MESSAGE})
+	}
+
+	waitFor(func() bool { return client.faults.Lost() == 5 })
+
+	if sent := pc.queue.Sent(); sent != 0 {
+		t.Errorf("counted %d dropped messages as sent", sent)
+	}
+
+	if lost := client.faults.Lost(); lost != 5 {
+		t.Errorf("counted %d lost messages, expected 5", lost)
+	}
+}
+
+func TestBroadcastAfterStopDoesntBlock(t *testing.T) {
+	setLogLevels("off")
+
+	keys := newTestKeys(1)
+	client := &Client{}
+	client.setup(keys[0], RingTopology{})
+	client.Stop()
+
+	// Nothing takes the messages off the channel, so it fills up
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < SEND_QUEUE_SIZE+1; i++ {
+			client.broadcast(Message{ID: PING_MESSAGE})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a broadcast after the client stopped blocked")
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"math/big"
+	"time"
 )
 
 func Sign(message []byte, sk SecretKey) *big.Int {
@@ -26,19 +26,20 @@ func Sign(message []byte, sk SecretKey) *big.Int {
 }
 
 func Verify(message []byte, signature *big.Int, pk PublicKey) bool {
+	defer metrics.ObserveSince("signature_verify_seconds", time.Now())
 
 	// Verifying:
 	// m = s ^ e mod n
 
 	// 'Decrypt' the signature
 	decSign := new(big.Int).Exp(signature, pk.E_pk, pk.N_pk)
-	decSignBytes := decSign.Bytes()
 
 	// Calculate the sha of the original message
 	sha := sha256.New()
 	sha.Write(message)
 	hash := sha.Sum(nil)
 
-	// Return whether the decrypted signature matches the sha of the message
-	return (bytes.Compare(hash, decSignBytes) == 0)
+	// Return whether the decrypted signature matches the sha of the message. They are compared
+	// as numbers, since the bytes of the signature lose the leading zeros of the hash
+	return decSign.Cmp(new(big.Int).SetBytes(hash)) == 0
 }
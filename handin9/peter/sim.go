@@ -0,0 +1,702 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A deterministic simulation of a network of clients. The clients are real Clients, with the same
+// handshake, send queues, gossip and scoring, but their connections are in memory, and time is virtual:
+// every frame is delivered at a virtual time, and the next one is only delivered once every client
+// is done with the last. Every random choice comes from the seed, so the same config always gives the
+// same result, and thousands of slots take seconds instead of hours.
+type SimConfig struct {
+	Clients      int
+	Slots        int
+	Seed         int64
+	Latency      time.Duration // The least time a message takes
+	Jitter       time.Duration // A random extra delay, up to Jitter
+	Loss         float64       // The chance that a message is lost
+	WinChance    float64       // The chance each client wins a slot. Defaults to 1 / Clients
+	Transactions int           // How many random transactions are made in each slot
+	Topology     Topology      // Defaults to RingTopology
+
+	// The clients are split into two halves for the slots from PartitionFrom until PartitionUntil
+	PartitionFrom  int
+	PartitionUntil int
+}
+
+// The size of the keys of simulated clients. It's far smaller than the real keys, since signing
+// is most of the work in a simulation, but it still has to be larger than a sha256 hash
+var SIM_KEY_SIZE = 512
+
+// When the first slot of a simulation begins
+var SIM_EPOCH = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Counts the messages which are still being handled by the clients of a simulation: frames which
+// haven't been read to the end, broadcasts which haven't been queued, and queued messages which
+// haven't been written. The simulator waits for it to reach zero before it moves on. All the
+// methods do nothing on a nil Activity, which is what clients outside a simulation have
+type Activity struct {
+	lock  sync.Mutex
+	idle  *sync.Cond
+	count int
+}
+
+func NewActivity() *Activity {
+	a := &Activity{}
+	a.idle = sync.NewCond(&a.lock)
+	return a
+}
+
+func (a *Activity) Add(n int) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.count += n
+	if a.count == 0 {
+		a.idle.Broadcast()
+	}
+}
+
+// Blocks until nothing is being handled
+func (a *Activity) Wait() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for a.count > 0 {
+		a.idle.Wait()
+	}
+}
+
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+// One end of an in-memory connection between two simulated clients. Each write is handed to the
+// simulator, which delivers it to the other end at a virtual time. The deadlines are ignored,
+// since time only moves when the simulator moves it
+type simConn struct {
+	sim    *Simulator
+	local  int
+	remote int
+	other  *simConn
+
+	lock   sync.Mutex
+	ready  *sync.Cond
+	buffer []byte
+	unread int  // Frames which were delivered, and which the reader hasn't finished handling
+	eof    bool // The other end was closed, and everything it wrote has been delivered
+	closed bool
+
+	// Guarded by the lock of the simulator
+	written int
+	arrival time.Time // When the last frame written arrives. Frames arrive in order, like on TCP
+	random  *rand.Rand
+}
+
+func newSimConn(sim *Simulator, local int, remote int) *simConn {
+	sc := &simConn{sim: sim, local: local, remote: remote}
+	sc.ready = sync.NewCond(&sc.lock)
+	sc.random = rand.New(rand.NewSource(sim.config.Seed*int64(len(sim.clients)*len(sim.clients)) + int64(local*len(sim.clients)+remote)))
+	return sc
+}
+
+// The reader only asks for more once it is done with what it was given, so the frames it was
+// given stop counting as activity. Has to be called with the lock held
+func (sc *simConn) release() {
+	if sc.unread > 0 {
+		sc.sim.activity.Add(-sc.unread)
+		sc.unread = 0
+	}
+}
+
+func (sc *simConn) Read(p []byte) (int, error) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	for len(sc.buffer) == 0 {
+		sc.release()
+
+		if sc.closed {
+			return 0, net.ErrClosed
+		}
+		if sc.eof {
+			return 0, io.EOF
+		}
+
+		sc.ready.Wait()
+	}
+
+	n := copy(p, sc.buffer)
+	sc.buffer = sc.buffer[n:]
+	return n, nil
+}
+
+func (sc *simConn) Write(p []byte) (int, error) {
+	sc.lock.Lock()
+	closed := sc.closed
+	sc.lock.Unlock()
+
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	sc.sim.transmit(sc, append([]byte{}, p...))
+	return len(p), nil
+}
+
+// Hands a frame to this end. A nil frame means that the other end was closed
+func (sc *simConn) deliver(frame []byte) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if sc.closed {
+		return false
+	}
+
+	if frame == nil {
+		sc.eof = true
+	} else {
+		sc.buffer = append(sc.buffer, frame...)
+		sc.unread++
+		sc.sim.activity.Add(1)
+	}
+
+	sc.ready.Broadcast()
+	return true
+}
+
+func (sc *simConn) Close() error {
+	sc.lock.Lock()
+	if sc.closed {
+		sc.lock.Unlock()
+		return nil
+	}
+	sc.closed = true
+	sc.release()
+	sc.ready.Broadcast()
+	sc.lock.Unlock()
+
+	// The other end reads what is underway, and then gets an EOF
+	sc.sim.transmit(sc, nil)
+	return nil
+}
+
+func (sc *simConn) LocalAddr() net.Addr                { return simAddr(simAddress(sc.local)) }
+func (sc *simConn) RemoteAddr() net.Addr               { return simAddr(simAddress(sc.remote)) }
+func (sc *simConn) SetDeadline(t time.Time) error      { return nil }
+func (sc *simConn) SetReadDeadline(t time.Time) error  { return nil }
+func (sc *simConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func simAddress(index int) string {
+	return "sim-" + strconv.Itoa(index)
+}
+
+type simEvent struct {
+	at    time.Time
+	order [3]int // Events at the same time run in this order. Slots come first, then frames by connection
+	run   func()
+}
+
+type simQueue []simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		for k := range q[i].order {
+			if q[i].order[k] != q[j].order[k] {
+				return q[i].order[k] < q[j].order[k]
+			}
+		}
+		return false
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(simEvent)) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	event := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return event
+}
+
+type Simulator struct {
+	config   SimConfig
+	clients  []*Client
+	genesis  *GenesisBlock
+	random   *rand.Rand
+	activity *Activity
+	start    time.Time // When the first slot begins, once the connections are set up
+
+	lock      sync.Mutex // Guards the clock, the queue and the counts, since the clients write concurrently
+	now       time.Time
+	queue     simQueue
+	running   bool // Set once the handshakes are done, so only the messages after them are counted
+	delivered int
+
+	created int // Blocks made by any client
+}
+
+type SimResult struct {
+	Slots     int
+	Created   int
+	Height    int   // The length of the longest chain of client 0
+	Wins      []int // How many blocks each client has on the longest chain of client 0
+	Heads     []string
+	Converged bool // True if every client has the same head
+	Delivered int
+	Lost      int
+	Elapsed   time.Duration // The real time the simulation took
+}
+
+// Generates a key pair from the random source, so simulated clients get the same keys every run
+func deterministicKeyGen(random *rand.Rand, k int) KeyPair {
+	prime := func() *big.Int {
+		for {
+			candidate := new(big.Int).Rand(random, new(big.Int).Lsh(big.NewInt(1), uint(k/2)))
+			candidate.SetBit(candidate, k/2-1, 1)
+			candidate.SetBit(candidate, 0, 1)
+
+			if candidate.ProbablyPrime(20) && TestGCD(candidate) {
+				return candidate
+			}
+		}
+	}
+
+	p := prime()
+	q := prime()
+	for p.Cmp(q) == 0 {
+		q = prime()
+	}
+
+	n := new(big.Int).Mul(p, q)
+	return KeyPair{Pk: generatePublicKey(n, e), Sk: generateSecretKey(n, calculateD(p, q))}
+}
+
+// Returns the hardness which gives each draw the chance to win
+func hardnessForChance(chance float64) *big.Int {
+	max := new(big.Int).Mul(big.NewInt(int64(PREMIUM_ACCOUNT)), new(big.Int).Lsh(big.NewInt(1), 256))
+	losing := new(big.Int).Mul(max, big.NewInt(int64((1-chance)*1e9)))
+
+	return losing.Div(losing, big.NewInt(1e9))
+}
+
+func NewSimulator(config SimConfig) (*Simulator, error) {
+	if config.Clients < 2 {
+		return nil, errors.New("a simulation needs at least 2 clients")
+	}
+
+	if config.Loss < 0 || config.Loss >= 1 {
+		return nil, errors.New("the loss has to be at least 0 and below 1")
+	}
+
+	if config.Topology == nil {
+		config.Topology = RingTopology{}
+	}
+
+	if config.WinChance <= 0 || config.WinChance > 1 {
+		config.WinChance = 1 / float64(config.Clients)
+	}
+
+	sim := &Simulator{config: config, random: rand.New(rand.NewSource(config.Seed)), activity: NewActivity(), now: SIM_EPOCH}
+
+	var pairs []KeyPair
+	var kingKeys []string
+	for i := 0; i < config.Clients; i++ {
+		pair := deterministicKeyGen(sim.random, SIM_KEY_SIZE)
+		pairs = append(pairs, pair)
+		kingKeys = append(kingKeys, pair.Pk.toString())
+	}
+
+	sim.genesis = NewGenesisBlock(pairs[0], kingKeys, int(config.Seed), SIM_EPOCH)
+	sim.genesis.Hardness = hardnessForChance(config.WinChance)
+	sim.genesis.Sign(pairs[0])
+
+	for i, pair := range pairs {
+		client, err := sim.newClient(i, pair)
+		if err != nil {
+			return nil, err
+		}
+		sim.clients = append(sim.clients, client)
+	}
+
+	sim.connect()
+
+	// Run the handshakes, so the first slot starts with every connection open
+	for sim.step() {
+	}
+	sim.start = sim.now
+	sim.running = true
+
+	return sim, nil
+}
+
+// Sets up a client like Client.setup does, but with its randomness from the seed
+func (sim *Simulator) newClient(index int, pair KeyPair) (*Client, error) {
+	client := &Client{}
+	client.setup(pair, sim.config.Topology)
+	client.ownPeer = Peer{simAddress(index), pair.Pk.toString()}
+	client.log = newPeerLogger(client.ownPeer)
+	client.random = rand.New(rand.NewSource(sim.config.Seed + int64(index)))
+	client.activity = sim.activity
+
+	client.faults.Seed(sim.config.Seed + int64(index))
+	client.faults.SetConfig(FaultConfig{Drop: sim.config.Loss})
+
+	if err := client.setGenesisBlock(sim.genesis); err != nil {
+		return nil, err
+	}
+
+	go client.broadcastMessages()
+
+	return client, nil
+}
+
+// Connects the clients like the topology would. A client dials the peers the topology picks for it,
+// unless they already dialed it
+func (sim *Simulator) connect() {
+	var peers []Peer
+	for _, client := range sim.clients {
+		peers = append(peers, client.ownPeer)
+	}
+
+	connected := make(map[[2]int]bool)
+
+	for i, client := range sim.clients {
+		var known []Peer
+		for _, peer := range peers {
+			if peer.Address != client.ownPeer.Address {
+				known = append(known, peer)
+			}
+		}
+
+		candidates := sim.config.Topology.Candidates(client.ownPeer, known, sim.random)
+		for _, peer := range candidates[:sim.config.Topology.OutboundTarget(len(known))] {
+			other, _ := strconv.Atoi(peer.Address[len("sim-"):])
+			if connected[[2]int{i, other}] {
+				continue
+			}
+			connected[[2]int{i, other}] = true
+			connected[[2]int{other, i}] = true
+
+			sim.dial(i, other)
+		}
+	}
+}
+
+// Opens a connection from one client to another, and runs the handshake on both ends like a
+// dialing and a listening client do
+func (sim *Simulator) dial(from int, to int) {
+	local, remote := newSimConn(sim, from, to), newSimConn(sim, to, from)
+	local.other, remote.other = remote, local
+
+	dialer := NewPeerConn(local)
+	dialer.dialed = simAddress(to)
+
+	sim.open(sim.clients[from], dialer, local)
+	sim.open(sim.clients[to], NewPeerConn(remote), remote)
+	sim.activity.Wait()
+}
+
+func (sim *Simulator) open(client *Client, pc *PeerConn, conn *simConn) {
+	// The client is busy until it first waits for a frame
+	conn.unread = 1
+	sim.activity.Add(1)
+
+	go func() {
+		if client.openConnection(pc) {
+			client.handleConnection(pc)
+		}
+	}()
+}
+
+// Schedules the delivery of a frame to the other end of the connection
+func (sim *Simulator) transmit(sc *simConn, frame []byte) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	arrival := sim.now.Add(sim.config.Latency)
+	if sim.config.Jitter > 0 {
+		arrival = arrival.Add(time.Duration(sc.random.Int63n(int64(sim.config.Jitter))))
+	}
+
+	if arrival.Before(sc.arrival) {
+		arrival = sc.arrival
+	}
+	sc.arrival = arrival
+
+	order := [3]int{sc.local, sc.remote, sc.written}
+	sc.written++
+
+	heap.Push(&sim.queue, simEvent{arrival, order, func() {
+		if sc.other.deliver(frame) && frame != nil && sim.running {
+			sim.delivered++
+		}
+	}})
+}
+
+func (sim *Simulator) schedule(at time.Time, run func()) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	// Slots run before the frames which arrive at the same time
+	heap.Push(&sim.queue, simEvent{at, [3]int{-1, sim.queue.Len(), 0}, run})
+}
+
+// Runs the next event, and waits until every client is done with it. Returns false if there
+// are no events left
+func (sim *Simulator) step() bool {
+	sim.lock.Lock()
+	if sim.queue.Len() == 0 {
+		sim.lock.Unlock()
+		return false
+	}
+
+	event := heap.Pop(&sim.queue).(simEvent)
+	sim.now = event.at
+	sim.lock.Unlock()
+
+	event.run()
+	sim.activity.Wait()
+	return true
+}
+
+// Splits the clients into groups. Messages between clients in different groups are lost, like
+// with the partition command
+func (sim *Simulator) Partition(groups [][]int) {
+	for _, group := range groups {
+		in := make(map[int]bool)
+		for _, index := range group {
+			in[index] = true
+		}
+
+		var cut []string
+		for i, client := range sim.clients {
+			if !in[i] {
+				cut = append(cut, client.ownPeer.Pk)
+			}
+		}
+
+		for _, index := range group {
+			sim.clients[index].faults.SetCut(cut)
+		}
+	}
+}
+
+func (sim *Simulator) Heal() {
+	for _, client := range sim.clients {
+		client.faults.SetCut(nil)
+	}
+}
+
+// Starts every client on the slot, and then runs the lottery of each one like Client.blockTimer does
+func (sim *Simulator) runSlot(slot int) {
+	if slot == sim.config.PartitionFrom && sim.config.PartitionUntil > slot {
+		half := len(sim.clients) / 2
+		var first, second []int
+		for i := range sim.clients {
+			if i < half {
+				first = append(first, i)
+			} else {
+				second = append(second, i)
+			}
+		}
+		sim.Partition([][]int{first, second})
+	} else if slot == sim.config.PartitionUntil && sim.config.PartitionFrom < slot {
+		sim.Heal()
+	}
+
+	for _, client := range sim.clients {
+		client.advanceSlot(slot)
+	}
+
+	for i := 0; i < sim.config.Transactions; i++ {
+		sim.makeTransaction(slot, i)
+		sim.activity.Wait()
+	}
+
+	for _, client := range sim.clients {
+		if client.runLottery(sim.genesis, slot) {
+			sim.created++
+		}
+		sim.activity.Wait()
+	}
+}
+
+// Makes a random transaction between two clients, and hands it to the sender like the trans command
+func (sim *Simulator) makeTransaction(slot int, i int) {
+	from := sim.clients[sim.random.Intn(len(sim.clients))]
+	to := sim.clients[sim.random.Intn(len(sim.clients))]
+	if from == to {
+		return
+	}
+
+	transaction := SignedTransaction{
+		ID:     from.ownPeer.Address + "-" + strconv.Itoa(slot) + "-" + strconv.Itoa(i),
+		From:   from.ownPeer.Pk,
+		To:     to.ownPeer.Pk,
+		Amount: 1 + sim.random.Intn(10),
+	}
+	transaction.Signature = Sign(GenerateMessageFromTransaction(&transaction), from.sk).String()
+
+	from.handleTransaction(Message{ID: TRANSACTION_MESSAGE, Value: transaction})
+}
+
+// Runs every slot, waits for the messages which are still underway, and stops the clients
+func (sim *Simulator) Run() SimResult {
+	start := time.Now()
+	slotLength := sim.genesis.slotLength()
+
+	for slot := 1; slot <= sim.config.Slots; slot++ {
+		slot := slot
+		sim.schedule(sim.start.Add(time.Duration(slot-1)*slotLength), func() {
+			sim.runSlot(slot)
+		})
+	}
+
+	for sim.step() {
+	}
+
+	result := sim.result(time.Since(start))
+
+	for _, client := range sim.clients {
+		client.Stop()
+	}
+
+	return result
+}
+
+func (sim *Simulator) result(elapsed time.Duration) SimResult {
+	result := SimResult{
+		Slots:     sim.config.Slots,
+		Created:   sim.created,
+		Wins:      make([]int, len(sim.clients)),
+		Converged: true,
+		Delivered: sim.delivered,
+		Elapsed:   elapsed,
+	}
+
+	creators := make(map[string]int)
+	for i, client := range sim.clients {
+		creators[client.ownPeer.Pk] = i
+		result.Lost += client.faults.Lost()
+
+		head, _ := client.getHead()
+		result.Heads = append(result.Heads, head.Signature)
+
+		if head.Signature != result.Heads[0] {
+			result.Converged = false
+		}
+	}
+
+	first := sim.clients[0]
+	first.lock.Lock()
+	defer first.lock.Unlock()
+
+	head := first.getLongestBlock(MAX_INT)
+	result.Height = first.chainHeight(head)
+
+	for block := head; block != nil && block.ID > 0; block = first.getBlockBySignature(block.PreviousBlock) {
+		result.Wins[creators[block.Sender]]++
+	}
+
+	return result
+}
+
+func (r SimResult) Print() {
+	fmt.Println("Simulated", r.Slots, "slots with", len(r.Wins), "clients in", r.Elapsed.Round(time.Millisecond))
+	fmt.Println("Made", r.Created, "blocks, of which", r.Height, "are on the longest chain")
+	fmt.Println("Delivered", r.Delivered, "messages, and lost", r.Lost)
+
+	expected := float64(r.Height) / float64(len(r.Wins))
+	for i, wins := range r.Wins {
+		if expected > 0 {
+			fmt.Printf("Client %d has %d blocks on the chain (%.1f%% of the expected %.1f)\n", i, wins, 100*float64(wins)/expected, expected)
+		}
+	}
+
+	if r.Converged {
+		fmt.Println("All clients agree on the head", shortHash(r.Heads[0]))
+		return
+	}
+
+	heads := make(map[string]int)
+	for _, head := range r.Heads {
+		heads[head]++
+	}
+	fmt.Println("The clients have not converged: there are", len(heads), "different heads")
+}
+
+// Parses the arguments of the simulate command: <clients> <slots> <seed> [name=value ...]
+func parseSimConfig(params []string) (SimConfig, error) {
+	var config SimConfig
+	var err error
+
+	if config.Clients, err = strconv.Atoi(params[0]); err != nil {
+		return config, errors.New("invalid number of clients")
+	}
+	if config.Slots, err = strconv.Atoi(params[1]); err != nil {
+		return config, errors.New("invalid number of slots")
+	}
+	if config.Seed, err = strconv.ParseInt(params[2], 10, 64); err != nil {
+		return config, errors.New("invalid seed")
+	}
+
+	for _, option := range params[3:] {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return config, errors.New("expected name=value, got " + option)
+		}
+
+		name, value := parts[0], parts[1]
+		switch name {
+		case "latency":
+			config.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			config.Jitter, err = time.ParseDuration(value)
+		case "loss":
+			config.Loss, err = strconv.ParseFloat(value, 64)
+		case "win":
+			config.WinChance, err = strconv.ParseFloat(value, 64)
+		case "transactions":
+			config.Transactions, err = strconv.Atoi(value)
+		case "topology":
+			if config.Topology = GetTopology(value); config.Topology == nil {
+				err = errors.New("unknown topology")
+			}
+		case "partition":
+			bounds := strings.SplitN(value, "-", 2)
+			if len(bounds) != 2 {
+				err = errors.New("expected from-until")
+				break
+			}
+			if config.PartitionFrom, err = strconv.Atoi(bounds[0]); err == nil {
+				config.PartitionUntil, err = strconv.Atoi(bounds[1])
+			}
+		default:
+			err = errors.New("unknown option")
+		}
+
+		if err != nil {
+			return config, errors.New("invalid " + option + ": " + err.Error())
+		}
+	}
+
+	return config, nil
+}
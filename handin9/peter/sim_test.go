@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulationConverges(t *testing.T) {
+	setLogLevels("off")
+
+	config := SimConfig{Clients: 4, Slots: 30, Seed: 7, Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond, Transactions: 2}
+
+	sim, err := NewSimulator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := sim.Run()
+
+	if !result.Converged {
+		t.Fatalf("the clients have different heads: %v", result.Heads)
+	}
+
+	if result.Height == 0 || result.Created < result.Height {
+		t.Fatalf("made %d blocks, and %d are on the longest chain", result.Created, result.Height)
+	}
+
+	if result.Lost != 0 {
+		t.Errorf("lost %d messages without any loss", result.Lost)
+	}
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	setLogLevels("off")
+
+	configs := []SimConfig{
+		{Clients: 4, Slots: 20, Seed: 3, Latency: 50 * time.Millisecond, Jitter: 200 * time.Millisecond, Loss: 0.05, Transactions: 1},
+
+		// More clients than TARGET_OUTBOUND, so the random topology has to pick
+		{Clients: TARGET_OUTBOUND + 2, Slots: 10, Seed: 5, Latency: 50 * time.Millisecond, Transactions: 1, Topology: RandomTopology{}},
+	}
+
+	for _, config := range configs {
+		var results []SimResult
+		for i := 0; i < 2; i++ {
+			sim, err := NewSimulator(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, sim.Run())
+		}
+
+		first, second := results[0], results[1]
+		if first.Created != second.Created || first.Height != second.Height || first.Delivered != second.Delivered || first.Lost != second.Lost {
+			t.Fatalf("two runs with the same seed differ: %+v and %+v", first, second)
+		}
+
+		for i := range first.Heads {
+			if first.Heads[i] != second.Heads[i] {
+				t.Fatalf("client %d has different heads in two runs with the same seed", i)
+			}
+		}
+	}
+}
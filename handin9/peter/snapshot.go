@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// A snapshot lets a client join without replaying the whole chain. It holds the balances after a
+// final block and the IDs of the transactions in each block, which are checked against the state root
+// in the block's header, and the headers from the genesis block up to it, which are checked like a
+// light client checks them. A client started from a snapshot only has the headers of the blocks up to
+// it, and applies the blocks after it to the balances in it. The file is JSON with a version, and a
+// checksum of the snapshot.
+
+type Snapshot struct {
+	Genesis      GenesisBlock
+	Headers      []BlockHeader // From the first block after the genesis block, up to the block of the snapshot
+	Balances     []Allocation  // The balances after the block, sorted by account. Accounts with nothing are left out
+	Transactions [][]string    // The IDs of the transactions in the block of each header, which later blocks skip
+}
+
+type SnapshotFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"` // The SHA-256 of the compact JSON of the snapshot, as hex
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+// The block a client was started from, and what it needs to go on from there
+type SnapshotBase struct {
+	block   *Block
+	ledger  *Ledger
+	used    map[string]bool // The IDs of the transactions in the block and the ones before it
+	headers map[string]bool // The blocks this client only has the headers of, by signature
+
+	transactions map[string][]string // The IDs of the transactions in the blocks this client only has the headers of
+}
+
+// Returns the header of the block the snapshot was taken at
+func (snapshot *Snapshot) block() *BlockHeader {
+	if len(snapshot.Headers) == 0 {
+		return &snapshot.Genesis.BlockHeader
+	}
+
+	return &snapshot.Headers[len(snapshot.Headers)-1]
+}
+
+// Returns the root of the used transactions after the block of the snapshot
+func (snapshot *Snapshot) usedRoot() string {
+	root := usedRoot("", snapshot.Genesis.Transactions)
+	for _, ids := range snapshot.Transactions {
+		root = usedRoot(root, ids)
+	}
+
+	return root
+}
+
+// Takes a snapshot at the block FINALITY_DEPTH blocks below the head, or at the block this client
+// was started from, if that is higher
+func (s *State) exportSnapshot() (*Snapshot, error) {
+	if s.light {
+		return nil, errors.New("a light client doesn't have the balances")
+	}
+
+	block := s.getLongestBlock(MAX_INT)
+	for i := 0; i < FINALITY_DEPTH && block.PreviousBlock != "" && !s.isSnapshotBase(block); i++ {
+		block = s.getBlockBySignature(block.PreviousBlock)
+	}
+
+	ledger, ok := s.ledgerAfter(block)
+	if !ok {
+		return nil, errors.New("some of the transactions of the chain are missing")
+	}
+
+	snapshot := &Snapshot{Genesis: *s.genesisBlock}
+
+	for ; block.PreviousBlock != ""; block = s.getBlockBySignature(block.PreviousBlock) {
+		ids := block.Transactions
+		if s.isHeaderOnly(block.Signature) {
+			ids = s.snapshot.transactions[block.Signature]
+		}
+
+		// Unshift the header and its transactions
+		snapshot.Headers = append([]BlockHeader{block.BlockHeader}, snapshot.Headers...)
+		snapshot.Transactions = append([][]string{ids}, snapshot.Transactions...)
+	}
+
+	for account, balance := range ledger.Accounts {
+		if balance != 0 {
+			snapshot.Balances = append(snapshot.Balances, Allocation{account, balance})
+		}
+	}
+	sort.Slice(snapshot.Balances, func(i, j int) bool { return snapshot.Balances[i].Account < snapshot.Balances[j].Account })
+
+	return snapshot, nil
+}
+
+// Checks the headers and the balances of the snapshot against the genesis block of this client.
+// Returns an error describing the first invalid item
+func (s *State) verifySnapshot(snapshot *Snapshot) error {
+	if snapshot.Genesis.Hash() != s.genesisBlock.Hash() {
+		return errors.New("the snapshot is of another chain")
+	}
+
+	if len(snapshot.Transactions) != len(snapshot.Headers) {
+		return fmt.Errorf("the snapshot has the transactions of %d blocks, but %d headers", len(snapshot.Transactions), len(snapshot.Headers))
+	}
+
+	previous := &s.genesisBlock.BlockHeader
+	for i := range snapshot.Headers {
+		header := &snapshot.Headers[i]
+
+		if header.PreviousBlock != previous.Signature {
+			return fmt.Errorf("header %d, slot %d, doesn't follow the header before it", i, header.ID)
+		}
+
+		if header.ID <= previous.ID {
+			return fmt.Errorf("header %d, slot %d, isn't after the slot of the header before it", i, header.ID)
+		}
+
+		if !isValidKeyString(header.Sender) || header.Draw == nil {
+			return fmt.Errorf("header %d, slot %d, has a malformed sender or draw", i, header.ID)
+		}
+
+		if !header.isValid() {
+			return fmt.Errorf("header %d, slot %d, isn't signed by its sender", i, header.ID)
+		}
+
+		if !s.IsValidDraw(s.genesisBlock.Seed, header.ID, header.Draw, GeneratePublicKeyFromString(header.Sender)) {
+			return fmt.Errorf("header %d, slot %d, has an invalid draw", i, header.ID)
+		}
+
+		previous = header
+	}
+
+	ledger := MakeLedger()
+	for i, balance := range snapshot.Balances {
+		if balance.Amount <= 0 {
+			return fmt.Errorf("balance %d, of %s, isn't positive", i, shortHash(balance.Account))
+		}
+
+		if i > 0 && balance.Account <= snapshot.Balances[i-1].Account {
+			return fmt.Errorf("balance %d, of %s, isn't sorted by account", i, shortHash(balance.Account))
+		}
+
+		ledger.AddAmount(balance.Account, balance.Amount)
+	}
+
+	if stateRoot(ledger.Root(), snapshot.usedRoot()) != previous.StateRoot {
+		return errors.New("the balances or the used transactions don't match the state root of the block")
+	}
+
+	return nil
+}
+
+// Starts the chain of this client from the snapshot, which has to be of its genesis block. The client
+// mustn't have any other blocks yet
+func (s *State) importSnapshot(snapshot *Snapshot) error {
+	if s.light {
+		return errors.New("a light client has no use for the balances")
+	}
+
+	if len(s.blocks) > 1 {
+		return errors.New("the client already has blocks")
+	}
+
+	if err := s.verifySnapshot(snapshot); err != nil {
+		return err
+	}
+
+	base := &SnapshotBase{block: s.genesisBlock.Block, ledger: MakeLedger(), used: make(map[string]bool), headers: make(map[string]bool), transactions: make(map[string][]string)}
+
+	for i, header := range snapshot.Headers {
+		block := &Block{BlockHeader: header}
+		s.addBlock(block)
+
+		base.block = block
+		base.headers[block.Signature] = true
+		base.transactions[block.Signature] = snapshot.Transactions[i]
+
+		for _, id := range snapshot.Transactions[i] {
+			base.used[id] = true
+		}
+	}
+
+	for _, balance := range snapshot.Balances {
+		base.ledger.AddAmount(balance.Account, balance.Amount)
+	}
+
+	s.snapshot = base
+	s.states[base.block.Signature] = &blockState{base.ledger, newStateTree(base.ledger), base.ledger.Root(), snapshot.usedRoot()}
+	s.currentBlockID = base.block.ID
+
+	return nil
+}
+
+func (s *State) isSnapshotBase(block *Block) bool {
+	return s.snapshot != nil && s.snapshot.block == block
+}
+
+// Returns true if this client only has the header of the block
+func (s *State) isHeaderOnly(signature string) bool {
+	return s.light || (s.snapshot != nil && s.snapshot.headers[signature])
+}
+
+func (c *Client) exportSnapshot() (*Snapshot, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.exportSnapshot()
+}
+
+func (c *Client) importSnapshot(snapshot *Snapshot) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.State.importSnapshot(snapshot)
+}
+
+func snapshotChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func saveSnapshot(snapshot *Snapshot, path string) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	file, err := json.MarshalIndent(SnapshotFile{SNAPSHOT_VERSION, snapshotChecksum(data), data}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, file, 0644)
+}
+
+// Reads a snapshot, and checks its version and checksum. The contents are checked when it is imported
+func loadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file SnapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid snapshot file %s: %w", path, err)
+	}
+
+	if file.Version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("unsupported snapshot version %d in %s, expected %d", file.Version, path, SNAPSHOT_VERSION)
+	}
+
+	// The snapshot is indented in the file, so it is compacted again before it is hashed
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, file.Snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot file %s: %w", path, err)
+	}
+
+	if snapshotChecksum(compact.Bytes()) != file.Checksum {
+		return nil, errors.New("the checksum of " + path + " doesn't match, the file is damaged")
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(file.Snapshot, &snapshot); err != nil || snapshot.Genesis.Block == nil {
+		return nil, errors.New("invalid snapshot file " + path)
+	}
+
+	if !snapshot.Genesis.isValid() {
+		return nil, errors.New("the genesis block in " + path + " isn't valid")
+	}
+
+	return &snapshot, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Returns a state with a chain of blocks, each with a transaction from keys[0] to keys[1]
+func newTestChain(t *testing.T, keys []KeyPair, length int) *State {
+	t.Helper()
+
+	s := newTestState(t, keys)
+	s.currentBlockID = length
+
+	previous := s.genesisBlock.Block
+	for slot := 1; slot <= length; slot++ {
+		transaction := signTestTransaction("t"+strconv.Itoa(slot), keys[0], keys[1], 10)
+		s.applyTransaction(transaction)
+
+		block := signTestBlock(s, slot, previous, keys[slot%2], []string{transaction.ID})
+		if verdict := s.applyBlock(block); verdict != VERDICT_USEFUL {
+			t.Fatalf("block in slot %d: got verdict %d", slot, verdict)
+		}
+		previous = block
+	}
+
+	return s
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestChain(t, keys, FINALITY_DEPTH+3)
+
+	snapshot, err := s.exportSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := &State{}
+	other.setGenesisBlock(s.genesisBlock)
+	if err := other.importSnapshot(snapshot); err != nil {
+		t.Fatalf("a valid snapshot was rejected: %v", err)
+	}
+
+	// The transactions in the snapshot are skipped by later blocks
+	for _, ids := range snapshot.Transactions {
+		for _, id := range ids {
+			if !other.snapshot.used[id] {
+				t.Errorf("transaction %s isn't used after the import", id)
+			}
+		}
+	}
+
+	// A client started from the snapshot makes the same state roots as the one it came from
+	base := other.snapshot.block
+	if state, _ := other.stateAfter(base); state.used != s.states[base.Signature].used {
+		t.Error("the root of the used transactions differs after the import")
+	}
+}
+
+func TestSnapshotCommitsToUsedTransactions(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestChain(t, keys, FINALITY_DEPTH+3)
+
+	tampered := map[string]func(*Snapshot){
+		"no transactions": func(snapshot *Snapshot) {
+			snapshot.Transactions = nil
+		},
+		"a block without its transactions": func(snapshot *Snapshot) {
+			snapshot.Transactions[0] = nil
+		},
+		"a transaction moved to another block": func(snapshot *Snapshot) {
+			snapshot.Transactions[1] = append(snapshot.Transactions[1], snapshot.Transactions[0]...)
+			snapshot.Transactions[0] = nil
+		},
+		"an extra transaction": func(snapshot *Snapshot) {
+			snapshot.Transactions[2] = append(snapshot.Transactions[2], "extra")
+		},
+	}
+
+	for name, tamper := range tampered {
+		snapshot, err := s.exportSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tamper(snapshot)
+
+		other := &State{}
+		other.setGenesisBlock(s.genesisBlock)
+		if err := other.importSnapshot(snapshot); err == nil {
+			t.Errorf("%s: the snapshot was accepted", name)
+		}
+	}
+}
+
+func TestBalanceProofCoversUsedTransactions(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestChain(t, keys, 3)
+	head := s.getLongestBlock(MAX_INT)
+
+	proof, err := s.balanceProof(head.Signature, keys[1].Pk.toString())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyBalanceProof(head.BlockHeader, proof); err != nil {
+		t.Fatalf("a valid proof was rejected: %v", err)
+	}
+
+	proof.Used = usedRoot("", nil)
+	if VerifyBalanceProof(head.BlockHeader, proof) == nil {
+		t.Error("accepted a proof with another root of the used transactions")
+	}
+}
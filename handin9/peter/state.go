@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// State is everything a client knows about the chain and the network. The methods on State are
+// the state transitions of a client: they don't touch the network, and they don't lock anything,
+// so they can be run and tested without any sockets. The Client embeds a State and guards it with
+// its lock, and does the networking based on what the transitions return.
+type State struct {
+	transactionsSent     []string            // A list of already broadcasted transactions
+	transactionsReceived []SignedTransaction // A list of all received transactions
+	transactionsByID     map[string]SignedTransaction
+	peers                []Peer               // The address book: the known peers, sorted by address
+	peerSeen             map[string]time.Time // When each peer in the address book was last seen alive
+	boundPeers           map[string]bool      // The addresses whose key was proven by dialing them, see bindDialedPeer
+	blocks               []*Block             // A list of all received blocks
+	blocksBySignature    map[string]*Block    // The same blocks, for fast lookups
+	heights              map[string]int       // How many blocks each block is from the genesis block, by signature
+	orphans              map[string][]*Block  // Blocks whose previous block is missing, by the signature of the previous block
+	numOrphans           int
+	genesisBlock         *GenesisBlock
+	currentBlockID       int
+	transactionID        int        // The ID of the next transaction made by this client
+	random               *rand.Rand // The source of randomness for the state transitions
+	log                  *Logger
+	head                 *Block                 // The end of the longest chain, kept by addBlock
+	history              *HistoryIndex          // Built lazily, by updateHistory
+	states               map[string]*blockState // The state after each block, by signature. Filled in by stateAfter
+	transactionBlocks    map[string][]string    // The signatures of the blocks each transaction is in, by ID
+	light                bool                   // Only keep the headers of blocks, see light.go
+	snapshot             *SnapshotBase          // The block the client was started from, if it was started from a snapshot
+}
+
+// Adds a transaction, if it is valid and new. Only useful transactions should be passed on
+func (s *State) applyTransaction(transaction SignedTransaction) Verdict {
+	var transID = transaction.ID
+
+	// If this transaction has already been sent, break. This is checked first, since checking
+	// the signature is far slower, and only valid transactions are ever added
+	if _, ok := s.transactionsByID[transID]; ok {
+		return VERDICT_DUPLICATE
+	}
+
+	// Don't broadcast an invalid message
+	if !transaction.isValid() {
+		s.log.Warn(LOG_WALLET, "Received an invalid transaction", "transaction", transaction.ID)
+		return VERDICT_INVALID
+	}
+
+	if s.transactionsByID == nil {
+		s.transactionsByID = make(map[string]SignedTransaction)
+	}
+
+	s.transactionsSent = append(s.transactionsSent, transID)
+	s.transactionsReceived = append(s.transactionsReceived, transaction)
+	s.transactionsByID[transID] = transaction
+
+	return VERDICT_USEFUL
+}
+
+// Adds a block, if it is valid and new. Only useful blocks should be passed on
+func (s *State) applyBlock(block *Block) Verdict {
+	verdict, err := s.checkBlock(block)
+
+	switch verdict {
+	case VERDICT_USEFUL, VERDICT_ORPHAN:
+		// A light client only checks and keeps the header
+		if s.light {
+			block = &Block{BlockHeader: block.BlockHeader}
+		}
+
+		if verdict == VERDICT_ORPHAN {
+			s.addOrphan(block)
+		} else {
+			s.addBlock(block)
+		}
+
+	case VERDICT_INVALID:
+		s.log.Warn(LOG_CONSENSUS, "Received an invalid block", "slot", block.ID, "reason", err)
+
+	case VERDICT_IGNORED:
+		s.log.Debug(LOG_CONSENSUS, "Ignored a block", "slot", block.ID, "reason", err)
+	}
+
+	return verdict
+}
+
+// Checks a block like applyBlock does, without adding it. Returns the verdict, and unless the block
+// is useful, the reason, which completes a sentence starting with "the block"
+func (s *State) checkBlock(block *Block) (Verdict, error) {
+
+	// Skip this block, if it has already been received
+	if s.blocksBySignature[block.Signature] != nil || s.isOrphan(block) {
+		return VERDICT_DUPLICATE, errors.New("is already known")
+	}
+	for i := 0; i < len(s.blocks); i++ {
+		if s.blocks[i].ID == block.ID && s.blocks[i].Sender == block.Sender {
+			return VERDICT_DUPLICATE, errors.New("is the second block of its sender in the slot")
+		}
+	}
+
+	if !isValidKeyString(block.Sender) || block.Draw == nil {
+		return VERDICT_INVALID, errors.New("has a malformed sender or draw")
+	}
+
+	if !s.IsValidDraw(s.genesisBlock.Seed, block.ID, block.Draw, GeneratePublicKeyFromString(block.Sender)) {
+		return VERDICT_INVALID, errors.New("has a draw which doesn't win the slot")
+	}
+
+	if !block.isValid() {
+		return VERDICT_INVALID, errors.New("isn't signed by its sender")
+	}
+
+	if s.getBlockBySignature(block.PreviousBlock) == nil {
+		return VERDICT_ORPHAN, errors.New("follows a block which is missing")
+	}
+
+	if !s.light {
+		// The root can only be checked with all the transactions, so the block has to wait for them
+		if missing := s.missingTransactions(block); len(missing) > 0 {
+			return VERDICT_IGNORED, fmt.Errorf("is missing %d of its transactions, the first is %s", len(missing), missing[0])
+		}
+
+		// A body which doesn't match the signed root has been changed since it was signed
+		if !s.bodyMatchesRoot(block) {
+			return VERDICT_INVALID, errors.New("has transactions which don't match its root")
+		}
+	}
+
+	// The block may be from a slot this client hasn't reached yet, so the sender isn't punished
+	if err := s.checkBlockSlot(block); err != nil {
+		return VERDICT_IGNORED, err
+	}
+
+	// The sender has to agree with this client about the balances after the block
+	if !s.light {
+		if root, _ := s.stateRoot(block); root != block.StateRoot {
+			return VERDICT_INVALID, errors.New("has balances which don't match its state root")
+		}
+	}
+
+	return VERDICT_USEFUL, nil
+}
+
+// Adds a peer to the list. Returns false if it was already known
+func (s *State) addPeer(peer Peer) bool {
+	if s.isPeerRegistered(peer.Address) {
+		return false
+	}
+
+	s.peers = append(s.peers, peer)
+	s.sortPeers()
+	return true
+}
+
+// Removes a peer from the list of peers. Returns false if it wasn't in the list
+func (s *State) removePeer(address string) bool {
+	for i := 0; i < len(s.peers); i++ {
+		if s.peers[i].Address == address {
+			s.peers = append(s.peers[:i], s.peers[i+1:]...)
+			delete(s.peerSeen, address)
+			delete(s.boundPeers, address)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Starts the chain from the genesis block. Returns an error, and changes nothing, if it isn't signed by its sender
+func (s *State) setGenesisBlock(genesis *GenesisBlock) error {
+	if !genesis.isValid() {
+		return errors.New("the genesis block isn't signed by its sender")
+	}
+
+	s.genesisBlock = genesis
+	s.blocksBySignature = make(map[string]*Block)
+	s.heights = make(map[string]int)
+	s.states = make(map[string]*blockState)
+	s.transactionBlocks = make(map[string][]string)
+	s.addBlock(genesis.Block)
+
+	return nil
+}
+
+// Adds a block whose previous block is known, or the genesis block
+func (s *State) addBlock(block *Block) {
+	s.blocks = append(s.blocks, block)
+	s.blocksBySignature[block.Signature] = block
+
+	if block.ID > 0 {
+		s.heights[block.Signature] = s.heights[block.PreviousBlock] + 1
+	}
+
+	for _, id := range block.Transactions {
+		s.transactionBlocks[id] = append(s.transactionBlocks[id], block.Signature)
+	}
+
+	if s.head == nil || s.isLonger(block, s.head) {
+		s.head = block
+	}
+
+	s.pruneStates(block)
+}
+
+func (s *State) GetPeerFromPK(str string) *Peer {
+	for i := 0; i < len(s.peers); i++ {
+		if str == s.peers[i].Pk {
+			return &s.peers[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *State) GetPeerFromIP(ip string) *Peer {
+	for i := 0; i < len(s.peers); i++ {
+		if ip == s.peers[i].Address {
+			return &s.peers[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *State) isPeerRegistered(address string) bool {
+	for i := 0; i < len(s.peers); i++ {
+		if s.peers[i].Address == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *State) sortPeers() {
+	address := func(i, j int) bool {
+		return s.peers[i].Address < s.peers[j].Address
+	}
+	sort.SliceStable(s.peers, address)
+}
+
+// Returns why the block doesn't fit after its previous block, or nil if it does. A block can't be from
+// a slot before its previous block, or from a slot after the one this client is at
+func (s *State) checkBlockSlot(block *Block) error {
+	prev := s.getBlockBySignature(block.PreviousBlock)
+
+	if prev == nil {
+		return errors.New("follows a block which is missing")
+	}
+
+	if block.ID <= prev.ID { // Verify that prev block is smaller than current
+		return errors.New("isn't after the slot of its previous block")
+	}
+
+	if block.ID > s.currentBlockID+1 { // Verify that the block is the expected one
+		return fmt.Errorf("is too far ahead of slot %d", s.currentBlockID)
+	}
+
+	return nil
+}
+
+func (s *State) getBlockBySignature(sign string) *Block {
+	return s.blocksBySignature[sign]
+}
+
+func (s *State) getLongestBlock(lessThanID int) *Block {
+
+	// The longest chain of all is also the longest of the ones before the slot, if it is before it
+	if s.head.ID < lessThanID {
+		return s.head
+	}
+
+	var longestDist = 0
+	var longestBlock = s.genesisBlock.Block
+
+	for i := 0; i < len(s.blocks); i++ {
+		block := s.blocks[i]
+
+		if block.ID >= lessThanID {
+			continue
+		}
+
+		dist := s.heights[block.Signature]
+
+		if dist > longestDist {
+			longestDist = dist
+			longestBlock = block
+		} else if dist == longestDist {
+
+			// If distance is the same, pick the one with the biggest ID
+			if block.ID == longestBlock.ID {
+				if block.Signature > longestBlock.Signature {
+					longestDist = dist
+					longestBlock = block
+				}
+			} else if block.ID > longestBlock.ID {
+				longestDist = dist
+				longestBlock = block
+			}
+		}
+	}
+
+	return longestBlock
+}
+
+// Returns true if the chain ending in the block is picked over the one ending in the other block, like
+// getLongestBlock does: the longer chain, then the later slot, then the larger signature
+func (s *State) isLonger(block *Block, other *Block) bool {
+	if s.heights[block.Signature] != s.heights[other.Signature] {
+		return s.heights[block.Signature] > s.heights[other.Signature]
+	}
+
+	if block.ID != other.ID {
+		return block.ID > other.ID
+	}
+
+	return block.Signature > other.Signature
+}
+
+// Returns how many blocks there are between the genesis block and the block, which has to be added
+func (s *State) chainHeight(head *Block) int {
+	return s.heights[head.Signature]
+}
+
+// Returns the IDs of all received transactions which aren't in any block yet
+func (s *State) pendingTransactions() []string {
+
+	// Collect the 'old' transactions
+	used := make(map[string]bool)
+	if s.snapshot != nil {
+		for transID := range s.snapshot.used {
+			used[transID] = true
+		}
+	}
+	for _, block := range s.blocks {
+		for _, transID := range block.Transactions {
+			used[transID] = true
+		}
+	}
+
+	transactions := []string{}
+	for _, transaction := range s.transactionsReceived {
+		if !used[transaction.ID] {
+			transactions = append(transactions, transaction.ID)
+		}
+	}
+
+	return transactions
+}
+
+// Returns a ledger alongside a boolean describing if the ledger is valid or not.
+// The ledger will be invalid only if a block brings an account below 0.
+func (s *State) generateNewestLedger() (*Ledger, bool) {
+	block := s.getLongestBlock(MAX_INT)
+
+	return s.generateLedgerForBlock(block)
+}
+
+func (s *State) generateLedgerForBlock(block *Block) (*Ledger, bool) {
+	return s.replayChain(block, nil)
+}
+
+// Applies the transactions of the block, and the reward of its sender, to the ledger. used holds the IDs of
+// the transactions applied by earlier blocks, which are skipped. Returns the transactions which were applied
+// and the reward, or false without changing the ledger if the client doesn't have all the transactions
+func (s *State) applyBlockToLedger(block *Block, ledger *Ledger, used map[string]bool) ([]SignedTransaction, int, bool) {
+	if len(s.missingTransactions(block)) > 0 {
+		return nil, 0, false
+	}
+
+	if !s.bodyMatchesRoot(block) {
+		s.log.Warn(LOG_LEDGER, "The transactions of a block don't match its root", "slot", block.ID)
+		return nil, 0, false
+	}
+
+	senderPay := BLOCK_REWARD
+	var applied []SignedTransaction
+
+	for _, transID := range block.Transactions {
+
+		// Skip this ID, if it has already been seen
+		if used[transID] {
+			continue
+		}
+		used[transID] = true
+
+		trans := s.transactionsByID[transID]
+		if ledger.SignedTransaction(&trans) {
+			senderPay++ // Add 1 AU for each valid transaction
+			applied = append(applied, trans)
+		} else {
+			s.log.Debug(LOG_LEDGER, "Skipping an invalid transaction", "transaction", trans.ID, "slot", block.ID)
+		}
+	}
+
+	if senderPeer := s.GetPeerFromPK(block.Sender); senderPeer != nil {
+		s.log.Debug(LOG_LEDGER, "Paying the sender of a block", "amount", senderPay, "to", senderPeer.Address, "slot", block.ID)
+	}
+	ledger.AddAmount(block.Sender, senderPay)
+
+	return applied, senderPay, true
+}
+
+// Builds the ledger of the chain ending in the block, from the genesis block and up, or from the snapshot
+// the client was started from. If visit isn't nil, it is called after each block with the ledger so far,
+// the transactions of the block which were applied, and the reward paid to the sender of the block
+func (s *State) replayChain(block *Block, visit func(block *Block, ledger *Ledger, applied []SignedTransaction, reward int)) (*Ledger, bool) {
+	blocks := []*Block{block}
+
+	for block.PreviousBlock != "" && !s.isSnapshotBase(block) {
+		previous := block.PreviousBlock
+		block = s.getBlockBySignature(previous)
+
+		if block == nil {
+			s.log.Error(LOG_LEDGER, "Unable to generate ledger: missing block", "block", shortHash(previous))
+			return nil, true
+		}
+
+		blocks = append([]*Block{block}, blocks...) // Unshift the block
+	}
+
+	ledger := s.genesisBlock.allocationLedger()
+	usedTransactions := make(map[string]bool)
+
+	// The blocks up to the snapshot are only headers, and the snapshot has the balances after them
+	if s.isSnapshotBase(blocks[0]) {
+		ledger = s.snapshot.ledger.Copy()
+		for id := range s.snapshot.used {
+			usedTransactions[id] = true
+		}
+		blocks = blocks[1:]
+	}
+
+	s.log.Debug(LOG_LEDGER, "Generating ledger", "blocks", len(blocks))
+
+	for _, block := range blocks {
+		applied, senderPay, ok := s.applyBlockToLedger(block, ledger, usedTransactions)
+		if !ok {
+			s.log.Error(LOG_LEDGER, "Unable to apply a block. Cannot calculate ledger", "slot", block.ID, "missing", len(s.missingTransactions(block)))
+			return nil, true
+		}
+
+		if visit != nil {
+			visit(block, ledger, applied, senderPay)
+		}
+	}
+
+	return ledger, true
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"math/big"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The size of the modulus of the keys in the tests. Small keys keep the tests fast, but the modulus has
+// to be larger than the hashes which are signed
+const TEST_KEY_BITS = 512
+
+// Returns a state with a genesis block where every key is a king, and every draw wins
+func newTestState(t *testing.T, kings []KeyPair) *State {
+	t.Helper()
+	setLogLevels("off")
+
+	var kingKeys []string
+	for _, pair := range kings {
+		kingKeys = append(kingKeys, pair.Pk.toString())
+	}
+
+	genesis := NewGenesisBlock(kings[0], kingKeys, SEED, time.Time{})
+	genesis.Hardness = new(big.Int)
+	genesis.Sign(kings[0])
+
+	s := &State{}
+	if err := s.setGenesisBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func newTestKeys(n int) []KeyPair {
+	var pairs []KeyPair
+	for i := 0; i < n; i++ {
+		pairs = append(pairs, KeyGen(TEST_KEY_BITS))
+	}
+
+	return pairs
+}
+
+func signTestTransaction(id string, from KeyPair, to KeyPair, amount int) SignedTransaction {
+	transaction := SignedTransaction{ID: id, From: from.Pk.toString(), To: to.Pk.toString(), Amount: amount}
+	transaction.Signature = Sign(GenerateMessageFromTransaction(&transaction), from.Sk).String()
+
+	return transaction
+}
+
+// Makes a block like Client.generateBlock does, with the transactions the state has
+func signTestBlock(s *State, slot int, previous *Block, sender KeyPair, transactions []string) *Block {
+	txRoot, _ := s.txRoot(transactions)
+	block := NewBlock(slot, previous.Signature, sender.Pk.toString(), transactions, txRoot, GenerateDraw(s.genesisBlock.Seed, slot, sender.Sk))
+	block.StateRoot, _ = s.stateRoot(block)
+	block.Signature = Sign(GenerateMessageFromBlock(block), sender.Sk).String()
+
+	return block
+}
+
+func TestSetGenesisBlockRejectsInvalid(t *testing.T) {
+	keys := newTestKeys(2)
+
+	genesis := NewGenesisBlock(keys[0], []string{keys[0].Pk.toString()}, SEED, time.Time{})
+	genesis.Seed++ // No longer matches the signed parameters
+
+	s := &State{}
+	if err := s.setGenesisBlock(genesis); err == nil {
+		t.Fatal("accepted a genesis block with changed parameters")
+	}
+
+	if s.genesisBlock != nil || len(s.blocks) != 0 {
+		t.Fatal("a rejected genesis block changed the state")
+	}
+}
+
+func TestApplyTransactionVerdicts(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestState(t, keys)
+
+	transaction := signTestTransaction("t1", keys[0], keys[1], 10)
+
+	tampered := transaction
+	tampered.Amount = 20
+
+	zero := signTestTransaction("t2", keys[0], keys[1], 0)
+
+	malformed := signTestTransaction("t3", keys[0], keys[1], 10)
+	malformed.From = "not a key"
+
+	notANumber := signTestTransaction("t6", keys[0], keys[1], 10)
+	notANumber.Signature = "not-a-number"
+
+	tests := []struct {
+		name        string
+		transaction SignedTransaction
+		verdict     Verdict
+	}{
+		{"new", transaction, VERDICT_USEFUL},
+		{"again", transaction, VERDICT_DUPLICATE},
+		{"another", signTestTransaction("t4", keys[0], keys[1], 10), VERDICT_USEFUL},
+		{"zero amount", zero, VERDICT_INVALID},
+		{"malformed sender", malformed, VERDICT_INVALID},
+		{"signature isn't a number", notANumber, VERDICT_INVALID},
+	}
+
+	for _, test := range tests {
+		if verdict := s.applyTransaction(test.transaction); verdict != test.verdict {
+			t.Errorf("%s: got verdict %d, expected %d", test.name, verdict, test.verdict)
+		}
+	}
+
+	// Same ID as an added transaction, so it's a duplicate before the signature is checked
+	if verdict := s.applyTransaction(tampered); verdict != VERDICT_DUPLICATE {
+		t.Errorf("tampered copy: got verdict %d, expected %d", verdict, VERDICT_DUPLICATE)
+	}
+
+	tampered.ID = "t5"
+	if verdict := s.applyTransaction(tampered); verdict != VERDICT_INVALID {
+		t.Errorf("tampered: got verdict %d, expected %d", verdict, VERDICT_INVALID)
+	}
+
+	if len(s.transactionsReceived) != 2 {
+		t.Errorf("kept %d transactions, expected 2", len(s.transactionsReceived))
+	}
+}
+
+func TestApplyBlockVerdicts(t *testing.T) {
+	keys := newTestKeys(2)
+	outsider := KeyGen(TEST_KEY_BITS)
+	s := newTestState(t, keys)
+	s.currentBlockID = 10
+	genesis := s.genesisBlock.Block
+
+	transaction := signTestTransaction("t1", keys[0], keys[1], 10)
+	if verdict := s.applyTransaction(transaction); verdict != VERDICT_USEFUL {
+		t.Fatalf("got verdict %d for the transaction", verdict)
+	}
+
+	first := signTestBlock(s, 1, genesis, keys[0], []string{transaction.ID})
+
+	// Made by another state which has the first block, so it is an orphan until the first block is added
+	other := &State{}
+	other.setGenesisBlock(s.genesisBlock)
+	other.currentBlockID = s.currentBlockID
+	other.applyTransaction(transaction)
+	other.applyBlock(first)
+	unknownPrevious := signTestBlock(other, 3, first, keys[1], nil)
+
+	badSignature := *signTestBlock(s, 2, genesis, keys[1], nil)
+	badSignature.Signature = Sign([]byte("something else"), keys[1].Sk).String()
+
+	notANumber := *signTestBlock(s, 2, genesis, keys[1], nil)
+	notANumber.Signature = "not-a-number"
+
+	notKing := signTestBlock(s, 2, genesis, outsider, nil)
+
+	wrongStateRoot := *signTestBlock(s, 2, genesis, keys[1], nil)
+	wrongStateRoot.StateRoot = genesis.StateRoot
+	wrongStateRoot.Signature = Sign(GenerateMessageFromBlock(&wrongStateRoot), keys[1].Sk).String()
+
+	missing := signTestTransaction("t2", keys[1], keys[0], 5)
+	missingTransaction := NewBlock(2, genesis.Signature, keys[1].Pk.toString(), []string{missing.ID}, merkleRoot([][]byte{missing.Hash()}), GenerateDraw(SEED, 2, keys[1].Sk))
+	missingTransaction.Signature = Sign(GenerateMessageFromBlock(missingTransaction), keys[1].Sk).String()
+
+	tooFarAhead := signTestBlock(s, 12, genesis, keys[1], nil)
+
+	tests := []struct {
+		name    string
+		block   *Block
+		verdict Verdict
+	}{
+		{"orphan", unknownPrevious, VERDICT_ORPHAN},
+		{"new", first, VERDICT_USEFUL},
+		{"again", first, VERDICT_DUPLICATE},
+		{"bad signature", &badSignature, VERDICT_INVALID},
+		{"signature isn't a number", &notANumber, VERDICT_INVALID},
+		{"sender isn't a king", notKing, VERDICT_INVALID},
+		{"wrong state root", &wrongStateRoot, VERDICT_INVALID},
+		{"missing transaction", missingTransaction, VERDICT_IGNORED},
+		{"slot too far ahead", tooFarAhead, VERDICT_IGNORED},
+	}
+
+	for _, test := range tests {
+		if verdict := s.applyBlock(test.block); verdict != test.verdict {
+			t.Errorf("%s: got verdict %d, expected %d", test.name, verdict, test.verdict)
+		}
+	}
+
+	if head := s.getLongestBlock(MAX_INT); head != first {
+		t.Fatalf("the head is in slot %d, expected the first block", head.ID)
+	}
+
+	// The orphan is only added once its previous block has been added, and applied again
+	for _, orphan := range s.takeOrphans(first.Signature) {
+		if verdict := s.applyBlock(orphan); verdict != VERDICT_USEFUL {
+			t.Errorf("orphan: got verdict %d once its previous block was added", verdict)
+		}
+	}
+
+	// The transaction moves its amount less 1 AU, which goes to the sender of the block. keys[0] sent the
+	// genesis block and the first block, and keys[1] the orphan
+	ledger, _ := s.generateNewestLedger()
+	if balance := ledger.Accounts[keys[0].Pk.toString()]; balance != PREMIUM_ACCOUNT-9+BLOCK_REWARD+BLOCK_REWARD+1 {
+		t.Errorf("the sender of the first block has %d", balance)
+	}
+	if balance := ledger.Accounts[keys[1].Pk.toString()]; balance != PREMIUM_ACCOUNT+9+BLOCK_REWARD {
+		t.Errorf("the receiver of the transaction has %d", balance)
+	}
+}
+
+func TestApplyBlockSkipsTransactionsInEarlierBlocks(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestState(t, keys)
+	s.currentBlockID = 10
+
+	transaction := signTestTransaction("t1", keys[0], keys[1], 10)
+	s.applyTransaction(transaction)
+
+	var previous = s.genesisBlock.Block
+	for slot := 1; slot <= 2; slot++ {
+		block := signTestBlock(s, slot, previous, keys[slot%2], []string{transaction.ID})
+		if verdict := s.applyBlock(block); verdict != VERDICT_USEFUL {
+			t.Fatalf("block in slot %d: got verdict %d", slot, verdict)
+		}
+		previous = block
+	}
+
+	ledger, _ := s.generateNewestLedger()
+	if balance := ledger.Accounts[keys[1].Pk.toString()]; balance != PREMIUM_ACCOUNT+9+BLOCK_REWARD+1 {
+		t.Errorf("the transaction was applied twice, the receiver has %d", balance)
+	}
+}
+
+func TestGossipedKeyDoesNotPinAddress(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestState(t, keys)
+	address := "10.0.0.1:7000"
+
+	// Anyone can claim an address in an ADDR
+	s.markPeerSeen(Peer{address, keys[0].Pk.toString()}, time.Now())
+	if s.getBoundPeer(address) != nil {
+		t.Fatal("a key from gossip was bound to the address")
+	}
+
+	// Dialing the address proves which key the peer there has
+	pc := &PeerConn{remote: &Hello{Pk: keys[1].Pk.toString(), ListenAddress: address}, dialed: address}
+	s.bindDialedPeer(pc)
+
+	if peer := s.getBoundPeer(address); peer == nil || peer.Pk != keys[1].Pk.toString() {
+		t.Fatal("the key proven by dialing wasn't bound to the address")
+	}
+
+	// A peer which dialed this side only claims its address, so it can't take over the binding
+	pc = &PeerConn{remote: &Hello{Pk: keys[0].Pk.toString(), ListenAddress: address}}
+	s.bindDialedPeer(pc)
+
+	if peer := s.getBoundPeer(address); peer.Pk != keys[1].Pk.toString() {
+		t.Fatal("a peer which dialed replaced the bound key")
+	}
+}
+
+func TestReorgDepth(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestState(t, keys)
+	s.currentBlockID = 10
+	genesis := s.genesisBlock.Block
+
+	// One branch of three blocks, and another of one block, both from the genesis block
+	var long []*Block
+	previous := genesis
+	for slot := 1; slot <= 3; slot++ {
+		block := signTestBlock(s, slot, previous, keys[0], nil)
+		s.applyBlock(block)
+		long = append(long, block)
+		previous = block
+	}
+
+	short := signTestBlock(s, 4, genesis, keys[1], nil)
+	s.applyBlock(short)
+
+	tests := []struct {
+		name    string
+		oldHead *Block
+		newHead *Block
+		depth   int
+	}{
+		{"same head", long[2], long[2], 0},
+		{"extended", long[1], long[2], 0},
+		{"to the shorter branch", long[2], short, 3},
+		{"to the longer branch", short, long[2], 1},
+		{"back to an ancestor", long[2], long[0], 2},
+	}
+
+	for _, test := range tests {
+		if depth := s.reorgDepth(test.oldHead, test.newHead); depth != test.depth {
+			t.Errorf("%s: got depth %d, expected %d", test.name, depth, test.depth)
+		}
+	}
+}
+
+func TestGenesisParamsAreSigned(t *testing.T) {
+	keys := newTestKeys(1)
+
+	genesis := NewGenesisBlock(keys[0], []string{keys[0].Pk.toString()}, SEED, time.Unix(100000000, 0))
+	genesis.Hardness = big.NewInt(12345)
+	genesis.Sign(keys[0])
+	if !genesis.isValid() {
+		t.Fatal("a signed genesis block isn't valid")
+	}
+
+	// Moves the last digit of the hardness to the front of the start time
+	start, err := strconv.ParseInt("5"+strconv.FormatInt(genesis.StartTime.UnixNano(), 10), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis.Hardness = big.NewInt(1234)
+	genesis.StartTime = time.Unix(0, start)
+
+	if genesis.isValid() {
+		t.Fatal("accepted a genesis block with a changed hardness")
+	}
+}
+
+func TestStatesArePrunedBelowFinality(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestChain(t, keys, FINALITY_DEPTH+4)
+	head := s.getLongestBlock(MAX_INT)
+
+	state, _ := s.stateAfter(head)
+	if state.balances != state.ledger.Root() {
+		t.Error("the tree made block by block has another root than the ledger")
+	}
+
+	if kept := s.states[s.genesisBlock.Signature]; kept.ledger != nil {
+		t.Error("the ledger of a final block is kept")
+	}
+
+	// A final block keeps its roots, and its balances are made again when they are needed
+	first := s.blocks[1]
+	if root, _ := s.stateRoot(first); root != first.StateRoot {
+		t.Error("the state root of a final block changed")
+	}
+
+	ledger, ok := s.ledgerAfter(first)
+	replayed, _ := s.generateLedgerForBlock(first)
+	if !ok || !ledger.Match(replayed) {
+		t.Error("the balances of a final block can't be made again")
+	}
+
+	if s.states[first.Signature].ledger != nil {
+		t.Error("the balances of a final block are kept after they are made again")
+	}
+
+	// A block can still be built on a final block
+	s.currentBlockID++
+	fork := signTestBlock(s, s.currentBlockID, first, keys[0], []string{"t1"})
+	if verdict := s.applyBlock(fork); verdict != VERDICT_USEFUL {
+		t.Errorf("a block after a final block got verdict %d", verdict)
+	}
+}
+
+func TestHistoryFollowsAReorg(t *testing.T) {
+	keys := newTestKeys(2)
+	s := newTestChain(t, keys, 3)
+	s.updateHistory()
+
+	// A longer branch after the first block, with a transaction of the old branch
+	s.currentBlockID = 6
+	previous := s.blocks[1]
+	for slot := 4; slot <= 6; slot++ {
+		block := signTestBlock(s, slot, previous, keys[0], []string{"t2"})
+		if verdict := s.applyBlock(block); verdict != VERDICT_USEFUL {
+			t.Fatalf("block in slot %d: got verdict %d", slot, verdict)
+		}
+		previous = block
+	}
+	s.updateHistory()
+	rewound := s.history
+
+	s.history = nil
+	s.updateHistory()
+
+	if !reflect.DeepEqual(rewound.chain, s.history.chain) || !rewound.ledger.Match(s.history.ledger) {
+		t.Error("the index is on another chain than one built from the genesis block")
+	}
+
+	if !reflect.DeepEqual(rewound.entries, s.history.entries) {
+		t.Error("the index has other entries than one built from the genesis block")
+	}
+}
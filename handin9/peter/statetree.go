@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// Blocks commit to the balances after them with the root of a sparse Merkle tree, which is combined
+// with the root of the used transactions into the state root in the header. The tree has a leaf for
+// every possible account: the path to an account's leaf is the 256 bits of the hash of its key, and
+// the leaves of accounts with a balance of 0 are empty. An empty subtree hashes to 32 zero bytes, so
+// only the paths to the non-empty leaves have to be hashed, and two ledgers with the same balances
+// have the same root, whatever order the accounts were added in. A balance is proven with the hashes
+// of the non-empty subtrees next to the path, which also proves that an account has nothing.
+
+const STATE_TREE_DEPTH = 256
+
+var EMPTY_STATE_NODE = make([]byte, sha256.Size)
+
+type stateLeaf struct {
+	key  []byte // The hash of the account
+	hash []byte
+}
+
+// The hash of a non-empty subtree next to the path to a leaf
+type StateStep struct {
+	Depth int    `json:"depth"` // The number of bits of the key above the subtree
+	Hash  string `json:"hash"`
+}
+
+// Proves the balance of an account after a block, given only the block's header
+type BalanceProof struct {
+	Block   string      `json:"block"` // The signature of the block
+	Account string      `json:"account"`
+	Balance int         `json:"balance"`
+	Path    []StateStep `json:"path"` // By depth, the empty subtrees are left out
+	Used    string      `json:"used"` // The root of the used transactions after the block, see usedRoot
+}
+
+func stateKey(account string) []byte {
+	key := sha256.Sum256([]byte(account))
+	return key[:]
+}
+
+// Returns the bit of the key at the depth. 0 goes left, and 1 goes right
+func keyBit(key []byte, depth int) byte {
+	return (key[depth/8] >> (7 - uint(depth%8))) & 1
+}
+
+func stateLeafHash(key []byte, balance int) []byte {
+	if balance == 0 {
+		return EMPTY_STATE_NODE
+	}
+
+	amount := make([]byte, 8)
+	binary.BigEndian.PutUint64(amount, uint64(int64(balance)))
+
+	return merkleLeaf(append(append([]byte{}, key...), amount...))
+}
+
+func stateNode(left []byte, right []byte) []byte {
+	if isEmptyStateNode(left) && isEmptyStateNode(right) {
+		return EMPTY_STATE_NODE
+	}
+
+	return merkleNode(left, right)
+}
+
+func isEmptyStateNode(hash []byte) bool {
+	for _, b := range hash {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the non-empty leaves of the ledger, sorted by key
+func stateLeaves(ledger *Ledger) []stateLeaf {
+	var leaves []stateLeaf
+	for account, balance := range ledger.Accounts {
+		if balance != 0 {
+			key := stateKey(account)
+			leaves = append(leaves, stateLeaf{key, stateLeafHash(key, balance)})
+		}
+	}
+
+	sort.Slice(leaves, func(i, j int) bool { return string(leaves[i].key) < string(leaves[j].key) })
+
+	return leaves
+}
+
+// Returns the hash of the subtree at the depth which holds the leaves. They are sorted, so the ones
+// going left come first
+func stateSubtree(leaves []stateLeaf, depth int) []byte {
+	if len(leaves) == 0 {
+		return EMPTY_STATE_NODE
+	}
+
+	if depth == STATE_TREE_DEPTH {
+		return leaves[0].hash
+	}
+
+	split := sort.Search(len(leaves), func(i int) bool { return keyBit(leaves[i].key, depth) == 1 })
+
+	return stateNode(stateSubtree(leaves[:split], depth+1), stateSubtree(leaves[split:], depth+1))
+}
+
+// Returns the root of the sparse Merkle tree over the balances, as hex
+func (l *Ledger) Root() string {
+	return hex.EncodeToString(stateSubtree(stateLeaves(l), 0))
+}
+
+// A node of the sparse Merkle tree, where nil is an empty subtree. Nodes are never changed, so the
+// tree after a block shares everything but the paths to the changed balances with the one before it
+type stateTreeNode struct {
+	hash  []byte
+	left  *stateTreeNode
+	right *stateTreeNode
+}
+
+// Returns the tree over the balances of the ledger
+func newStateTree(ledger *Ledger) *stateTreeNode {
+	var tree *stateTreeNode
+	for account, balance := range ledger.Accounts {
+		key := stateKey(account)
+		tree = tree.set(key, stateLeafHash(key, balance), 0)
+	}
+
+	return tree
+}
+
+func (n *stateTreeNode) Hash() []byte {
+	if n == nil {
+		return EMPTY_STATE_NODE
+	}
+
+	return n.hash
+}
+
+// Returns the tree below this node, at the depth, with the leaf of the key set to the hash
+func (n *stateTreeNode) set(key []byte, leaf []byte, depth int) *stateTreeNode {
+	if depth == STATE_TREE_DEPTH {
+		if isEmptyStateNode(leaf) {
+			return nil
+		}
+
+		return &stateTreeNode{hash: leaf}
+	}
+
+	var left, right *stateTreeNode
+	if n != nil {
+		left, right = n.left, n.right
+	}
+
+	if keyBit(key, depth) == 0 {
+		left = left.set(key, leaf, depth+1)
+	} else {
+		right = right.set(key, leaf, depth+1)
+	}
+
+	if left == nil && right == nil {
+		return nil
+	}
+
+	return &stateTreeNode{stateNode(left.Hash(), right.Hash()), left, right}
+}
+
+// Returns the hashes of the non-empty subtrees next to the path to the account
+func (l *Ledger) statePath(account string) []StateStep {
+	key := stateKey(account)
+	leaves := stateLeaves(l)
+
+	var path []StateStep
+	for depth := 0; depth < STATE_TREE_DEPTH && len(leaves) > 0; depth++ {
+		var same, other []stateLeaf
+		for _, leaf := range leaves {
+			if keyBit(leaf.key, depth) == keyBit(key, depth) {
+				same = append(same, leaf)
+			} else {
+				other = append(other, leaf)
+			}
+		}
+
+		if len(other) > 0 {
+			path = append(path, StateStep{depth, hex.EncodeToString(stateSubtree(other, depth+1))})
+		}
+
+		leaves = same
+	}
+
+	return path
+}
+
+// Returns the root the path leads to from the balance
+func (p BalanceProof) root() (string, error) {
+	siblings := make(map[int][]byte)
+	for _, step := range p.Path {
+		hash, err := hex.DecodeString(step.Hash)
+		if err != nil || len(hash) != sha256.Size || step.Depth < 0 || step.Depth >= STATE_TREE_DEPTH {
+			return "", errors.New("malformed step in the proof")
+		}
+
+		if _, ok := siblings[step.Depth]; ok {
+			return "", errors.New("two steps in the proof have the same depth")
+		}
+		siblings[step.Depth] = hash
+	}
+
+	key := stateKey(p.Account)
+	node := stateLeafHash(key, p.Balance)
+
+	for depth := STATE_TREE_DEPTH - 1; depth >= 0; depth-- {
+		sibling, ok := siblings[depth]
+		if !ok {
+			sibling = EMPTY_STATE_NODE
+		}
+
+		if keyBit(key, depth) == 0 {
+			node = stateNode(node, sibling)
+		} else {
+			node = stateNode(sibling, node)
+		}
+	}
+
+	return stateRoot(hex.EncodeToString(node), p.Used), nil
+}
+
+// The state root also commits to the transactions which have been used, since later blocks skip them.
+// The used transactions are a chain of hashes over the IDs in each block, so the root after a block
+// follows from the one before it, and a snapshot can't leave any of them out
+func usedRoot(previous string, ids []string) string {
+	sha := sha256.New()
+	sha.Write([]byte(previous))
+	for _, id := range ids {
+		sha.Write([]byte(strconv.Itoa(len(id)) + ":" + id)) // The length keeps the IDs apart
+	}
+
+	return hex.EncodeToString(sha.Sum(nil))
+}
+
+// Returns the state root of a header, from the root of the balances and the root of the used transactions
+func stateRoot(balances string, used string) string {
+	sum := sha256.Sum256([]byte(balances + "|" + used))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checks that the account had the balance after the block with the header, and that the header is signed by its sender
+func VerifyBalanceProof(header BlockHeader, proof BalanceProof) error {
+	if proof.Block != header.Signature {
+		return errors.New("the proof is for another block")
+	}
+
+	if !header.isValid() {
+		return errors.New("the header isn't signed by its sender")
+	}
+
+	root, err := proof.root()
+	if err != nil {
+		return err
+	}
+
+	if root != header.StateRoot {
+		return errors.New("the balance doesn't match the state root of the block")
+	}
+
+	return nil
+}
+
+// The state after a block. It is made from the state after the previous block, so a new block only
+// costs the accounts it changes. The ledger and the tree are dropped once the block is final, see pruneStates
+type blockState struct {
+	ledger   *Ledger        // Must not be changed, since the state of the next block starts from a copy of it
+	tree     *stateTreeNode // The sparse Merkle tree over the balances in the ledger
+	balances string         // The root of the tree, as hex
+	used     string         // The root of the used transactions, see usedRoot
+}
+
+// Returns the state after the block, which doesn't have to be added yet, but whose previous block has
+// to be. The states of added blocks are kept, so only the blocks since the last kept one are applied.
+// Returns false if some transactions are missing
+func (s *State) stateAfter(block *Block) (*blockState, bool) {
+	var blocks []*Block
+	var state *blockState
+
+	// Walk back to the nearest block whose state is kept in full
+	for b := block; state == nil; {
+		if kept, ok := s.states[b.Signature]; ok && kept.ledger != nil && s.blocksBySignature[b.Signature] == b {
+			state = kept
+			break
+		}
+		blocks = append(blocks, b)
+
+		if b.PreviousBlock == "" {
+			ledger := s.genesisBlock.allocationLedger()
+			state = &blockState{ledger: ledger, tree: newStateTree(ledger)}
+			break
+		}
+
+		if b = s.getBlockBySignature(b.PreviousBlock); b == nil {
+			return nil, false
+		}
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		next, ok := s.nextState(state, blocks[i])
+		if !ok {
+			return nil, false
+		}
+		state = next
+
+		// A final block only keeps its roots, so it isn't kept in full again
+		if _, ok := s.states[blocks[i].Signature]; !ok && s.blocksBySignature[blocks[i].Signature] == blocks[i] {
+			s.states[blocks[i].Signature] = state
+		}
+	}
+
+	return state, true
+}
+
+// Returns the state after the block, given the state after the previous block
+func (s *State) nextState(previous *blockState, block *Block) (*blockState, bool) {
+	ledger := previous.ledger.Copy()
+
+	// Transactions in earlier blocks are skipped, like replayChain does
+	if _, _, ok := s.applyBlockToLedger(block, ledger, s.usedBefore(block)); !ok {
+		return nil, false
+	}
+
+	tree := previous.tree
+	for account, balance := range ledger.Accounts {
+		if balance != previous.ledger.Accounts[account] {
+			key := stateKey(account)
+			tree = tree.set(key, stateLeafHash(key, balance), 0)
+		}
+	}
+
+	return &blockState{ledger, tree, hex.EncodeToString(tree.Hash()), usedRoot(previous.used, block.Transactions)}, true
+}
+
+// Returns the transactions of the block which are in a block on the chain before it, for applyBlockToLedger
+func (s *State) usedBefore(block *Block) map[string]bool {
+	used := make(map[string]bool)
+	for _, id := range block.Transactions {
+		if s.isUsedBefore(id, block) {
+			used[id] = true
+		}
+	}
+
+	return used
+}
+
+// Returns true if the transaction is in a block on the chain before the block, or before the snapshot
+func (s *State) isUsedBefore(id string, block *Block) bool {
+	if s.snapshot != nil && s.snapshot.used[id] {
+		return true
+	}
+
+	previous := s.getBlockBySignature(block.PreviousBlock)
+	for _, signature := range s.transactionBlocks[id] {
+		if s.isAncestor(s.getBlockBySignature(signature), previous) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the ancestor is the block, or one of the blocks before it
+func (s *State) isAncestor(ancestor *Block, block *Block) bool {
+	for block != nil && s.heights[block.Signature] > s.heights[ancestor.Signature] {
+		block = s.getBlockBySignature(block.PreviousBlock)
+	}
+
+	return block == ancestor
+}
+
+// Drops the ledger and the tree of the block FINALITY_DEPTH+1 blocks below the block, keeping its roots.
+// Blocks are rarely built on a final block, and their state is made from the genesis block when they are
+func (s *State) pruneStates(block *Block) {
+	for i := 0; i <= FINALITY_DEPTH && block != nil; i++ {
+		block = s.getBlockBySignature(block.PreviousBlock)
+	}
+
+	// The client can't go below the block it was started from
+	if block == nil || s.isSnapshotBase(block) {
+		return
+	}
+
+	if state, ok := s.states[block.Signature]; ok {
+		state.ledger, state.tree = nil, nil
+	}
+}
+
+// Returns the balances after the block, like stateAfter. The ledger must not be changed
+func (s *State) ledgerAfter(block *Block) (*Ledger, bool) {
+	state, ok := s.stateAfter(block)
+	if !ok {
+		return nil, false
+	}
+
+	return state.ledger, true
+}
+
+// Returns the state root after the block, or false if some transactions are missing
+func (s *State) stateRoot(block *Block) (string, bool) {
+	if state, ok := s.states[block.Signature]; ok && s.blocksBySignature[block.Signature] == block {
+		return stateRoot(state.balances, state.used), true
+	}
+
+	state, ok := s.stateAfter(block)
+	if !ok {
+		return "", false
+	}
+
+	return stateRoot(state.balances, state.used), true
+}
+
+// Returns a proof of the balance of the account after the block
+func (s *State) balanceProof(signature string, account string) (BalanceProof, error) {
+	block := s.getBlockBySignature(signature)
+	if block == nil {
+		return BalanceProof{}, errors.New("no block with that signature")
+	}
+
+	state, ok := s.stateAfter(block)
+	if !ok {
+		return BalanceProof{}, errors.New("some of the transactions of the chain are missing")
+	}
+
+	return BalanceProof{Block: signature, Account: account, Balance: state.ledger.Accounts[account], Path: state.ledger.statePath(account), Used: state.used}, nil
+}
+
+// Params: {"account": pk or address, "block": signature}. The block is the head if it is left out.
+// Returns the header of the block and the proof, which holds the balance
+func (rpc *RPCServer) getBalanceProof(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Account string `json:"account"`
+		Block   string `json:"block"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	c := rpc.client
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pk := p.Account
+	if peer := c.State.GetPeerFromIP(p.Account); peer != nil {
+		pk = peer.Pk
+	}
+
+	if !isValidKeyString(pk) {
+		return nil, invalidParamsError{"account has to be a public key, or the address of a known peer"}
+	}
+
+	signature := p.Block
+	if signature == "" {
+		signature = c.getLongestBlock(MAX_INT).Signature
+	}
+
+	proof, err := c.balanceProof(signature, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"header": headerToJSON(&c.getBlockBySignature(signature).BlockHeader),
+		"proof":  proof,
+	}, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+// Fetching the blocks and transactions a client has missed. Gossip only reaches the clients which
+// are connected when it's sent, so a client which was partitioned away, or lost a message, gets
+// blocks whose previous block it has never seen. Such a block is kept as an orphan, and the
+// previous block is asked for (GET_BLOCK) from the peer which sent it, until the chains connect.
+
+func (s *State) isOrphan(block *Block) bool {
+	for _, orphan := range s.orphans[block.PreviousBlock] {
+		if orphan.Signature == block.Signature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keeps a block until its previous block arrives. Once MAX_ORPHANS are kept, new ones are dropped
+func (s *State) addOrphan(block *Block) {
+	if s.numOrphans >= MAX_ORPHANS {
+		return
+	}
+
+	if s.orphans == nil {
+		s.orphans = make(map[string][]*Block)
+	}
+
+	s.orphans[block.PreviousBlock] = append(s.orphans[block.PreviousBlock], block)
+	s.numOrphans++
+}
+
+// Removes and returns the orphans whose previous block is the given block, so they can be applied again
+func (s *State) takeOrphans(signature string) []*Block {
+	children := s.orphans[signature]
+	delete(s.orphans, signature)
+	s.numOrphans -= len(children)
+
+	return children
+}
+
+// Returns the IDs of the transactions in the block which this client doesn't have
+func (s *State) missingTransactions(block *Block) []string {
+	var missing []string
+	for _, id := range block.Transactions {
+		if _, ok := s.transactionsByID[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+
+	return missing
+}
+
+// Returns a block and the transactions in it which this client has, or nil if it doesn't have the block
+func (s *State) blockWithTransactions(signature string) (*Block, []SignedTransaction) {
+	// Without the body, the block would look invalid to the peer
+	block := s.getBlockBySignature(signature)
+	if block == nil || s.isHeaderOnly(signature) {
+		return nil, nil
+	}
+
+	var transactions []SignedTransaction
+	for _, id := range block.Transactions {
+		if transaction, ok := s.transactionsByID[id]; ok {
+			transactions = append(transactions, transaction)
+		}
+	}
+
+	return block, transactions
+}
+
+// Asks the peer which sent a block for what is needed to use it: the previous block of an orphan,
+// or the block again, with its transactions, if some of them are missing. A block is only accepted
+// with all its transactions, since they are needed to check its Merkle root
+func (c *Client) requestMissing(pc *PeerConn, block *Block, verdict Verdict) {
+	switch verdict {
+	case VERDICT_ORPHAN:
+		c.queueMessage(pc, Message{ID: GET_BLOCK_MESSAGE, Value: block.PreviousBlock})
+
+	case VERDICT_IGNORED:
+		c.lock.Lock()
+		missing := c.missingTransactions(block)
+		c.lock.Unlock()
+
+		if len(missing) > 0 {
+			c.queueMessage(pc, Message{ID: GET_BLOCK_MESSAGE, Value: block.Signature})
+		}
+	}
+}
+
+// Sends the transactions of the block, and then the block itself
+func (c *Client) handleGetBlock(pc *PeerConn, signature string) {
+	c.lock.Lock()
+	block, transactions := c.blockWithTransactions(signature)
+	c.lock.Unlock()
+
+	if block == nil {
+		return
+	}
+
+	for _, transaction := range transactions {
+		c.queueMessage(pc, Message{ID: TRANSACTION_MESSAGE, Value: transaction})
+	}
+
+	c.queueMessage(pc, Message{ID: BLOCK_MESSAGE, Value: *block})
+}
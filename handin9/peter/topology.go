@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// A Topology decides which peers a client connects to. The peer manager dials the candidates
+// from the front of the list, until it has OutboundTarget connections.
+type Topology interface {
+	Name() string
+
+	// Orders the known peers, which never include self, by how much self should connect to them.
+	// Random choices come from random, so a seeded client makes the same ones
+	Candidates(self Peer, known []Peer, random *rand.Rand) []Peer
+
+	// How many outbound connections a client should keep, when numKnown peers are known
+	OutboundTarget(numKnown int) int
+}
+
+var TOPOLOGIES = []Topology{RingTopology{}, RandomTopology{}, KademliaTopology{}, MeshTopology{}}
+
+func GetTopology(name string) Topology {
+	for _, topology := range TOPOLOGIES {
+		if topology.Name() == strings.ToLower(name) {
+			return topology
+		}
+	}
+
+	return nil
+}
+
+func TopologyNames() []string {
+	var names []string
+	for _, topology := range TOPOLOGIES {
+		names = append(names, topology.Name())
+	}
+
+	return names
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// Connects to the peers after self in the list sorted by address, with wrap around
+type RingTopology struct{}
+
+func (RingTopology) Name() string {
+	return "ring"
+}
+
+func (RingTopology) Candidates(self Peer, known []Peer, random *rand.Rand) []Peer {
+	sorted := append([]Peer{}, known...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Address < sorted[j].Address
+	})
+
+	// Find where self would be in the list, and start right after it
+	index := sort.Search(len(sorted), func(i int) bool {
+		return sorted[i].Address > self.Address
+	})
+
+	return append(sorted[index:], sorted[:index]...)
+}
+
+func (RingTopology) OutboundTarget(numKnown int) int {
+	return minInt(TARGET_OUTBOUND, numKnown)
+}
+
+// Connects to random peers
+type RandomTopology struct{}
+
+func (RandomTopology) Name() string {
+	return "random"
+}
+
+func (RandomTopology) Candidates(self Peer, known []Peer, random *rand.Rand) []Peer {
+	shuffled := append([]Peer{}, known...)
+	random.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	return shuffled
+}
+
+func (RandomTopology) OutboundTarget(numKnown int) int {
+	return minInt(TARGET_OUTBOUND, numKnown)
+}
+
+// Like Kademlia, the distance between two peers is the XOR of the hashes of their public keys.
+// Peers are grouped in buckets by the highest bit of the distance, and the closest peer of each
+// bucket comes first. This gives every client both close and far neighbours, and a small diameter.
+type KademliaTopology struct{}
+
+func (KademliaTopology) Name() string {
+	return "kademlia"
+}
+
+func hashKey(pk string) *big.Int {
+	sha := sha256.Sum256([]byte(pk))
+	return new(big.Int).SetBytes(sha[:])
+}
+
+func (KademliaTopology) Candidates(self Peer, known []Peer, random *rand.Rand) []Peer {
+	selfHash := hashKey(self.Pk)
+
+	buckets := make(map[int][]Peer)
+	distances := make(map[string]*big.Int)
+
+	for _, peer := range known {
+		distance := new(big.Int).Xor(selfHash, hashKey(peer.Pk))
+		distances[peer.Address] = distance
+
+		bucket := distance.BitLen()
+		buckets[bucket] = append(buckets[bucket], peer)
+	}
+
+	var bucketIDs []int
+	for id, bucket := range buckets {
+		bucketIDs = append(bucketIDs, id)
+		sort.Slice(bucket, func(i, j int) bool {
+			return distances[bucket[i].Address].Cmp(distances[bucket[j].Address]) < 0
+		})
+	}
+	sort.Ints(bucketIDs)
+
+	// Take the closest remaining peer from each bucket in turn
+	var candidates []Peer
+	for len(candidates) < len(known) {
+		for _, id := range bucketIDs {
+			if len(buckets[id]) > 0 {
+				candidates = append(candidates, buckets[id][0])
+				buckets[id] = buckets[id][1:]
+			}
+		}
+	}
+
+	return candidates
+}
+
+func (KademliaTopology) OutboundTarget(numKnown int) int {
+	return minInt(TARGET_OUTBOUND, numKnown)
+}
+
+// Connects every client to every other client. Only meant for small tests
+type MeshTopology struct{}
+
+func (MeshTopology) Name() string {
+	return "mesh"
+}
+
+func (MeshTopology) Candidates(self Peer, known []Peer, random *rand.Rand) []Peer {
+	return known
+}
+
+func (MeshTopology) OutboundTarget(numKnown int) int {
+	return numKnown
+}
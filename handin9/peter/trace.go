@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing shows how a transaction or block spreads through the overlay. The client which makes it
+// gives the message a trace ID, and every client which passes it on adds one to its hop count.
+// Each client records when it first saw the message, who it got it from and who it passed it on
+// to, and "trace" puts the records of all the clients in a network together into a tree.
+
+// What a single client knows about a traced message
+type TraceRecord struct {
+	TraceID     string
+	Type        string    // The ID of the message, like transMsg
+	FirstSeen   time.Time // When the message was first made or received
+	From        string    // The address of the peer it was first received from. Empty on the client which made it
+	Hops        int       // How many times the message was passed on before it got here
+	ForwardedTo []string  // The addresses of the peers it was passed on to
+	Duplicates  int       // How many more times it was received, after the first
+}
+
+type Tracer struct {
+	lock    sync.Mutex
+	records map[string]*TraceRecord
+	order   []string // The trace IDs, oldest first, so the oldest can be forgotten
+}
+
+func NewTracer() *Tracer {
+	return &Tracer{records: make(map[string]*TraceRecord)}
+}
+
+// Records a message, if it is traced and hasn't been seen before. from is empty if this client made it
+func (t *Tracer) Seen(msg Message, from string, now time.Time) {
+	if msg.TraceID == "" {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if record, ok := t.records[msg.TraceID]; ok {
+		record.Duplicates++
+		return
+	}
+
+	if len(t.order) >= MAX_TRACES {
+		delete(t.records, t.order[0])
+		t.order = t.order[1:]
+	}
+
+	t.records[msg.TraceID] = &TraceRecord{TraceID: msg.TraceID, Type: msg.ID, FirstSeen: now, From: from, Hops: msg.Hops}
+	t.order = append(t.order, msg.TraceID)
+}
+
+func (t *Tracer) Forwarded(msg Message, to string) {
+	if msg.TraceID == "" {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if record, ok := t.records[msg.TraceID]; ok {
+		record.ForwardedTo = append(record.ForwardedTo, to)
+	}
+}
+
+// Returns a copy of the record, or false if this client hasn't seen the message
+func (t *Tracer) Get(traceID string) (TraceRecord, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	record, ok := t.records[traceID]
+	if !ok {
+		return TraceRecord{}, false
+	}
+
+	copied := *record
+	copied.ForwardedTo = append([]string{}, record.ForwardedTo...)
+	return copied, true
+}
+
+// Returns the trace IDs this client has seen, oldest first
+func (t *Tracer) IDs() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return append([]string{}, t.order...)
+}
+
+// Returns a traced copy of a message made by this client, and records it as seen
+func (c *Client) traceOrigin(msg Message, traceID string) Message {
+	msg.TraceID = traceID
+	msg.Hops = 0
+	c.tracer.Seen(msg, "", time.Now())
+
+	return msg
+}
+
+// Returns the address a peer listens on, which is how it is known in the traces of other clients
+func traceAddress(pc *PeerConn) string {
+	if pc.remote != nil && pc.remote.ListenAddress != "" {
+		return pc.remote.ListenAddress
+	}
+
+	return pc.RemoteAddr()
+}
+
+var errTraceNotSeen = errors.New("no client has seen the message")
+
+// The records of all the clients in a network for one message
+type Trace struct {
+	ID       string
+	Origin   string                 // The address of the client which made the message
+	Records  map[string]TraceRecord // By the address of the client
+	Children map[string][]string    // The addresses of the clients which first got the message from each client
+	Clients  int                    // The number of clients in the network
+}
+
+func (n *Network) Trace(traceID string) (*Trace, error) {
+	trace := &Trace{ID: traceID, Records: make(map[string]TraceRecord), Children: make(map[string][]string), Clients: len(n.Clients)}
+
+	for _, client := range n.Clients {
+		record, ok := client.tracer.Get(traceID)
+		if !ok {
+			continue
+		}
+
+		address := client.ownPeer.Address
+		trace.Records[address] = record
+
+		if record.From == "" {
+			trace.Origin = address
+		} else {
+			trace.Children[record.From] = append(trace.Children[record.From], address)
+		}
+	}
+
+	if len(trace.Records) == 0 {
+		return nil, errTraceNotSeen
+	}
+
+	if trace.Origin == "" {
+		return nil, errors.New("seen " + traceID + ", but the client which made it has left the network")
+	}
+
+	for from := range trace.Children {
+		children := trace.Children[from]
+		sort.Slice(children, func(i, j int) bool {
+			return trace.Records[children[i]].FirstSeen.Before(trace.Records[children[j]].FirstSeen)
+		})
+	}
+
+	return trace, nil
+}
+
+// Returns the trace IDs seen by any client in the network, oldest first
+func (n *Network) TraceIDs() []string {
+	seen := make(map[string]bool)
+	var ids []string
+
+	for _, client := range n.Clients {
+		for _, id := range client.tracer.IDs() {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+// Returns how long after the origin each client got the message, sorted
+func (t *Trace) latencies() []time.Duration {
+	start := t.Records[t.Origin].FirstSeen
+
+	var latencies []time.Duration
+	for address, record := range t.Records {
+		if address != t.Origin {
+			latencies = append(latencies, record.FirstSeen.Sub(start))
+		}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	index := int(p * float64(len(sorted)-1))
+	return sorted[index]
+}
+
+func (t *Trace) Print() {
+	start := t.Records[t.Origin].FirstSeen
+
+	fmt.Println("Trace", t.ID, "of a", t.Records[t.Origin].Type, "reached", len(t.Records), "/", t.Clients, "clients")
+
+	var printTree func(address string, depth int)
+	printTree = func(address string, depth int) {
+		record := t.Records[address]
+
+		line := strings.Repeat("  ", depth) + address
+		if record.From == "" {
+			line += " (origin)"
+		} else {
+			line += " +" + record.FirstSeen.Sub(start).Round(time.Microsecond).String() + ", hop " + strconv.Itoa(record.Hops)
+		}
+		line += ", forwarded to " + strconv.Itoa(len(record.ForwardedTo)) + ", " + strconv.Itoa(record.Duplicates) + " duplicate(s)"
+		fmt.Println(line)
+
+		for _, child := range t.Children[address] {
+			printTree(child, depth+1)
+		}
+	}
+	printTree(t.Origin, 0)
+
+	latencies := t.latencies()
+	if len(latencies) == 0 {
+		return
+	}
+
+	fmt.Println("Latency: p50", percentile(latencies, 0.5).Round(time.Microsecond),
+		"p90", percentile(latencies, 0.9).Round(time.Microsecond),
+		"p99", percentile(latencies, 0.99).Round(time.Microsecond),
+		"max", latencies[len(latencies)-1].Round(time.Microsecond))
+
+	duplicates := 0
+	for _, record := range t.Records {
+		duplicates += record.Duplicates
+	}
+	fmt.Println("The clients received", duplicates, "duplicate(s), or", fmt.Sprintf("%.1f", float64(duplicates)/float64(len(t.Records))), "per client")
+}